@@ -1,25 +1,36 @@
 package block
 
 import (
+	"block/p2p"
 	"block/utils"
-	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"net/http"
+	"math"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	MINIG_DIFFICULTY = 3
-	MINIG_SENDER     = "THE BLOCKCHAIN"
-	MINIG_REWARD     = 1.0
-	MINIG_TIMER_SEC  = 20
+	// 最初のブロックの難易度(ハッシュの目標値のcompact表現)
+	// 以降はブロックの生成間隔に合わせて調整される
+	MINIG_INITIAL_BITS = 0x1f0fffff
+	// 最も易しい難易度
+	MINIG_POW_LIMIT_BITS = 0x200fffff
+	MINIG_SENDER         = "THE BLOCKCHAIN"
+	MINIG_REWARD         = 1 * utils.COIN
+	// 目標とするブロックの生成間隔のデフォルト値
+	TARGET_BLOCK_TIME_SEC = 20
+	// 難易度を調整するブロック数の間隔
+	DIFFICULTY_ADJUSTMENT_INTERVAL = 10
+	// ブロックに含めるトランザクションのバイナリ形式の合計サイズの上限(byte)
+	MAX_BLOCK_SIZE = 1000000
 
 	BLOCKCHAIN_PORT_RANGE_START       = 5000
 	BLOCKCHAIN_PORT_RANGE_END         = 5003
@@ -28,29 +39,54 @@ const (
 	BLOCKCHAIN_NEIGHBOR_SYNC_TIME_SEC = 20
 )
 
+var (
+	ErrInvalidSignature    = errors.New("invalid transaction signature")
+	ErrAddressMismatch     = errors.New("sender address does not match the public key")
+	ErrInsufficientBalance = errors.New("not enough balance in a wallet")
+	ErrDuplicateNonce      = errors.New("duplicate nonce")
+	ErrNonceOutOfOrder     = errors.New("nonce out of order")
+	ErrInvalidValue        = errors.New("transaction value must be positive")
+	ErrRewardTransaction   = errors.New("mining reward transactions cannot be submitted")
+	ErrInvalidReward       = errors.New("invalid mining reward")
+	ErrTransactionTooLarge = errors.New("transaction does not fit in a block")
+	ErrBlockTooLarge       = errors.New("block exceeds the maximum size")
+)
+
 type Block struct {
-	timestamp    int64
-	nonce        int
-	previousHash [32]byte
+	header       BlockHeader
 	transactions []*Transaction
 }
 
 // ブロックの新規作成
-func NewBlock(nonce int, previousHash [32]byte, transactions []*Transaction) *Block {
+func NewBlock(header BlockHeader, transactions []*Transaction) *Block {
 	b := new(Block)
-	b.timestamp = time.Now().UnixNano()
-	b.nonce = nonce
-	b.previousHash = previousHash
+	b.header = header
 	b.transactions = transactions
 	return b
 }
 
+func (b *Block) Header() *BlockHeader {
+	return &b.header
+}
+
+func (b *Block) Height() uint64 {
+	return b.header.height
+}
+
 func (b *Block) PreviousHash() [32]byte {
-	return b.previousHash
+	return b.header.previousHash
 }
 
 func (b *Block) Nonce() int {
-	return b.nonce
+	return b.header.nonce
+}
+
+func (b *Block) Bits() uint32 {
+	return b.header.bits
+}
+
+func (b *Block) Timestamp() int64 {
+	return b.header.timestamp
 }
 
 func (b *Block) Transaction() []*Transaction {
@@ -59,60 +95,50 @@ func (b *Block) Transaction() []*Transaction {
 
 // blockのプリント関数
 func (b *Block) Print() {
-	fmt.Printf("timestamp        %d\n", b.timestamp)
-	fmt.Printf("nonce            %d\n", b.nonce)
-	fmt.Printf("previous_hash    %x\n", b.previousHash)
+	b.header.Print()
 	for _, t := range b.transactions {
 		t.Print()
 	}
 }
 
+// ブロックのハッシュはヘッダーのみから計算する
 func (b *Block) Hash() [32]byte {
-	m, _ := json.Marshal(b)
-	return sha256.Sum256([]byte(m))
+	return b.header.Hash()
 }
 
 func (b *Block) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		Timestamp    int64          `json:"timestamp"`
-		Nonce        int            `json:"nonce"`
-		PreviousHash string         `json:"previous_hash"`
+		Header       *BlockHeader   `json:"header"`
 		Transactions []*Transaction `json:"transactions"`
 	}{
-		Timestamp:    b.timestamp,
-		Nonce:        b.nonce,
-		PreviousHash: fmt.Sprintf("%x", b.previousHash),
+		Header:       &b.header,
 		Transactions: b.transactions,
 	})
 }
 
 func (b *Block) UnmarshalJSON(data []byte) error {
-	var previousHash string
 	v := &struct {
-		Timestamp    *int64          `json:"timestamp"`
-		Nonce        *int            `json:"nonce"`
-		PreviousHash *string         `json:"previous_hash"`
+		Header       *BlockHeader    `json:"header"`
 		Transactions *[]*Transaction `json:"transactions"`
 	}{
-		Timestamp:    &b.timestamp,
-		Nonce:        &b.nonce,
-		PreviousHash: &previousHash,
+		Header:       &b.header,
 		Transactions: &b.transactions,
 	}
-	// PreviousHashは空の状態でアンマーシャルを行う
 	if err := json.Unmarshal(data, &v); err != nil {
 		return err
 	}
-	// byteのハッシュに変換
-	ph, _ := hex.DecodeString(*v.PreviousHash)
-	// copy(コピー先, コピー元)
-	copy(b.previousHash[:], ph[:32])
+	for _, t := range b.transactions {
+		if t == nil {
+			return errors.New("null transaction in block")
+		}
+	}
 	return nil
 }
 
 type Blockchain struct {
-	transactionPool []*Transaction
-	chain           []*Block
+	// 未承認トランザクション
+	mempool *Mempool
+	chain   []*Block
 	// (blockchainネットワークからの)報酬の送信先
 	blockchainAddress string
 	// GetBlockchain()の作成より追加
@@ -120,6 +146,34 @@ type Blockchain struct {
 	mux          sync.Mutex
 	neighbors    []string
 	muxNeighbors sync.Mutex
+	// nilの場合はポートの走査でピアを探す
+	peers *p2p.PeerManager
+	// TCPで他のノードと通信する(nilの場合はHTTPのみ)
+	node *p2p.Node
+	// TCPを使う場合も、接続していない近隣ノードにHTTPで送る
+	nodeHTTP bool
+	// ブロックの永続化先(nilの場合はメモリ上のみ)
+	store Store
+	// 他の分岐とorphanも含めて受け取ったブロック
+	tree *BlockTree
+	// 承認済みのブロックから作ったアドレスごとの残高と履歴
+	index *AddressIndex
+	// 承認済みのトランザクションを含むブロックの索引
+	txIndex *TxIndex
+	// 台帳のモデル(LEDGER_ACCOUNTかLEDGER_UTXO)と、UTXOモデルの場合の未使用の出力
+	ledger string
+	utxos  *UTXOSet
+	// reorgが起きたときに呼ぶ関数
+	reorgListeners []func(*ReorgEvent)
+	// 他のノードとの同期の進捗
+	syncProgress SyncProgress
+	// 難易度調整で目標とするブロックの生成間隔
+	targetBlockTime time.Duration
+	startMining     sync.Once
+	miner           *Miner
+	// チェーンの末尾が変わるとキャンセルされるcontext(古い末尾に対するマイニングを中断する)
+	tipCtx    context.Context
+	tipCancel context.CancelFunc
 }
 
 func (bc *Blockchain) Run() {
@@ -130,25 +184,170 @@ func (bc *Blockchain) Run() {
 }
 
 // ブロックチェーンの新規作成
-func NewBlockchain(blockchainAddrdess string, port uint16) *Blockchain {
-	b := &Block{}
+// storeに保存済みのチェーンがあれば検証した上で復元し、なければgenesisブロックを作成する
+// targetBlockTimeは難易度調整で目標とするブロックの生成間隔(チェーンの検証にも使われるため全ノードで同じ値にする)
+// ledgerは台帳のモデル(LEDGER_ACCOUNTかLEDGER_UTXO)で、こちらも全ノードで同じ値にする
+func NewBlockchain(blockchainAddrdess string, port uint16, store Store, targetBlockTime time.Duration, ledger string) (*Blockchain, error) {
+	if ledger != LEDGER_ACCOUNT && ledger != LEDGER_UTXO {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownLedger, ledger)
+	}
 	bc := new(Blockchain)
 	bc.blockchainAddress = blockchainAddrdess
-	bc.CreateBlock(0, b.Hash())
 	bc.port = port
-	return bc
+	bc.store = store
+	bc.targetBlockTime = targetBlockTime
+	bc.miner = NewMiner(runtime.NumCPU())
+	bc.tipCtx, bc.tipCancel = context.WithCancel(context.Background())
+	bc.txIndex = NewTxIndex()
+	bc.tree = NewBlockTree()
+	bc.mempool = NewMempool(DefaultMempoolLimits())
+	bc.index = NewAddressIndex()
+	bc.ledger = ledger
+	if ledger == LEDGER_UTXO {
+		bc.utxos = NewUTXOSet()
+	}
+	if store != nil {
+		chain, err := store.LoadChain()
+		if err != nil {
+			return nil, err
+		}
+		if len(chain) > 0 {
+			if !bc.ValidChain(chain) {
+				return nil, fmt.Errorf("stored chain is invalid")
+			}
+			bc.chain = chain
+			bc.txIndex.replaceChain(nil, chain)
+			bc.tree = NewBlockTreeFromChain(chain)
+			bc.index = NewAddressIndexFromChain(chain)
+			if bc.utxos != nil {
+				bc.utxos = NewUTXOSetFromChain(chain)
+			}
+			log.Printf("action=load_chain, length=%d", len(chain))
+		}
+	}
+	if len(bc.chain) == 0 {
+		h := NewBlockHeader(0, (&BlockHeader{}).Hash(), 0, nil)
+		bc.CreateBlock(*h, nil)
+	}
+	if store != nil {
+		if err := bc.loadTransactionPool(); err != nil {
+			return nil, err
+		}
+	}
+	return bc, nil
+}
+
+// 保存済みの未承認トランザクションを受け付け時と同じ検証をしながら復元する
+// 再起動までの間に無効になったトランザクションは破棄される
+func (bc *Blockchain) loadTransactionPool() error {
+	pool, err := bc.store.LoadTransactionPool()
+	if err != nil {
+		return err
+	}
+	evicted := 0
+	for _, tr := range pool {
+		if !tr.Validate() {
+			evicted += 1
+			continue
+		}
+		t, err := tr.Transaction()
+		if err != nil {
+			evicted += 1
+			continue
+		}
+		if err := bc.addTransaction(t, "", time.Now()); err != nil {
+			evicted += 1
+		}
+	}
+	// 破棄したトランザクションをファイルからも取り除く
+	bc.saveTransactionPool()
+	log.Printf("action=load_transaction_pool, restored=%d, evicted=%d", len(pool)-evicted, evicted)
+	return nil
+}
+
+// 未承認トランザクション全体をストレージに保存する(追記した変更もまとめ直す)
+// 全体を作り直した場合(起動時の復元とチェーンの切り替え)に使う
+func (bc *Blockchain) saveTransactionPool() {
+	bc.mempool.takeChanges()
+	if bc.store == nil {
+		return
+	}
+	pool := make([]*TransactionRequest, 0, bc.mempool.Len())
+	for _, t := range bc.mempool.Transactions() {
+		pool = append(pool, t.Request())
+	}
+	if err := bc.store.SaveTransactionPool(pool); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
+}
+
+// 前回の保存から後のmempoolの変更だけをストレージに追記する
+func (bc *Blockchain) journalTransactionPool() {
+	changes := bc.mempool.takeChanges()
+	if bc.store == nil || len(changes) == 0 {
+		return
+	}
+	journal := make([]*TransactionPoolChange, 0, len(changes))
+	for _, c := range changes {
+		tc := &TransactionPoolChange{TxID: c.id}
+		if c.tx != nil {
+			tc.Transaction = c.tx.Request()
+		}
+		journal = append(journal, tc)
+	}
+	if err := bc.store.AppendTransactionPoolJournal(journal); err != nil {
+		log.Printf("ERROR: %v", err)
+	}
 }
 
 func (bc *Blockchain) Chain() []*Block {
 	return bc.chain
 }
 
+// ピアの管理を設定した場合はアドレスを交換して接続先を決め、ない場合は同じサブネットのポートを走査する
 func (bc *Blockchain) SetNeighbors() {
-	bc.neighbors = utils.FindNeighbors(
-		utils.GetHost(), bc.port,
-		NEIGHBOR_IP_RANGE_START, NEIGHBOR_IP_RANGE_END,
-		BLOCKCHAIN_PORT_RANGE_START, BLOCKCHAIN_PORT_RANGE_END)
+	if bc.peers != nil {
+		bc.peers.Refresh()
+		bc.neighbors = bc.peers.Peers()
+	} else {
+		bc.neighbors = utils.FindNeighbors(
+			utils.GetHost(), bc.port,
+			NEIGHBOR_IP_RANGE_START, NEIGHBOR_IP_RANGE_END,
+			BLOCKCHAIN_PORT_RANGE_START, BLOCKCHAIN_PORT_RANGE_END)
+	}
 	log.Printf("%v", bc.neighbors)
+	if bc.node != nil {
+		bc.node.ConnectAll(bc.neighbors)
+	}
+}
+
+// シードノードとアドレスの交換によってピアを探す(設定しない場合はポートの走査)
+func (bc *Blockchain) SetPeerManager(pm *p2p.PeerManager) {
+	bc.peers = pm
+}
+
+func (bc *Blockchain) PeerManager() *p2p.PeerManager {
+	return bc.peers
+}
+
+// ピアとの通信の失敗を記録する
+func (bc *Blockchain) peerFailed(n string) {
+	if bc.peers != nil {
+		bc.peers.Failed(n)
+	}
+}
+
+// ピアが不正なデータを送ってきたことを記録する
+func (bc *Blockchain) peerMisbehaving(n string, penalty int, reason string) {
+	if bc.peers != nil {
+		bc.peers.Misbehaving(n, penalty, reason)
+	}
+}
+
+func (bc *Blockchain) Neighbors() []string {
+	bc.muxNeighbors.Lock()
+	defer bc.muxNeighbors.Unlock()
+	return append([]string{}, bc.neighbors...)
 }
 
 func (bc *Blockchain) SyncNeighbors() {
@@ -163,15 +362,14 @@ func (bc *Blockchain) StartSyncNeighbors() {
 }
 
 func (bc *Blockchain) TransactionPool() []*Transaction {
-	return bc.transactionPool
-}
-
-// DELETEメソッドの処理
-func (bc *Blockchain) ClearTransactionPool() {
-	bc.transactionPool = bc.transactionPool[:0]
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.mempool.Transactions()
 }
 
 func (bc *Blockchain) MarshalJSON() ([]byte, error) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
 	// 特定のフィールドのみマーシャル
 	return json.Marshal(struct {
 		Blocks []*Block `json:"chain"`
@@ -194,20 +392,35 @@ func (bc *Blockchain) UnmarshalJSON(data []byte) error {
 }
 
 // ブロックの追加
-func (bc *Blockchain) CreateBlock(nonce int, previousHash [32]byte) *Block {
-	b := NewBlock(nonce, previousHash, bc.transactionPool)
+// bc.muxを保持した状態で呼び出すため、他のノードへの送信は行わない(呼び出し側がロックを解放してから送る)
+func (bc *Blockchain) CreateBlock(header BlockHeader, transactions []*Transaction) *Block {
+	b := NewBlock(header, transactions)
+	bc.tree.add(b).verified = true
+	bc.connectBlock(b)
+	return b
+}
+
+// 検証済みのブロックをチェーンの末尾に繋げ、索引と未承認トランザクションを更新する
+// bc.muxを保持した状態で呼び出す
+func (bc *Blockchain) connectBlock(b *Block) {
 	// 新しいブロックチェーンを既存のブロックチェーンのスライスに追加
 	bc.chain = append(bc.chain, b)
-	bc.transactionPool = []*Transaction{}
-	// 他のノードのトランザクションも空にする
-	for _, n := range bc.neighbors {
-		endpoint := fmt.Sprintf("http://%s/transactions", n)
-		client := &http.Client{}
-		req, _ := http.NewRequest("DELETE", endpoint, nil)
-		resp, _ := client.Do(req)
-		log.Printf("%v", resp)
+	bc.tree.pruneStale(bc.chain)
+	bc.txIndex.connectBlock(b)
+	bc.index.connectBlock(b)
+	if bc.utxos != nil {
+		bc.utxos.ConnectBlock(b)
 	}
-	return b
+	if bc.store != nil {
+		if err := bc.store.AppendBlock(b); err != nil {
+			log.Printf("ERROR: %v", err)
+		}
+	}
+	// ブロックに含まれたトランザクションのみmempoolから取り除く
+	// 他のノードも受け取ったブロックを繋げる際に同じように取り除くため、他のノードのmempoolは操作しない
+	bc.removeMinedTransactions(b.transactions)
+	bc.journalTransactionPool()
+	bc.tipChanged()
 }
 
 func (bc *Blockchain) LastBlock() *Block {
@@ -225,265 +438,941 @@ func (bc *Blockchain) Print() {
 }
 
 // POSTメソッドの処理
-func (bc *Blockchain) CreateTransaction(sender string, recipient string, value float32, senderPublicKey *ecdsa.PublicKey, s *utils.Signature) bool {
-	isTransacted := bc.AddTransaction(sender, recipient, value, senderPublicKey, s)
-
-	if isTransacted {
-		for _, n := range bc.neighbors {
-			publicKeyStr := fmt.Sprintf("%064x%064x", senderPublicKey.X.Bytes(),
-				senderPublicKey.Y.Bytes())
-			signatureStr := s.String()
-			bt := &TransactionRequest{
-				&sender, &recipient, &publicKeyStr, &value, &signatureStr}
-			m, _ := json.Marshal(bt)
-			buf := bytes.NewBuffer(m)
-			endpoint := fmt.Sprintf("http://%s/transactions", n)
-			client := &http.Client{}
-			// トランザクションを他のノードと同期
-			req, _ := http.NewRequest("PUT", endpoint, buf)
-			resp, _ := client.Do(req)
-			log.Printf("%v", resp)
-		}
+// 追加したトランザクションのIDを返す
+func (bc *Blockchain) CreateTransaction(sender string, recipient string, value uint64, fee uint64, nonce uint64, senderPublicKey *ecdsa.PublicKey, s *utils.Signature) ([32]byte, error) {
+	t := NewTransaction(sender, recipient, value, fee, nonce)
+	t.senderPublicKey = senderPublicKey
+	t.signature = s
+	return bc.CreateSignedTransaction(t)
+}
+
+// 署名済みのトランザクションを追加し、他のノードにも同期する
+func (bc *Blockchain) CreateSignedTransaction(t *Transaction) ([32]byte, error) {
+	bc.mux.Lock()
+	bc.expireTransactions()
+	err := bc.addTransaction(t, "", time.Now())
+	bc.journalTransactionPool()
+	bc.mux.Unlock()
+	if err != nil {
+		return [32]byte{}, err
 	}
-	return isTransacted
+
+	// トランザクションを他のノードと同期
+	bc.announceTransaction(t)
+	return t.ID(), nil
 }
 
 // PUTメソッドの処理
-func (bc *Blockchain) AddTransaction(sender string, recipient string, value float32, senderPublicKey *ecdsa.PublicKey, s *utils.Signature) bool {
-	t := NewTransaction(sender, recipient, value)
+// マイニングのnonce探索中もロックは短時間しか保持されないため、トランザクションの受付は止まらない
+// 追加したトランザクションのIDを返す
+func (bc *Blockchain) AddTransaction(sender string, recipient string, value uint64, fee uint64, nonce uint64, senderPublicKey *ecdsa.PublicKey, s *utils.Signature) ([32]byte, error) {
+	t := NewTransaction(sender, recipient, value, fee, nonce)
+	t.senderPublicKey = senderPublicKey
+	t.signature = s
+	return bc.AddSignedTransaction(t, "")
+}
 
-	// マイニングの報酬を受け取るトランザクションの場合
+// 署名済みのトランザクションを他のノードに同期せずに追加する
+// sourceは送ってきたノード
+func (bc *Blockchain) AddSignedTransaction(t *Transaction, source string) ([32]byte, error) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	bc.expireTransactions()
+	err := bc.addTransaction(t, source, time.Now())
+	bc.journalTransactionPool()
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return t.ID(), nil
+}
+
+// sourceは送ってきたノード、arrivalは受け付けた時刻(mempoolの期限の起点)
+// bc.muxを保持した状態で呼び出す(ストレージへの保存は呼び出し側で行う)
+func (bc *Blockchain) addTransaction(t *Transaction, source string, arrival time.Time) error {
+	sender := t.senderBlockchainAddress
+	if bc.mempool.entry(t.ID()) != nil {
+		return ErrAlreadyInMempool
+	}
+
+	// マイニングの報酬はMining()の中でのみ作成する
 	if sender == MINIG_SENDER {
-		bc.transactionPool = append(bc.transactionPool, t)
-		return true
+		log.Println("ERROR: Mining reward transaction submitted")
+		return ErrRewardTransaction
+	}
+	if t.value == 0 {
+		log.Println("ERROR: Invalid transaction value")
+		return ErrInvalidValue
+	}
+	// 台帳のモデルに合わない形式のトランザクションは受け付けない
+	if t.IsUTXO() != (bc.utxos != nil) {
+		log.Printf("ERROR: Transaction does not match the %s ledger", bc.ledger)
+		return ErrLedgerMismatch
+	}
+	cost, ok := t.Cost()
+	if !ok {
+		log.Println("ERROR: Transaction amount overflows")
+		return utils.ErrAmountOverflow
 	}
 
 	// トランザクションの署名が妥当な場合のみトランザクションを追加する
-	if bc.VerifyTransactionSignature(senderPublicKey, s, t) {
-		if bc.CalculateTotalAmount(sender) < value {
-			log.Println("ERROR: Not enough balance in a wallet")
-			return false
-		}
-		bc.transactionPool = append(bc.transactionPool, t)
-		return true
-	} else {
+	// UTXOモデルの場合は入力ごとの署名を後で検証する
+	if !t.IsUTXO() && !bc.VerifyTransactionSignature(t.senderPublicKey, t.signature, t) {
 		log.Println("ERROR: Verify Transaction")
+		return ErrInvalidSignature
+	}
+	if t.senderPublicKey == nil {
+		log.Println("ERROR: Missing sender public key")
+		return ErrInvalidSignature
+	}
+	if utils.PublicKeyToBlockchainAddress(t.senderPublicKey) != sender {
+		log.Println("ERROR: Sender address does not match the public key")
+		return ErrAddressMismatch
+	}
+	if err := bc.checkPendingNonce(sender, t.nonce); err != nil {
+		log.Printf("ERROR: %v", err)
+		return err
+	}
+	if t.Size() > MAX_BLOCK_SIZE-bc.rewardTransactionSize() {
+		log.Println("ERROR: Transaction too large")
+		return ErrTransactionTooLarge
+	}
+	// 入力は承認済みの出力のみとし、未承認のトランザクションが消費している出力は使えない
+	if t.IsUTXO() {
+		if err := t.checkUTXO(bc.utxos, bc.poolSpentOutputs()); err != nil {
+			log.Printf("ERROR: %v", err)
+			return err
+		}
+	}
+	// 承認済みの残高から、同じ送信者の未承認の送金を差し引いた残りで足りるか
+	if spendable := bc.pendingBalance(sender).Spendable(); spendable < cost {
+		log.Println("ERROR: Not enough balance in a wallet")
+		return fmt.Errorf("%w: %s needed, %s spendable after pending transactions", ErrInsufficientBalance,
+			utils.FormatAmount(cost), utils.FormatAmount(spendable))
+	}
+	evicted, err := bc.mempool.add(newMempoolEntry(t, source, arrival))
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return err
 	}
-	return false
+	for _, e := range evicted {
+		log.Printf("action=evict_transaction, txid=%x, fee_rate=%.4f", e.id, e.feeRate)
+	}
+	return nil
+}
+
+// 送信者が次に使うべきnonce(承認済みのトランザクション数)
+func (bc *Blockchain) ConfirmedNonce(blockchainAddress string) uint64 {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.confirmedNonce(blockchainAddress)
+}
+
+func (bc *Blockchain) confirmedNonce(blockchainAddress string) uint64 {
+	return bc.index.Nonce(blockchainAddress)
+}
+
+// 未承認のトランザクションも含めて、送信者が次に使うべきnonce
+func (bc *Blockchain) NextNonce(blockchainAddress string) uint64 {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.confirmedNonce(blockchainAddress) + uint64(bc.mempool.senderCount(blockchainAddress))
+}
 
+// mempoolに追加しようとしているトランザクションのnonceを検証
+func (bc *Blockchain) checkPendingNonce(sender string, nonce uint64) error {
+	confirmed := bc.confirmedNonce(sender)
+	if nonce < confirmed {
+		return fmt.Errorf("%w: nonce %d of %s is already confirmed (next nonce is %d)", ErrDuplicateNonce, nonce, sender, confirmed)
+	}
+	// mempoolのキューは承認済みのnonceから連続している
+	next := confirmed + uint64(bc.mempool.senderCount(sender))
+	if nonce < next {
+		return fmt.Errorf("%w: nonce %d of %s is already pending", ErrDuplicateNonce, nonce, sender)
+	}
+	if nonce != next {
+		return fmt.Errorf("%w: nonce %d of %s is out of order (expected %d)", ErrNonceOutOfOrder, nonce, sender, next)
+	}
+	return nil
 }
 
 // トランザクションの署名の妥当性を検証
 func (bc *Blockchain) VerifyTransactionSignature(senderPubllicKey *ecdsa.PublicKey, s *utils.Signature, t *Transaction) bool {
-	m, _ := json.Marshal(t)
-	h := sha256.Sum256([]byte(m))
+	if senderPubllicKey == nil || s == nil {
+		return false
+	}
+	h := sha256.Sum256(t.SigningBytes())
 	return ecdsa.Verify(senderPubllicKey, h[:], s.R, s.S)
 }
 
+// ブロックに含まれるトランザクションが送信者本人によって署名されたものか検証
+// UTXOモデルの場合、utxosはブロックの直前までの未使用の出力(アカウントモデルの場合はnil)
+func (bc *Blockchain) verifyBlockTransaction(t *Transaction, utxos *UTXOSet) error {
+	if t.IsUTXO() != (utxos != nil) {
+		return ErrLedgerMismatch
+	}
+	if utxos == nil && !bc.VerifyTransactionSignature(t.senderPublicKey, t.signature, t) {
+		return ErrInvalidSignature
+	}
+	if t.senderPublicKey == nil {
+		return ErrInvalidSignature
+	}
+	if utils.PublicKeyToBlockchainAddress(t.senderPublicKey) != t.senderBlockchainAddress {
+		return ErrAddressMismatch
+	}
+	if utxos != nil {
+		return t.checkUTXO(utxos, nil)
+	}
+	return nil
+}
+
 func (bc *Blockchain) CopyTransactionPool() []*Transaction {
 	transactions := make([]*Transaction, 0)
-	for _, t := range bc.transactionPool {
-		transactions = append(transactions,
-			NewTransaction(t.senderBlockchainAddress,
-				t.recipientBlockchainAddress,
-				t.value))
+	for _, t := range bc.mempool.Transactions() {
+		ct := NewTransaction(t.senderBlockchainAddress,
+			t.recipientBlockchainAddress,
+			t.value,
+			t.fee,
+			t.nonce)
+		ct.senderPublicKey = t.senderPublicKey
+		ct.signature = t.signature
+		ct.inputs = t.inputs
+		ct.outputs = t.outputs
+		transactions = append(transactions, ct)
 	}
 	return transactions
 }
 
-func (bc *Blockchain) ValidPloof(nonce int, previousHash [32]byte, transactions []*Transaction, difficulty int) bool {
-	zeros := strings.Repeat("0", difficulty)
-	// timestampは0で良いの？　次のブロックだからまだないのはわかるけど
-	guessBlock := Block{0, nonce, previousHash, transactions}
-	// string(zeros)と比較するためにstringにフォーマット
-	guessHashStr := fmt.Sprintf("%x", guessBlock.Hash())
-	return guessHashStr[:difficulty] == zeros
+func (bc *Blockchain) ValidPloof(header *BlockHeader) bool {
+	target, ok := CompactToTarget(header.bits)
+	if !ok {
+		return false
+	}
+	return validPloof(header, &target)
 }
 
-func (bc *Blockchain) PloofOfWork() int {
-	transactions := bc.CopyTransactionPool()
-	previousHash := bc.LastBlock().Hash()
-	nonce := 0
-	for !bc.ValidPloof(nonce, previousHash, transactions, MINIG_DIFFICULTY) {
-		nonce += 1
+// 目標値を変換済みのProof of Workの検証
+func validPloof(header *BlockHeader, target *[32]byte) bool {
+	return HashMeetsTarget(header.Hash(), target)
+}
+
+// nonceの探索はMinerのワーカーで並列に行い、ctxがキャンセルされると中断してエラーを返す
+// 探索が目標の生成間隔より長引いた場合はタイムスタンプを更新するため、見つかったヘッダーを返す
+func (bc *Blockchain) PloofOfWork(ctx context.Context, header *BlockHeader) (BlockHeader, error) {
+	return bc.miner.Search(ctx, *header, bc.targetBlockTime)
+}
+
+// マイニングに使うgoroutineの数を変更する
+// Minerは置き換えずに設定のみを変えるため、探索中やMiner()の参照と競合しない
+func (bc *Blockchain) SetMiningWorkers(workers int) {
+	bc.miner.SetWorkers(workers)
+}
+
+func (bc *Blockchain) Miner() *Miner {
+	return bc.miner
+}
+
+// チェーンの末尾が変わったことを通知し、古い末尾に対するマイニングを中断させる
+// bc.muxを保持した状態で呼び出す
+func (bc *Blockchain) tipChanged() {
+	if bc.tipCancel != nil {
+		bc.tipCancel()
 	}
-	return nonce
+	bc.tipCtx, bc.tipCancel = context.WithCancel(context.Background())
 }
 
 func (bc *Blockchain) Mining() bool {
 	// Mining()関数の自動化対応
+	// ロックはブロックの材料を集める間とブロックを追加する間だけ保持し、nonceの探索中は解放する
 	bc.mux.Lock()
-	defer bc.mux.Unlock()
-
 	/*
-		if len(bc.transactionPool) == 0 {
+		if bc.mempool.Len() == 0 {
 			return false
 		}
 	*/
 
-	// transactionpoolに自分へのリワードを追加
-	bc.AddTransaction(MINIG_SENDER, bc.blockchainAddress, MINIG_REWARD, nil, nil)
-	nonce := bc.PloofOfWork()
+	// 手数料の高い順に選んだトランザクションと自分へのリワード
+	transactions := bc.BlockTemplate()
+	bits := bc.NextBits(bc.chain)
 	previousHash := bc.LastBlock().Hash()
-	bc.CreateBlock(nonce, previousHash)
-	log.Println("action=mining, status=success")
+	header := NewBlockHeader(uint64(len(bc.chain)), previousHash, bits, transactions)
+	ctx := bc.tipCtx
+	bc.mux.Unlock()
 
-	// 他のノードに対してconsensusAPIをリクエストする
-	for _, n := range bc.neighbors {
-		endpoint := fmt.Sprintf("http://%s/consensus", n)
-		client := &http.Client{}
-		req, _ := http.NewRequest("PUT", endpoint, nil)
-		resp, _ := client.Do(req)
-		log.Printf("%v", resp)
+	solved, err := bc.PloofOfWork(ctx, header)
+	if err != nil {
+		log.Printf("action=mining, status=canceled, reason=%v", err)
+		return false
+	}
+
+	bc.mux.Lock()
+	// 探索中に他のノードのチェーンを採用した場合、掘ったブロックは古い末尾に繋がるため捨てる
+	if bc.LastBlock().Hash() != previousHash {
+		bc.mux.Unlock()
+		log.Println("action=mining, status=stale")
+		return false
 	}
+	b := bc.CreateBlock(solved, transactions)
+	height := solved.height
+	bc.mux.Unlock()
+	log.Printf("action=mining, status=success, height=%d, bits=%08x, hashrate=%.0f", height, bits, bc.miner.Hashrate())
+
+	// チェーン全体ではなく掘ったブロックのみを他のノードに送る
+	bc.announceBlock(b)
 
 	return true
 }
 
+// マイニングを開始する(ブロックの生成間隔は難易度調整で制御されるため、待たずに次のブロックを掘り続ける)
+// 複数回呼び出されても、マイニングを行うgoroutineは1つのみ
 func (bc *Blockchain) StartMining() {
-	bc.Mining()
-	// 20秒後に再度StartMiningを呼び出す
-	_ = time.AfterFunc(time.Second*MINIG_TIMER_SEC, bc.StartMining)
+	bc.startMining.Do(func() {
+		go func() {
+			for {
+				bc.Mining()
+			}
+		}()
+	})
+}
+
+func (bc *Blockchain) CalculateTotalAmount(blockchainAddress string) uint64 {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.calculateTotalAmount(blockchainAddress)
+}
 
+// 承認済みの残高(送信者は手数料も負担する)
+func (bc *Blockchain) calculateTotalAmount(blockchainAddress string) uint64 {
+	return bc.index.Balance(blockchainAddress)
 }
 
-func (bc *Blockchain) CalculateTotalAmount(blockchainAddress string) float32 {
-	var totalamount float32 = 0.0
-	for _, b := range bc.chain {
-		for _, t := range b.transactions {
-			value := t.value
-			if blockchainAddress == t.recipientBlockchainAddress {
-				totalamount += value
-			}
-			if blockchainAddress == t.senderBlockchainAddress {
-				totalamount -= value
-			}
-		}
+// 承認済みの残高と未承認のトランザクションによる増減
+// 未承認の合計はmempoolがuint64に収まる範囲でしか受け付けない
+type PendingBalance struct {
+	Confirmed uint64
+	// mempoolにある受け取りの合計と、送金(手数料を含む)の合計
+	Incoming uint64
+	Outgoing uint64
+}
+
+// mempoolのトランザクションがすべて承認された後の残高
+func (pb *PendingBalance) Balance() uint64 {
+	total, ok := utils.AddAmount(pb.Confirmed, pb.Incoming)
+	if !ok {
+		total = math.MaxUint64
+	}
+	if total < pb.Outgoing {
+		return 0
+	}
+	return total - pb.Outgoing
+}
+
+// 新しいトランザクションに使える残高(未承認の受け取りは承認されるまで使えない)
+func (pb *PendingBalance) Spendable() uint64 {
+	if pb.Confirmed < pb.Outgoing {
+		return 0
+	}
+	return pb.Confirmed - pb.Outgoing
+}
+
+func (bc *Blockchain) PendingBalance(blockchainAddress string) *PendingBalance {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.pendingBalance(blockchainAddress)
+}
+
+// 未承認の合計はmempoolが受け付け時と取り除く際に更新しているため、mempoolを走査しない
+func (bc *Blockchain) pendingBalance(blockchainAddress string) *PendingBalance {
+	return &PendingBalance{
+		Confirmed: bc.calculateTotalAmount(blockchainAddress),
+		Incoming:  bc.mempool.incomingTotal(blockchainAddress),
+		Outgoing:  bc.mempool.outgoingTotal(blockchainAddress),
 	}
-	return totalamount
 }
 
 func (bc *Blockchain) ValidChain(chain []*Block) bool {
-	// 比較対象のブロック
-	preBlock := chain[0]
+	if err := bc.VerifyChain(chain); err != nil {
+		log.Printf("ERROR: %v", err)
+		return false
+	}
+	return true
+}
+
+// チェーンを先頭から検証し、不正なブロックがあればその位置と理由を返す
+// ハッシュの繋がりとProof of Workに加えて、残高をブロックごとに再計算して状態遷移の妥当性も確認する
+func (bc *Blockchain) VerifyChain(chain []*Block) error {
+	_, err := bc.verifyChain(chain)
+	return err
+}
+
+// 不正なブロックがあればそのインデックスも返す(チェーンが空の場合は-1)
+func (bc *Blockchain) verifyChain(chain []*Block) (int, error) {
+	if len(chain) == 0 {
+		return -1, fmt.Errorf("empty chain")
+	}
+	if err := checkGenesis(chain[0]); err != nil {
+		return 0, fmt.Errorf("block 0: %w", err)
+	}
+	// UTXOモデルの場合はブロックごとに未使用の出力を更新しながら入力を検証する
+	var utxos *UTXOSet
+	if bc.ledger == LEDGER_UTXO {
+		utxos = NewUTXOSet()
+	}
+	return bc.verifyBlocks(chain, 1, make(map[string]uint64), make(map[string]uint64), utxos)
+}
+
+// chain[from:]のブロックを検証し、不正なブロックがあればそのインデックスと理由を返す
+// nonces(送信者ごとに次に期待されるnonce)、balances(アドレスごとの残高)、utxos(UTXOモデルの場合のみ)は
+// chain[:from]を反映した状態を渡し、検証しながら更新される
+func (bc *Blockchain) verifyBlocks(chain []*Block, from int, nonces map[string]uint64, balances map[string]uint64, utxos *UTXOSet) (int, error) {
 	// 次のブロックのインデックス
-	currentIndex := 1
+	currentIndex := from
 	for currentIndex < len(chain) {
 		b := chain[currentIndex]
-		if b.previousHash != preBlock.Hash() {
-			return false
+		h := &b.header
+		if err := bc.checkBlock(b, chain[:currentIndex]); err != nil {
+			return currentIndex, fmt.Errorf("block %d: %w", currentIndex, err)
 		}
 
-		if !bc.ValidPloof(b.Nonce(), b.PreviousHash(), b.Transaction(), MINIG_DIFFICULTY) {
-			return false
+		// リワードは手数料が確定してから検証する
+		var reward *Transaction
+		rewards := 0
+		var fees uint64 = 0
+		for _, t := range b.transactions {
+			if t.senderBlockchainAddress == MINIG_SENDER {
+				rewards += 1
+				reward = t
+				continue
+			}
+			if t.value == 0 {
+				return currentIndex, fmt.Errorf("block %d: %w: transaction from %s with nonce %d", currentIndex, ErrInvalidValue, t.senderBlockchainAddress, t.nonce)
+			}
+			if err := bc.verifyBlockTransaction(t, utxos); err != nil {
+				return currentIndex, fmt.Errorf("block %d: %w: transaction from %s with nonce %d", currentIndex, err, t.senderBlockchainAddress, t.nonce)
+			}
+			expected := nonces[t.senderBlockchainAddress]
+			if t.nonce < expected {
+				return currentIndex, fmt.Errorf("block %d: %w: nonce %d of %s was already used", currentIndex, ErrDuplicateNonce, t.nonce, t.senderBlockchainAddress)
+			}
+			if t.nonce > expected {
+				return currentIndex, fmt.Errorf("block %d: %w: nonce %d of %s (expected %d)", currentIndex, ErrNonceOutOfOrder, t.nonce, t.senderBlockchainAddress, expected)
+			}
+			nonces[t.senderBlockchainAddress] = expected + 1
+			// 送金額と手数料の合計が溢れると、残高のない送信者がコインを作れてしまう
+			cost, ok := t.Cost()
+			if !ok {
+				return currentIndex, fmt.Errorf("block %d: %w: transaction from %s with nonce %d", currentIndex, utils.ErrAmountOverflow, t.senderBlockchainAddress, t.nonce)
+			}
+			if balances[t.senderBlockchainAddress] < cost {
+				return currentIndex, fmt.Errorf("block %d: %w: %s spends %s with balance %s", currentIndex, ErrInsufficientBalance, t.senderBlockchainAddress,
+					utils.FormatAmount(cost), utils.FormatAmount(balances[t.senderBlockchainAddress]))
+			}
+			balances[t.senderBlockchainAddress] -= cost
+			received, ok := utils.AddAmount(balances[t.recipientBlockchainAddress], t.value)
+			if !ok {
+				return currentIndex, fmt.Errorf("block %d: %w: balance of %s", currentIndex, utils.ErrAmountOverflow, t.recipientBlockchainAddress)
+			}
+			balances[t.recipientBlockchainAddress] = received
+			if fees, ok = utils.AddAmount(fees, t.fee); !ok {
+				return currentIndex, fmt.Errorf("block %d: %w: total fee", currentIndex, utils.ErrAmountOverflow)
+			}
+			if utxos != nil {
+				utxos.connectTransaction(t, h.height)
+			}
+		}
+		if rewards != 1 {
+			return currentIndex, fmt.Errorf("block %d: %w: %d reward transactions (expected 1)", currentIndex, ErrInvalidReward, rewards)
+		}
+		// リワードはMINIG_REWARDとブロック内の手数料の合計
+		// リワードのnonceはブロックの高さとし、ブロックごとにトランザクションIDが異なるようにする
+		expectedReward, ok := utils.AddAmount(MINIG_REWARD, fees)
+		if !ok {
+			return currentIndex, fmt.Errorf("block %d: %w: reward", currentIndex, utils.ErrAmountOverflow)
+		}
+		if reward.value != expectedReward || reward.fee != 0 || reward.nonce != h.height ||
+			len(reward.inputs) != 0 || len(reward.outputs) != 0 {
+			return currentIndex, fmt.Errorf("block %d: %w: reward of %s (expected %s)", currentIndex, ErrInvalidReward,
+				utils.FormatAmount(reward.value), utils.FormatAmount(expectedReward))
+		}
+		rewarded, ok := utils.AddAmount(balances[reward.recipientBlockchainAddress], reward.value)
+		if !ok {
+			return currentIndex, fmt.Errorf("block %d: %w: balance of %s", currentIndex, utils.ErrAmountOverflow, reward.recipientBlockchainAddress)
+		}
+		balances[reward.recipientBlockchainAddress] = rewarded
+		if utxos != nil {
+			utxos.connectTransaction(reward, h.height)
 		}
-		preBlock = b
 		currentIndex += 1
 	}
-	return true
+	return -1, nil
 }
 
-func (bc *Blockchain) ResolveConflicts() bool {
-	var longestChain []*Block = nil
-	maxLength := len(bc.chain)
-
-	for _, n := range bc.neighbors {
-		endpoint := fmt.Sprintf("http://%s/chain", n)
-		resp, _ := http.Get(endpoint)
-		if resp.StatusCode == 200 {
-			var bcResp Blockchain
-			decoder := json.NewDecoder(resp.Body)
-			_ = decoder.Decode(&bcResp)
-
-			chain := bcResp.Chain()
-
-			if len(chain) > maxLength && bc.ValidChain(chain) {
-				maxLength = len(chain)
-				longestChain = chain
-			}
-		}
+// genesisブロックは各ノードで独自に作成されるため、トランザクションを持てない
+// Proof of Workを持たないため難易度は0でなければならず、仕事量にも数えない
+// (難易度を持つgenesisを認めると、高さ0のブロックだけで採用中のチェーンを付け替えられる)
+func checkGenesis(b *Block) error {
+	if len(b.transactions) != 0 {
+		return fmt.Errorf("genesis block must not contain transactions")
+	}
+	h := &b.header
+	if h.version != BLOCK_VERSION || h.height != 0 || h.merkleRoot != MerkleRoot(nil) ||
+		h.previousHash != (&BlockHeader{}).Hash() {
+		return fmt.Errorf("invalid genesis header")
+	}
+	if h.bits != 0 {
+		return fmt.Errorf("genesis block must have zero difficulty (bits %08x)", h.bits)
+	}
+	return nil
+}
+
+// ブロック単体で確認できる項目(ヘッダー、Proof of Work、Merkle root、サイズ)の検証
+// chainはbの直前までのブロックで、トランザクションの内容と残高は検証しない
+func (bc *Blockchain) checkBlock(b *Block, chain []*Block) error {
+	if b.header.height != uint64(len(chain)) {
+		return fmt.Errorf("height %d mismatch", b.header.height)
+	}
+	return bc.checkBlockAfter(b, chain[len(chain)-1], func(height int) *Block {
+		return chain[height]
+	})
+}
+
+// preBlockの次のブロックとしてのcheckBlock
+// ancestorは高さからpreBlockの祖先を返し、難易度の調整区間の先頭を引く場合にのみ呼ばれる
+func (bc *Blockchain) checkBlockAfter(b *Block, preBlock *Block, ancestor func(height int) *Block) error {
+	if err := bc.checkHeaderAfter(&b.header, preBlock, ancestor); err != nil {
+		return err
+	}
+
+	// ヘッダーのMerkle rootがトランザクションと一致していなければ、PoWはトランザクションを保証しない
+	if b.header.merkleRoot != TransactionsMerkleRoot(b.transactions) {
+		return fmt.Errorf("merkle root mismatch")
+	}
+
+	if size := transactionsSize(b.transactions); size > MAX_BLOCK_SIZE {
+		return fmt.Errorf("%w: %d bytes", ErrBlockTooLarge, size)
+	}
+	return nil
+}
+
+// ヘッダーのみで確認できる項目(繋がり、タイムスタンプ、難易度、Proof of Work)の検証
+// chainはヘッダーのみのブロックでもよい
+func (bc *Blockchain) checkHeader(h *BlockHeader, chain []*Block) error {
+	if h.height != uint64(len(chain)) {
+		return fmt.Errorf("height %d mismatch", h.height)
+	}
+	return bc.checkHeaderAfter(h, chain[len(chain)-1], func(height int) *Block {
+		return chain[height]
+	})
+}
+
+// preBlockの次のヘッダーとしてのcheckHeader
+func (bc *Blockchain) checkHeaderAfter(h *BlockHeader, preBlock *Block, ancestor func(height int) *Block) error {
+	if h.version != BLOCK_VERSION {
+		return fmt.Errorf("unsupported version %d", h.version)
+	}
+	if h.height != preBlock.header.height+1 {
+		return fmt.Errorf("height %d mismatch", h.height)
+	}
+	if h.previousHash != preBlock.Hash() {
+		return fmt.Errorf("previous hash mismatch")
+	}
+
+	if h.timestamp <= preBlock.header.timestamp {
+		return fmt.Errorf("timestamp is not after the previous block")
 	}
-	if longestChain != nil {
-		bc.chain = longestChain
-		log.Printf("Resolve conflicts replaced")
-		return true
+	if h.timestamp > time.Now().Add(MAX_FUTURE_BLOCK_TIME).UnixNano() {
+		return fmt.Errorf("timestamp is too far in the future")
 	}
-	log.Printf("Resolve conflicts not replaced")
-	return false
+
+	if expected := bc.nextBits(int(h.height), preBlock, ancestor); h.bits != expected {
+		return fmt.Errorf("bits %08x (expected %08x)", h.bits, expected)
+	}
+
+	if !bc.ValidPloof(h) {
+		return fmt.Errorf("invalid proof of work")
+	}
+	return nil
+}
+
+// 他のノードと同期し、末尾が変わった場合はtrueを返す
+// チェーン全体を一度に取得せず、ヘッダーを先に検証してから足りないブロックのみを取得する
+func (bc *Blockchain) ResolveConflicts() bool {
+	return bc.SyncBlocks()
 }
 
 type Transaction struct {
 	senderBlockchainAddress    string
 	recipientBlockchainAddress string
-	value                      float32
+	// 最小単位(1コイン=10^8)の整数で表した送金額
+	value uint64
+	// マイナーに支払う手数料(送金額とは別に送信者の残高から引かれる)
+	fee uint64
+	// 送信者ごとの連番(リプレイ防止のため署名対象に含める)
+	nonce uint64
+	// 再検証のために保持する署名情報(マイニング報酬の場合はnil)
+	// UTXOモデルの場合、署名は入力ごとに持つためsignatureはnil
+	senderPublicKey *ecdsa.PublicKey
+	signature       *utils.Signature
+	// UTXOモデルの場合のみ
+	inputs  []*TxInput
+	outputs []*TxOutput
 }
 
-func NewTransaction(sender string, recipient string, value float32) *Transaction {
-	return &Transaction{sender, recipient, value}
+func NewTransaction(sender string, recipient string, value uint64, fee uint64, nonce uint64) *Transaction {
+	return &Transaction{
+		senderBlockchainAddress:    sender,
+		recipientBlockchainAddress: recipient,
+		value:                      value,
+		fee:                        fee,
+		nonce:                      nonce,
+	}
+}
+
+func (t *Transaction) Fee() uint64 {
+	return t.fee
+}
+
+// 送信者の残高から引かれる額(送金額と手数料の合計)
+// uint64に収まらない場合はfalse
+func (t *Transaction) Cost() (uint64, bool) {
+	return utils.AddAmount(t.value, t.fee)
+}
+
+// ブロックサイズの計算に使うトランザクションのサイズ(バイナリ形式のbyte数)
+func (t *Transaction) Size() int {
+	return len(t.Encode())
+}
+
+// トランザクションID(署名を含めたバイナリ形式のハッシュ)
+// Merkle treeの葉として使う
+func (t *Transaction) ID() [32]byte {
+	return sha256.Sum256(t.Encode())
+}
+
+func (t *Transaction) Nonce() uint64 {
+	return t.nonce
+}
+
+// 他のノードへの同期や永続化に使う署名付きの形式に変換
+func (t *Transaction) Request() *TransactionRequest {
+	sender := t.senderBlockchainAddress
+	recipient := t.recipientBlockchainAddress
+	value := utils.FormatAmount(t.value)
+	fee := utils.FormatAmount(t.fee)
+	nonce := t.nonce
+	tr := &TransactionRequest{
+		SenderBlockchainAddress:    &sender,
+		RecipientBlockchainAddress: &recipient,
+		Value:                      &value,
+		Fee:                        &fee,
+		Nonce:                      &nonce,
+	}
+	if t.senderPublicKey != nil {
+		publicKeyStr := fmt.Sprintf("%064x%064x", t.senderPublicKey.X.Bytes(), t.senderPublicKey.Y.Bytes())
+		tr.SenderPublicKey = &publicKeyStr
+	}
+	if t.signature != nil {
+		signatureStr := t.signature.String()
+		tr.Signature = &signatureStr
+	}
+	for _, in := range t.inputs {
+		tr.Inputs = append(tr.Inputs, in.request())
+	}
+	for _, out := range t.outputs {
+		tr.Outputs = append(tr.Outputs, out.request())
+	}
+	return tr
 }
 
 func (t *Transaction) Print() {
 	fmt.Printf("%s\n", strings.Repeat("-", 40))
 	fmt.Printf("sender_blockchain_address      %s\n", t.senderBlockchainAddress)
 	fmt.Printf("recipient_blockchain_address   %s\n", t.recipientBlockchainAddress)
-	fmt.Printf("value                          %.1f\n", t.value)
+	fmt.Printf("value                          %s\n", utils.FormatAmount(t.value))
+	fmt.Printf("fee                            %s\n", utils.FormatAmount(t.fee))
+	fmt.Printf("nonce                          %d\n", t.nonce)
 }
 
 func (t *Transaction) MarshalJSON() ([]byte, error) {
+	var publicKeyStr, signatureStr string
+	if t.senderPublicKey != nil {
+		publicKeyStr = fmt.Sprintf("%064x%064x", t.senderPublicKey.X.Bytes(), t.senderPublicKey.Y.Bytes())
+	}
+	if t.signature != nil {
+		signatureStr = t.signature.String()
+	}
+	// 入力と出力は転送用の形式と同じ表現にする
+	tr := t.Request()
+	// txidは表示用であり、アンマーシャル時には無視して再計算する
 	return json.Marshal(struct {
-		Sender    string  `json:"sender_blockchain_address"`
-		Recipient string  `json:"recipient_blockchain_address"`
-		Value     float32 `json:"value"`
+		TxID            string             `json:"txid"`
+		Sender          string             `json:"sender_blockchain_address"`
+		Recipient       string             `json:"recipient_blockchain_address"`
+		Value           string             `json:"value"`
+		Fee             string             `json:"fee"`
+		Nonce           uint64             `json:"nonce"`
+		SenderPublicKey string             `json:"sender_public_key,omitempty"`
+		Signature       string             `json:"signature,omitempty"`
+		Inputs          []*TxInputRequest  `json:"inputs,omitempty"`
+		Outputs         []*TxOutputRequest `json:"outputs,omitempty"`
 	}{
-		Sender:    t.senderBlockchainAddress,
-		Recipient: t.recipientBlockchainAddress,
-		Value:     t.value,
+		TxID:            fmt.Sprintf("%x", t.ID()),
+		Sender:          t.senderBlockchainAddress,
+		Recipient:       t.recipientBlockchainAddress,
+		Value:           utils.FormatAmount(t.value),
+		Fee:             utils.FormatAmount(t.fee),
+		Nonce:           t.nonce,
+		SenderPublicKey: publicKeyStr,
+		Signature:       signatureStr,
+		Inputs:          tr.Inputs,
+		Outputs:         tr.Outputs,
 	})
 }
 
 func (t *Transaction) UnmarshalJSON(data []byte) error {
+	var valueStr, publicKeyStr, signatureStr string
+	var inputs []*TxInputRequest
+	var outputs []*TxOutputRequest
+	feeStr := "0"
 	v := &struct {
-		Sender    *string  `json:"sender_blockchain_address"`
-		Recipient *string  `json:"recipient_blockchain_address"`
-		Value     *float32 `json:"value"`
+		Sender          *string             `json:"sender_blockchain_address"`
+		Recipient       *string             `json:"recipient_blockchain_address"`
+		Value           *string             `json:"value"`
+		Fee             *string             `json:"fee"`
+		Nonce           *uint64             `json:"nonce"`
+		SenderPublicKey *string             `json:"sender_public_key"`
+		Signature       *string             `json:"signature"`
+		Inputs          *[]*TxInputRequest  `json:"inputs"`
+		Outputs         *[]*TxOutputRequest `json:"outputs"`
 	}{
-		Sender:    &t.senderBlockchainAddress,
-		Recipient: &t.recipientBlockchainAddress,
-		Value:     &t.value,
+		Sender:          &t.senderBlockchainAddress,
+		Recipient:       &t.recipientBlockchainAddress,
+		Value:           &valueStr,
+		Fee:             &feeStr,
+		Nonce:           &t.nonce,
+		SenderPublicKey: &publicKeyStr,
+		Signature:       &signatureStr,
+		Inputs:          &inputs,
+		Outputs:         &outputs,
 	}
 	if err := json.Unmarshal(data, &v); err != nil {
 		return err
 	}
+	value, err := utils.ParseAmount(valueStr)
+	if err != nil {
+		return err
+	}
+	t.value = value
+	fee, err := utils.ParseBalance(feeStr)
+	if err != nil {
+		return err
+	}
+	t.fee = fee
+	// 公開鍵と署名はどちらも128文字の16進数(マイニング報酬の場合は空)
+	if publicKeyStr != "" {
+		if len(publicKeyStr) != 128 {
+			return fmt.Errorf("invalid sender_public_key length %d", len(publicKeyStr))
+		}
+		t.senderPublicKey = utils.PublicKeyFromString(publicKeyStr)
+	}
+	if signatureStr != "" {
+		if len(signatureStr) != 128 {
+			return fmt.Errorf("invalid signature length %d", len(signatureStr))
+		}
+		t.signature = utils.SignatureFromString(signatureStr)
+	}
+	if t.inputs, err = parseInputs(inputs); err != nil {
+		return err
+	}
+	if t.outputs, err = parseOutputs(outputs); err != nil {
+		return err
+	}
 	return nil
 }
 
 type TransactionRequest struct {
-	SenderBlockchainAddress    *string  `json:"sender_blockchain_address"`
-	RecipientBlockchainAddress *string  `json:"recipient_blockchain_address"`
-	SenderPublicKey            *string  `json:"sender_public_key"`
-	Value                      *float32 `json:"value"`
-	Signature                  *string  `json:"signature"`
+	SenderBlockchainAddress    *string `json:"sender_blockchain_address"`
+	RecipientBlockchainAddress *string `json:"recipient_blockchain_address"`
+	SenderPublicKey            *string `json:"sender_public_key"`
+	Value                      *string `json:"value"`
+	Fee                        *string `json:"fee,omitempty"`
+	Nonce                      *uint64 `json:"nonce"`
+	Signature                  *string `json:"signature,omitempty"`
+	// UTXOモデルの場合のみ(署名は入力ごとに持つ)
+	Inputs  []*TxInputRequest  `json:"inputs,omitempty"`
+	Outputs []*TxOutputRequest `json:"outputs,omitempty"`
 }
 
+// 手数料の文字列を最小単位の整数に変換(省略時は0)
+func (tr *TransactionRequest) ParseFee() (uint64, error) {
+	if tr.Fee == nil {
+		return 0, nil
+	}
+	return utils.ParseBalance(*tr.Fee)
+}
+
+// 署名はトランザクション全体に対するもの(アカウントモデル)か入力ごとのもの(UTXOモデル)のどちらかが必要
 func (tr *TransactionRequest) Validate() bool {
 	if tr.SenderBlockchainAddress == nil ||
 		tr.RecipientBlockchainAddress == nil ||
 		tr.SenderPublicKey == nil ||
 		tr.Value == nil ||
-		tr.Signature == nil {
+		tr.Nonce == nil ||
+		(tr.Signature == nil && len(tr.Inputs) == 0) {
 		return false
 	}
 	return true
 }
 
+// 署名付きのトランザクションに変換する
+// Validate()を満たしていることが前提
+func (tr *TransactionRequest) Transaction() (*Transaction, error) {
+	value, err := utils.ParseAmount(*tr.Value)
+	if err != nil {
+		return nil, err
+	}
+	fee, err := tr.ParseFee()
+	if err != nil {
+		return nil, err
+	}
+	if len(*tr.SenderPublicKey) != 128 {
+		return nil, fmt.Errorf("invalid sender_public_key length %d", len(*tr.SenderPublicKey))
+	}
+	t := NewTransaction(*tr.SenderBlockchainAddress, *tr.RecipientBlockchainAddress, value, fee, *tr.Nonce)
+	if _, ok := t.Cost(); !ok {
+		return nil, fmt.Errorf("%w: value %s and fee %s", utils.ErrAmountOverflow, *tr.Value, utils.FormatAmount(fee))
+	}
+	t.senderPublicKey = utils.PublicKeyFromString(*tr.SenderPublicKey)
+	if tr.Signature != nil {
+		if len(*tr.Signature) != 128 {
+			return nil, fmt.Errorf("invalid signature length %d", len(*tr.Signature))
+		}
+		t.signature = utils.SignatureFromString(*tr.Signature)
+	}
+	if t.inputs, err = parseInputs(tr.Inputs); err != nil {
+		return nil, err
+	}
+	if t.outputs, err = parseOutputs(tr.Outputs); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+type TxInputRequest struct {
+	TxID      string `json:"txid"`
+	Index     uint32 `json:"index"`
+	Signature string `json:"signature,omitempty"`
+}
+
+func (in *TxInput) request() *TxInputRequest {
+	r := &TxInputRequest{TxID: fmt.Sprintf("%x", in.prevOut.TxID), Index: in.prevOut.Index}
+	if in.signature != nil {
+		r.Signature = in.signature.String()
+	}
+	return r
+}
+
+type TxOutputRequest struct {
+	Address string `json:"address"`
+	Value   string `json:"value"`
+}
+
+func (out *TxOutput) request() *TxOutputRequest {
+	return &TxOutputRequest{Address: out.address, Value: utils.FormatAmount(out.value)}
+}
+
+func parseInputs(requests []*TxInputRequest) ([]*TxInput, error) {
+	var inputs []*TxInput
+	for _, r := range requests {
+		if r == nil {
+			return nil, fmt.Errorf("missing input")
+		}
+		txid, err := ParseHash(r.TxID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input txid %q", r.TxID)
+		}
+		in := NewTxInput(OutPoint{txid, r.Index}, nil)
+		if r.Signature != "" {
+			if len(r.Signature) != 128 {
+				return nil, fmt.Errorf("invalid input signature length %d", len(r.Signature))
+			}
+			in.signature = utils.SignatureFromString(r.Signature)
+		}
+		inputs = append(inputs, in)
+	}
+	return inputs, nil
+}
+
+func parseOutputs(requests []*TxOutputRequest) ([]*TxOutput, error) {
+	var outputs []*TxOutput
+	for _, r := range requests {
+		if r == nil {
+			return nil, fmt.Errorf("missing output")
+		}
+		value, err := utils.ParseAmount(r.Value)
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, NewTxOutput(r.Address, value))
+	}
+	return outputs, nil
+}
+
+type NonceResponse struct {
+	Nonce uint64 `json:"nonce"`
+}
+
+// トランザクションを受け付けた場合のレスポンス
+type TransactionCreatedResponse struct {
+	Message string `json:"message"`
+	TxID    string `json:"txid"`
+}
+
 type AmountResponse struct {
-	Amount float32 `json:"amount"`
+	// 承認済みの残高
+	Amount uint64 `json:"amount"`
+	// 未承認のトランザクションも含めて問い合わせた場合のみ
+	Pending *PendingBalance `json:"-"`
 }
 
 func (ar *AmountResponse) MarshalJSON() ([]byte, error) {
+	if ar.Pending == nil {
+		return json.Marshal(struct {
+			Amount string `json:"amount"`
+		}{
+			Amount: utils.FormatAmount(ar.Amount),
+		})
+	}
 	return json.Marshal(struct {
-		Amount float32 `json:"amount"`
+		Amount    string `json:"amount"`
+		Confirmed string `json:"confirmed"`
+		Incoming  string `json:"pending_incoming"`
+		Outgoing  string `json:"pending_outgoing"`
+		Pending   string `json:"pending"`
+		Spendable string `json:"spendable"`
 	}{
-		Amount: ar.Amount,
+		Amount:    utils.FormatAmount(ar.Amount),
+		Confirmed: utils.FormatAmount(ar.Pending.Confirmed),
+		Incoming:  utils.FormatAmount(ar.Pending.Incoming),
+		Outgoing:  utils.FormatAmount(ar.Pending.Outgoing),
+		Pending:   utils.FormatAmount(ar.Pending.Balance()),
+		Spendable: utils.FormatAmount(ar.Pending.Spendable()),
 	})
 }
+
+func (ar *AmountResponse) UnmarshalJSON(data []byte) error {
+	var amount string
+	v := &struct {
+		Amount *string `json:"amount"`
+	}{
+		Amount: &amount,
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	a, err := utils.ParseBalance(amount)
+	if err != nil {
+		return err
+	}
+	ar.Amount = a
+	return nil
+}
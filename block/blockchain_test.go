@@ -0,0 +1,293 @@
+package block
+
+import (
+	"block/utils"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+// テスト用の鍵とアドレス
+type testAccount struct {
+	key     *ecdsa.PrivateKey
+	address string
+}
+
+func newTestAccount(t *testing.T) *testAccount {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAccount{key: key, address: utils.PublicKeyToBlockchainAddress(&key.PublicKey)}
+}
+
+// 署名済みのトランザクション
+func (a *testAccount) transfer(t *testing.T, recipient string, value uint64, fee uint64, nonce uint64) *Transaction {
+	t.Helper()
+	return signTestTransaction(t, NewTransaction(a.address, recipient, value, fee, nonce), a.key)
+}
+
+func signTestTransaction(t *testing.T, tx *Transaction, key *ecdsa.PrivateKey) *Transaction {
+	t.Helper()
+	h := sha256.Sum256(tx.SigningBytes())
+	r, s, err := ecdsa.Sign(rand.Reader, key, h[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.senderPublicKey = &key.PublicKey
+	tx.signature = &utils.Signature{R: r, S: s}
+	return tx
+}
+
+func (bc *Blockchain) addTestTransaction(tx *Transaction) error {
+	_, err := bc.AddTransaction(tx.senderBlockchainAddress, tx.recipientBlockchainAddress, tx.value, tx.fee, tx.nonce, tx.senderPublicKey, tx.signature)
+	return err
+}
+
+// ストレージを持たないチェーン(fundedの各アドレスにリワードを1回ずつ与える)
+func newTestBlockchain(t *testing.T, funded ...string) *Blockchain {
+	t.Helper()
+	bc, err := NewBlockchain("miner", 0, nil, time.Minute, LEDGER_ACCOUNT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range funded {
+		bc.connectTestBlock(mineTestBlock(bc, bc.chain, address))
+	}
+	return bc
+}
+
+// 索引を更新しながらチェーンの末尾にブロックを繋げる
+func (bc *Blockchain) connectTestBlock(b *Block) {
+	bc.CreateBlock(b.header, b.transactions)
+}
+
+// chainの末尾に続くブロックをProof of Workを満たすまで掘る
+// リワードはトランザクションの手数料を加えてminerに支払う
+func mineTestBlock(bc *Blockchain, chain []*Block, miner string, transactions ...*Transaction) *Block {
+	var fees uint64 = 0
+	for _, tx := range transactions {
+		fees += tx.fee
+	}
+	transactions = append(append([]*Transaction{}, transactions...), NewTransaction(MINIG_SENDER, miner, MINIG_REWARD+fees, 0, uint64(len(chain))))
+	return solveTestBlock(bc, chain, transactions)
+}
+
+func solveTestBlock(bc *Blockchain, chain []*Block, transactions []*Transaction) *Block {
+	last := chain[len(chain)-1]
+	h := NewBlockHeader(uint64(len(chain)), last.Hash(), bc.NextBits(chain), transactions)
+	h.timestamp = last.header.timestamp + int64(time.Second)
+	solveTestHeader(bc, h)
+	return NewBlock(*h, transactions)
+}
+
+func solveTestHeader(bc *Blockchain, h *BlockHeader) {
+	for h.nonce = 0; !bc.ValidPloof(h); h.nonce++ {
+	}
+}
+
+func TestAddTransactionNonce(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	if err := bc.addTestTransaction(alice.transfer(t, bob.address, 1, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.addTestTransaction(alice.transfer(t, bob.address, 1, 0, 0)); !errors.Is(err, ErrDuplicateNonce) {
+		t.Fatalf("error %v, want %v", err, ErrDuplicateNonce)
+	}
+	if err := bc.addTestTransaction(alice.transfer(t, bob.address, 1, 0, 2)); !errors.Is(err, ErrNonceOutOfOrder) {
+		t.Fatalf("error %v, want %v", err, ErrNonceOutOfOrder)
+	}
+	if err := bc.addTestTransaction(alice.transfer(t, bob.address, 1, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if next := bc.NextNonce(alice.address); next != 2 {
+		t.Fatalf("next nonce %d, want 2", next)
+	}
+}
+
+// 承認済みのnonceを使ったトランザクションは再送できない
+func TestAddTransactionRejectsConfirmedNonce(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	if err := bc.addTestTransaction(alice.transfer(t, bob.address, 1, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	bc.connectTestBlock(mineTestBlock(bc, bc.chain, bob.address, bc.CopyTransactionPool()...))
+	if err := bc.addTestTransaction(alice.transfer(t, bob.address, 1, 0, 0)); !errors.Is(err, ErrDuplicateNonce) {
+		t.Fatalf("error %v, want %v", err, ErrDuplicateNonce)
+	}
+}
+
+func TestAddTransactionRejectsOtherKey(t *testing.T) {
+	alice := newTestAccount(t)
+	mallory := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	tx := signTestTransaction(t, NewTransaction(alice.address, mallory.address, 1, 0, 0), mallory.key)
+	if err := bc.addTestTransaction(tx); !errors.Is(err, ErrAddressMismatch) {
+		t.Fatalf("error %v, want %v", err, ErrAddressMismatch)
+	}
+}
+
+func TestVerifyChain(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	chain := append(append([]*Block{}, bc.chain...), mineTestBlock(bc, bc.chain, bob.address, alice.transfer(t, bob.address, 1, 0, 0)))
+	if err := bc.VerifyChain(chain); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyChainRejectsInvalidTransactions(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+
+	unsigned := NewTransaction(alice.address, bob.address, 1, 0, 0)
+	forged := alice.transfer(t, bob.address, 1, 0, 0)
+	forged.value = 2
+	// 他人の鍵で署名したもの
+	stolen := signTestTransaction(t, NewTransaction(alice.address, bob.address, 1, 0, 0), bob.key)
+
+	tests := []struct {
+		name string
+		txs  []*Transaction
+		want error
+	}{
+		{"unsigned", []*Transaction{unsigned}, ErrInvalidSignature},
+		{"forged value", []*Transaction{forged}, ErrInvalidSignature},
+		{"other key", []*Transaction{stolen}, ErrAddressMismatch},
+		{"replayed nonce", []*Transaction{alice.transfer(t, bob.address, 1, 0, 0), alice.transfer(t, bob.address, 1, 0, 0)}, ErrDuplicateNonce},
+		{"nonce gap", []*Transaction{alice.transfer(t, bob.address, 1, 0, 1)}, ErrNonceOutOfOrder},
+		{"overspend", []*Transaction{alice.transfer(t, bob.address, MINIG_REWARD+1, 0, 0)}, ErrInsufficientBalance},
+		{"unfunded sender", []*Transaction{bob.transfer(t, alice.address, 1, 0, 0)}, ErrInsufficientBalance},
+		{"zero value", []*Transaction{alice.transfer(t, bob.address, 0, 0, 0)}, ErrInvalidValue},
+		{"overspend with fee", []*Transaction{alice.transfer(t, bob.address, MINIG_REWARD, 1, 0)}, ErrInsufficientBalance},
+		{"overflowing fee", []*Transaction{alice.transfer(t, bob.address, math.MaxUint64, 1, 0)}, utils.ErrAmountOverflow},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := append(append([]*Block{}, bc.chain...), mineTestBlock(bc, bc.chain, bob.address, tt.txs...))
+			if err := bc.VerifyChain(chain); !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyChainRejectsInvalidReward(t *testing.T) {
+	bc := newTestBlockchain(t)
+	height := uint64(len(bc.chain))
+	tests := []struct {
+		name string
+		txs  []*Transaction
+	}{
+		{"missing", nil},
+		{"too large", []*Transaction{NewTransaction(MINIG_SENDER, "miner", MINIG_REWARD+1, 0, height)}},
+		{"twice", []*Transaction{NewTransaction(MINIG_SENDER, "miner", MINIG_REWARD, 0, height), NewTransaction(MINIG_SENDER, "miner", MINIG_REWARD, 0, height)}},
+		{"wrong nonce", []*Transaction{NewTransaction(MINIG_SENDER, "miner", MINIG_REWARD, 0, height+1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := append(append([]*Block{}, bc.chain...), solveTestBlock(bc, bc.chain, tt.txs))
+			if err := bc.VerifyChain(chain); !errors.Is(err, ErrInvalidReward) {
+				t.Fatalf("error %v, want %v", err, ErrInvalidReward)
+			}
+		})
+	}
+}
+
+// リワードにはブロック内の手数料を含める
+func TestVerifyChainRejectsRewardWithoutFees(t *testing.T) {
+	alice := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	transactions := []*Transaction{
+		alice.transfer(t, "bob", 1, 10, 0),
+		NewTransaction(MINIG_SENDER, "miner", MINIG_REWARD, 0, uint64(len(bc.chain))),
+	}
+	chain := append(append([]*Block{}, bc.chain...), solveTestBlock(bc, bc.chain, transactions))
+	if err := bc.VerifyChain(chain); !errors.Is(err, ErrInvalidReward) {
+		t.Fatalf("error %v, want %v", err, ErrInvalidReward)
+	}
+}
+
+// 残高は承認済みのブロックから求め、リワードは受け付けない
+func TestAddTransactionChecksBalance(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	if err := bc.addTestTransaction(alice.transfer(t, bob.address, MINIG_REWARD+1, 0, 0)); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("error %v, want %v", err, ErrInsufficientBalance)
+	}
+	if err := bc.addTestTransaction(alice.transfer(t, bob.address, 0, 0, 0)); !errors.Is(err, ErrInvalidValue) {
+		t.Fatalf("error %v, want %v", err, ErrInvalidValue)
+	}
+	if _, err := bc.AddTransaction(MINIG_SENDER, bob.address, MINIG_REWARD, 0, 0, nil, nil); !errors.Is(err, ErrRewardTransaction) {
+		t.Fatalf("error %v, want %v", err, ErrRewardTransaction)
+	}
+}
+
+// 未承認の送金を差し引いた残高で受け付け、未承認の受け取りは承認されるまで使えない
+func TestAddTransactionCountsPendingOutgoing(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	if err := bc.addTestTransaction(alice.transfer(t, bob.address, MINIG_REWARD-10, 5, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.addTestTransaction(alice.transfer(t, bob.address, 6, 0, 1)); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("error %v, want %v", err, ErrInsufficientBalance)
+	}
+	if err := bc.addTestTransaction(alice.transfer(t, bob.address, 5, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.addTestTransaction(bob.transfer(t, alice.address, 1, 0, 0)); !errors.Is(err, ErrInsufficientBalance) {
+		t.Fatalf("error %v, want %v", err, ErrInsufficientBalance)
+	}
+
+	pb := bc.PendingBalance(alice.address)
+	if pb.Confirmed != MINIG_REWARD || pb.Outgoing != MINIG_REWARD || pb.Spendable() != 0 || pb.Balance() != 0 {
+		t.Fatalf("alice: %+v", pb)
+	}
+	pb = bc.PendingBalance(bob.address)
+	if pb.Confirmed != 0 || pb.Incoming != MINIG_REWARD-5 || pb.Spendable() != 0 || pb.Balance() != MINIG_REWARD-5 {
+		t.Fatalf("bob: %+v", pb)
+	}
+}
+
+func TestAmountResponseJSON(t *testing.T) {
+	ar := &AmountResponse{Amount: 3}
+	m, err := ar.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(m), `{"amount":"`+utils.FormatAmount(3)+`"}`; got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	// 他のノードのチェーンを採用して承認済みの残高が減った場合も、残高は0未満にしない
+	ar.Pending = &PendingBalance{Confirmed: 3, Incoming: 2, Outgoing: 4}
+	var v map[string]string
+	m, err = ar.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(m, &v); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uint64{"amount": 3, "confirmed": 3, "pending_incoming": 2, "pending_outgoing": 4, "pending": 1, "spendable": 0}
+	for key, amount := range want {
+		if v[key] != utils.FormatAmount(amount) {
+			t.Fatalf("%s is %s, want %s", key, v[key], utils.FormatAmount(amount))
+		}
+	}
+}
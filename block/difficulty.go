@@ -0,0 +1,136 @@
+package block
+
+import (
+	"bytes"
+	"math/big"
+	"time"
+)
+
+const (
+	// 許容するブロックのタイムスタンプの未来方向のずれ
+	MAX_FUTURE_BLOCK_TIME = 2 * time.Hour
+	// 1回の難易度調整で目標値を変化させる最大の倍率
+	MAX_RETARGET_FACTOR = 4
+)
+
+func (bc *Blockchain) TargetBlockTime() time.Duration {
+	return bc.targetBlockTime
+}
+
+// compact表現(上位1byteが指数、下位3byteが仮数)を256bitの目標値に変換
+// target = mantissa * 256^(exponent-3)
+func CompactToBig(bits uint32) *big.Int {
+	exponent := uint(bits >> 24)
+	mantissa := int64(bits & 0x007fffff)
+	target := big.NewInt(mantissa)
+	if exponent <= 3 {
+		return target.Rsh(target, 8*(3-exponent))
+	}
+	return target.Lsh(target, 8*(exponent-3))
+}
+
+// 256bitの目標値をcompact表現に変換(仮数の精度を超える下位のbitは切り捨てる)
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() <= 0 {
+		return 0
+	}
+	exponent := uint((target.BitLen() + 7) / 8)
+	var mantissa uint32
+	if exponent <= 3 {
+		mantissa = uint32(target.Uint64() << (8 * (3 - exponent)))
+	} else {
+		mantissa = uint32(new(big.Int).Rsh(target, 8*(exponent-3)).Uint64())
+	}
+	// 仮数の最上位bitは符号として扱われるため、立っている場合は桁をずらす
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent += 1
+	}
+	return uint32(exponent)<<24 | mantissa
+}
+
+// compact表現をハッシュと直接比較できる32byteのビッグエンディアンに変換
+// 目標値が範囲外(0または256bit超)の場合はfalse
+func CompactToTarget(bits uint32) ([32]byte, bool) {
+	var target [32]byte
+	t := CompactToBig(bits)
+	if t.Sign() <= 0 || t.BitLen() > 256 {
+		return target, false
+	}
+	t.FillBytes(target[:])
+	return target, true
+}
+
+// ハッシュを256bitの数値として目標値以下であるか比較する
+func HashMeetsTarget(hash [32]byte, target *[32]byte) bool {
+	return bytes.Compare(hash[:], target[:]) <= 0
+}
+
+// chainの末尾に続くブロックの難易度
+// DIFFICULTY_ADJUSTMENT_INTERVALブロックごとに、直前の区間の生成間隔と目標の比率で目標値を調整する
+func (bc *Blockchain) NextBits(chain []*Block) uint32 {
+	if len(chain) == 0 {
+		return MINIG_INITIAL_BITS
+	}
+	return bc.nextBits(len(chain), chain[len(chain)-1], func(height int) *Block {
+		return chain[height]
+	})
+}
+
+// 高さheightのブロックの難易度
+// lastは直前のブロックで、ancestorは高さからlastの祖先を返す
+// ancestorは難易度を調整する高さでのみ区間の先頭を引くために呼ばれるため、木の節点から祖先を辿る場合も毎回チェーン全体を作る必要はない
+func (bc *Blockchain) nextBits(height int, last *Block, ancestor func(height int) *Block) uint32 {
+	// genesisの次のブロック
+	if height <= 1 {
+		return MINIG_INITIAL_BITS
+	}
+	// genesisのタイムスタンプはノードの起動時刻のため、調整の計算には使わない
+	if height%DIFFICULTY_ADJUSTMENT_INTERVAL != 0 || height <= DIFFICULTY_ADJUSTMENT_INTERVAL {
+		return last.header.bits
+	}
+	first := ancestor(height - DIFFICULTY_ADJUSTMENT_INTERVAL)
+	actual := last.header.timestamp - first.header.timestamp
+	expected := int64(bc.targetBlockTime) * (DIFFICULTY_ADJUSTMENT_INTERVAL - 1)
+
+	// 急激な変化を防ぐため調整幅を制限する
+	if actual < expected/MAX_RETARGET_FACTOR {
+		actual = expected / MAX_RETARGET_FACTOR
+	}
+	if actual > expected*MAX_RETARGET_FACTOR {
+		actual = expected * MAX_RETARGET_FACTOR
+	}
+
+	// 生成が速すぎれば目標値を小さく(難しく)、遅すぎれば大きく(易しく)する
+	target := CompactToBig(last.header.bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	if limit := CompactToBig(MINIG_POW_LIMIT_BITS); target.Cmp(limit) > 0 {
+		target = limit
+	}
+	return BigToCompact(target)
+}
+
+// ブロックを掘るのに必要な仕事量の期待値(ハッシュの計算回数)
+// genesisはProof of Workを持たないため0とする
+func BlockWork(b *Block) *big.Int {
+	if b.header.height == 0 {
+		return new(big.Int)
+	}
+	// 2^256 / (target + 1)
+	target := CompactToBig(b.header.bits)
+	if target.Sign() <= 0 {
+		return new(big.Int)
+	}
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
+
+// チェーン全体の累積の仕事量(genesisは含まない)
+func ChainWork(chain []*Block) *big.Int {
+	work := new(big.Int)
+	for _, b := range chain {
+		work.Add(work, BlockWork(b))
+	}
+	return work
+}
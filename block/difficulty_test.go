@@ -0,0 +1,113 @@
+package block
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCompactToBig(t *testing.T) {
+	want := new(big.Int).Lsh(big.NewInt(0xffff), 8*(0x1d-3))
+	if got := CompactToBig(0x1d00ffff); got.Cmp(want) != 0 {
+		t.Fatalf("target %x, want %x", got, want)
+	}
+	for _, bits := range []uint32{0x1d00ffff, MINIG_INITIAL_BITS, MINIG_POW_LIMIT_BITS, 0x03123456} {
+		if got := BigToCompact(CompactToBig(bits)); got != bits {
+			t.Fatalf("BigToCompact(CompactToBig(%08x)) = %08x", bits, got)
+		}
+	}
+	if _, ok := CompactToTarget(0); ok {
+		t.Fatal("accepted a zero target")
+	}
+}
+
+// 難易度を調整する区間をinterval間隔で生成したチェーン(Proof of Workは満たさない)
+func testChainWithInterval(interval time.Duration) []*Block {
+	chain := []*Block{NewBlock(*NewBlockHeader(0, [32]byte{}, 0, nil), nil)}
+	for len(chain) < DIFFICULTY_ADJUSTMENT_INTERVAL*2 {
+		last := chain[len(chain)-1]
+		b := NewBlock(*NewBlockHeader(uint64(len(chain)), last.Hash(), MINIG_INITIAL_BITS, nil), nil)
+		b.header.timestamp = last.header.timestamp + int64(interval)
+		chain = append(chain, b)
+	}
+	return chain
+}
+
+func TestNextBits(t *testing.T) {
+	bc := newTestBlockchain(t)
+	initial := CompactToBig(MINIG_INITIAL_BITS)
+	tests := []struct {
+		name     string
+		interval time.Duration
+		// 調整後の目標値の初期値に対する比較(-1は難しくなる)
+		want int
+	}{
+		{"too fast", time.Second, -1},
+		{"on target", time.Minute, 0},
+		{"too slow", 10 * time.Minute, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain := testChainWithInterval(tt.interval)
+			if got := CompactToBig(bc.NextBits(chain)).Cmp(initial); got != tt.want {
+				t.Fatalf("target %x compared to %x is %d, want %d", CompactToBig(bc.NextBits(chain)), initial, got, tt.want)
+			}
+			// 区間の途中では直前のブロックの難易度を引き継ぐ
+			if got := bc.NextBits(chain[:len(chain)-1]); got != MINIG_INITIAL_BITS {
+				t.Fatalf("bits %08x in the middle of an interval, want %08x", got, MINIG_INITIAL_BITS)
+			}
+		})
+	}
+}
+
+// 調整幅はMAX_RETARGET_FACTOR倍までで、最も易しい難易度を超えない
+func TestNextBitsLimits(t *testing.T) {
+	bc := newTestBlockchain(t)
+	fast := CompactToBig(bc.NextBits(testChainWithInterval(time.Nanosecond)))
+	limit := new(big.Int).Div(CompactToBig(MINIG_INITIAL_BITS), big.NewInt(MAX_RETARGET_FACTOR+1))
+	if fast.Cmp(limit) <= 0 {
+		t.Fatalf("target %x changed more than %d times", fast, MAX_RETARGET_FACTOR)
+	}
+	chain := testChainWithInterval(time.Hour)
+	for _, b := range chain[1:] {
+		b.header.bits = MINIG_POW_LIMIT_BITS
+	}
+	if got := bc.NextBits(chain); got != MINIG_POW_LIMIT_BITS {
+		t.Fatalf("bits %08x, want the limit %08x", got, MINIG_POW_LIMIT_BITS)
+	}
+}
+
+// 短くても目標値の小さいブロックを持つチェーンの方が仕事量が大きい
+func TestChainWork(t *testing.T) {
+	genesis := NewBlock(*NewBlockHeader(0, [32]byte{}, 0, nil), nil)
+	easy := BigToCompact(new(big.Int).Lsh(big.NewInt(1), 240))
+	hard := BigToCompact(new(big.Int).Lsh(big.NewInt(1), 236))
+	long := []*Block{genesis, NewBlock(*NewBlockHeader(1, genesis.Hash(), easy, nil), nil), NewBlock(*NewBlockHeader(2, genesis.Hash(), easy, nil), nil)}
+	short := []*Block{genesis, NewBlock(*NewBlockHeader(1, genesis.Hash(), hard, nil), nil)}
+	if ChainWork(short).Cmp(ChainWork(long)) <= 0 {
+		t.Fatalf("work of the short chain %v is not larger than %v", ChainWork(short), ChainWork(long))
+	}
+}
+
+func TestVerifyChainRejectsInvalidHeader(t *testing.T) {
+	bc := newTestBlockchain(t)
+	tests := []struct {
+		name   string
+		modify func(b *Block)
+	}{
+		{"bits", func(b *Block) { b.header.bits = MINIG_POW_LIMIT_BITS }},
+		{"timestamp", func(b *Block) { b.header.timestamp = bc.chain[0].header.timestamp }},
+		{"future timestamp", func(b *Block) { b.header.timestamp = time.Now().Add(MAX_FUTURE_BLOCK_TIME + time.Minute).UnixNano() }},
+		{"height", func(b *Block) { b.header.height = 5 }},
+		{"merkle root", func(b *Block) { b.header.merkleRoot = [32]byte{1} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := mineTestBlock(bc, bc.chain, "miner")
+			tt.modify(b)
+			if err := bc.VerifyChain([]*Block{bc.chain[0], b}); err == nil {
+				t.Fatal("accepted a block with an invalid header")
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package block
+
+import (
+	"block/utils"
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/binary"
+)
+
+// ハッシュと署名の対象となるバイナリ形式
+// JSONはAPIでの表示用とし、合意に関わる値はすべてこの形式から計算する
+//
+//	[ENCODING_VERSION 1byte][種類 1byte][フィールド...]
+//
+// 整数はビッグエンディアンの固定長、文字列とバイト列はuint32(ビッグエンディアン)の長さを前置する
+// 形式を変える場合はENCODING_VERSIONを上げる(既存のハッシュと署名はすべて変わる)
+const (
+	ENCODING_VERSION = 1
+
+	ENCODING_TYPE_BLOCK_HEADER = 0x01
+	ENCODING_TYPE_TRANSACTION  = 0x02
+	// 入力と出力を持つUTXOモデルのトランザクション
+	ENCODING_TYPE_UTXO_TRANSACTION = 0x03
+)
+
+type encoder struct {
+	buf bytes.Buffer
+}
+
+func newEncoder(encodingType byte) *encoder {
+	e := new(encoder)
+	e.buf.WriteByte(ENCODING_VERSION)
+	e.buf.WriteByte(encodingType)
+	return e
+}
+
+func (e *encoder) writeUint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) writeUint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *encoder) writeInt64(v int64) {
+	e.writeUint64(uint64(v))
+}
+
+// 固定長のハッシュは長さを前置しない
+func (e *encoder) writeHash(h [32]byte) {
+	e.buf.Write(h[:])
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	e.writeUint32(uint32(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *encoder) writeString(s string) {
+	e.writeBytes([]byte(s))
+}
+
+func (e *encoder) bytes() []byte {
+	return e.buf.Bytes()
+}
+
+// 公開鍵のX,Y座標をそれぞれ32byteで連結する(公開鍵がない場合は空)
+func encodePublicKey(pk *ecdsa.PublicKey) []byte {
+	if pk == nil || pk.X == nil || pk.Y == nil {
+		return nil
+	}
+	b := make([]byte, 64)
+	pk.X.FillBytes(b[:32])
+	pk.Y.FillBytes(b[32:])
+	return b
+}
+
+// 署名のR,Sをそれぞれ32byteで連結する(署名がない場合は空)
+func encodeSignature(s *utils.Signature) []byte {
+	if s == nil || s.R == nil || s.S == nil {
+		return nil
+	}
+	b := make([]byte, 64)
+	s.R.FillBytes(b[:32])
+	s.S.FillBytes(b[32:])
+	return b
+}
+
+// version(uint32), height(uint64), timestamp(int64), previous_hash(32byte), merkle_root(32byte), bits(uint32), nonce(int64)
+func (h *BlockHeader) Encode() []byte {
+	e := newEncoder(ENCODING_TYPE_BLOCK_HEADER)
+	e.writeUint32(h.version)
+	e.writeUint64(h.height)
+	e.writeInt64(h.timestamp)
+	e.writeHash(h.previousHash)
+	e.writeHash(h.merkleRoot)
+	e.writeUint32(h.bits)
+	e.writeInt64(int64(h.nonce))
+	return e.bytes()
+}
+
+func (t *Transaction) encodeSigningFields() *encoder {
+	encodingType := byte(ENCODING_TYPE_TRANSACTION)
+	if t.IsUTXO() {
+		encodingType = ENCODING_TYPE_UTXO_TRANSACTION
+	}
+	e := newEncoder(encodingType)
+	e.writeString(t.senderBlockchainAddress)
+	e.writeString(t.recipientBlockchainAddress)
+	e.writeUint64(t.value)
+	e.writeUint64(t.fee)
+	e.writeUint64(t.nonce)
+	if t.IsUTXO() {
+		e.writeUint32(uint32(len(t.inputs)))
+		for _, in := range t.inputs {
+			e.writeHash(in.prevOut.TxID)
+			e.writeUint32(in.prevOut.Index)
+		}
+		e.writeUint32(uint32(len(t.outputs)))
+		for _, out := range t.outputs {
+			e.writeString(out.address)
+			e.writeUint64(out.value)
+		}
+	}
+	return e
+}
+
+// 署名の対象となるバイト列(署名と公開鍵自体は含まない)
+// sender(string), recipient(string), value(uint64), fee(uint64), nonce(uint64)
+// UTXOモデルの場合はさらに入力の数(uint32), 各入力のtxid(32byte)とindex(uint32), 出力の数(uint32), 各出力のaddress(string)とvalue(uint64)
+func (t *Transaction) SigningBytes() []byte {
+	return t.encodeSigningFields().bytes()
+}
+
+// 署名の対象に公開鍵(bytes)と署名(bytes)を続けたバイト列
+// UTXOモデルの場合はさらに各入力の署名(bytes)を続ける
+// トランザクションIDとブロックサイズの計算に使う
+func (t *Transaction) Encode() []byte {
+	e := t.encodeSigningFields()
+	e.writeBytes(encodePublicKey(t.senderPublicKey))
+	e.writeBytes(encodeSignature(t.signature))
+	for _, in := range t.inputs {
+		e.writeBytes(encodeSignature(in.signature))
+	}
+	return e.bytes()
+}
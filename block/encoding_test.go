@@ -0,0 +1,145 @@
+package block
+
+import (
+	"block/utils"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+// バイナリ形式とハッシュの固定値
+// 形式が変わるとハッシュと署名がすべて変わり既存のチェーンを読み込めなくなるため、意図せず変わっていないことを確かめる
+// 期待値はGoの実装とは別に計算したもの
+const (
+	goldenHeader = "0101" + "00000002" + "0000000000000001" + "17979cfe362a0000" +
+		"1111111111111111111111111111111111111111111111111111111111111111" +
+		"2222222222222222222222222222222222222222222222222222222222222222" +
+		"1f00ffff" + "000000000000002a"
+	goldenHeaderHash = "410b87ebe1cd39ad81b64fc40fab677c57665a9e2834f56485f9144ad38a9f80"
+
+	goldenSigningBytes = "0102" + "00000005616c696365" + "00000003626f62" +
+		"00000000000003e8" + "000000000000000a" + "0000000000000003"
+	goldenPublicKey = "00000040" +
+		"6b17d1f2e12c4247f8bce6e563a440f277037d812deb33a0f4a13945d898c296" +
+		"4fe342e2fe1a7f9b8ee7eb4a7c0f9e162bce33576b315ececbb6406837bf51f5"
+	goldenTransaction = goldenSigningBytes + goldenPublicKey + "00000040" +
+		"0000000000000000000000000000000000000000000000000000000000000001" +
+		"0000000000000000000000000000000000000000000000000000000000000002"
+	goldenTxID = "e10a5b2d96cc346aaef5b46c62d144f798ab8d2e39a49e987b6b30b2911c1616"
+
+	goldenUTXOSigningBytes = "0103" + "00000005616c696365" + "00000003626f62" +
+		"00000000000003e8" + "000000000000000a" + "0000000000000000" +
+		"00000001" + "3333333333333333333333333333333333333333333333333333333333333333" + "00000001" +
+		"00000002" + "00000003626f62" + "00000000000003e8" + "00000005616c696365" + "0000000000000005"
+	goldenUTXOTransaction = goldenUTXOSigningBytes + goldenPublicKey + "00000000" + "00000040" +
+		"0000000000000000000000000000000000000000000000000000000000000003" +
+		"0000000000000000000000000000000000000000000000000000000000000004"
+	goldenUTXOTxID = "31bdca01d1d8069f28df79183fb776336c5dc8a96553eb4aa0334ca7161981ce"
+
+	goldenMerkleRoot = "3463572d462dc8b10f5712ef726e0419b811bf542ce7dc25f12506f6a15a5d22"
+)
+
+// P-256の生成元を公開鍵とする(値が固定であれば有効な鍵である必要はない)
+func goldenKey() *ecdsa.PublicKey {
+	curve := elliptic.P256()
+	return &ecdsa.PublicKey{Curve: curve, X: curve.Params().Gx, Y: curve.Params().Gy}
+}
+
+func goldenSignature(r int64, s int64) *utils.Signature {
+	return &utils.Signature{R: big.NewInt(r), S: big.NewInt(s)}
+}
+
+func goldenAccountTx() *Transaction {
+	t := NewTransaction("alice", "bob", 1000, 10, 3)
+	t.senderPublicKey = goldenKey()
+	t.signature = goldenSignature(1, 2)
+	return t
+}
+
+func goldenUTXOTx() *Transaction {
+	t := NewTransaction("alice", "bob", 1000, 10, 0)
+	t.senderPublicKey = goldenKey()
+	t.inputs = []*TxInput{NewTxInput(OutPoint{TxID: filledHash(0x33), Index: 1}, goldenSignature(3, 4))}
+	t.outputs = []*TxOutput{NewTxOutput("bob", 1000), NewTxOutput("alice", 5)}
+	return t
+}
+
+func filledHash(b byte) [32]byte {
+	var h [32]byte
+	for i := range h {
+		h[i] = b
+	}
+	return h
+}
+
+func TestBlockHeaderEncoding(t *testing.T) {
+	h := &BlockHeader{
+		version:      2,
+		height:       1,
+		timestamp:    1700000000000000000,
+		previousHash: filledHash(0x11),
+		merkleRoot:   filledHash(0x22),
+		bits:         0x1f00ffff,
+		nonce:        42,
+	}
+	if got := hex.EncodeToString(h.Encode()); got != goldenHeader {
+		t.Fatalf("header encoding\n got %s\nwant %s", got, goldenHeader)
+	}
+	if got := fmt.Sprintf("%x", h.Hash()); got != goldenHeaderHash {
+		t.Fatalf("header hash %s, want %s", got, goldenHeaderHash)
+	}
+}
+
+func TestTransactionEncoding(t *testing.T) {
+	tests := []struct {
+		name    string
+		tx      *Transaction
+		signing string
+		encoded string
+		txid    string
+	}{
+		{"account", goldenAccountTx(), goldenSigningBytes, goldenTransaction, goldenTxID},
+		{"utxo", goldenUTXOTx(), goldenUTXOSigningBytes, goldenUTXOTransaction, goldenUTXOTxID},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hex.EncodeToString(tt.tx.SigningBytes()); got != tt.signing {
+				t.Fatalf("signing bytes\n got %s\nwant %s", got, tt.signing)
+			}
+			if got := hex.EncodeToString(tt.tx.Encode()); got != tt.encoded {
+				t.Fatalf("encoding\n got %s\nwant %s", got, tt.encoded)
+			}
+			if got := fmt.Sprintf("%x", tt.tx.ID()); got != tt.txid {
+				t.Fatalf("txid %s, want %s", got, tt.txid)
+			}
+			if tt.tx.Size() != len(tt.encoded)/2 {
+				t.Fatalf("size %d, want %d", tt.tx.Size(), len(tt.encoded)/2)
+			}
+		})
+	}
+}
+
+func TestTransactionsMerkleRootEncoding(t *testing.T) {
+	other := goldenAccountTx()
+	other.signature = goldenSignature(5, 6)
+	root := TransactionsMerkleRoot([]*Transaction{goldenAccountTx(), other})
+	if got := fmt.Sprintf("%x", root); got != goldenMerkleRoot {
+		t.Fatalf("merkle root %s, want %s", got, goldenMerkleRoot)
+	}
+}
+
+// 署名と公開鍵はIDに含まれるが、署名の対象には含まれない
+func TestSigningBytesExcludeSignature(t *testing.T) {
+	a := goldenAccountTx()
+	b := goldenAccountTx()
+	b.signature = goldenSignature(5, 6)
+	if hex.EncodeToString(a.SigningBytes()) != hex.EncodeToString(b.SigningBytes()) {
+		t.Fatal("signing bytes depend on the signature")
+	}
+	if a.ID() == b.ID() {
+		t.Fatal("txid does not depend on the signature")
+	}
+}
@@ -0,0 +1,150 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// ブロックヘッダーの形式のバージョン
+	// 2: Merkle treeの葉と内部ノードを接頭辞で区別する(1のブロックはMerkle rootが一致しないため読み込めない)
+	BLOCK_VERSION = 2
+)
+
+// Proof of Workの対象となるブロックヘッダー
+// トランザクションはMerkle rootとしてのみ含まれるため、ハッシュの計算量はブロックのサイズに依存しない
+type BlockHeader struct {
+	version      uint32
+	height       uint64
+	timestamp    int64
+	previousHash [32]byte
+	// ブロック内のトランザクションIDから作ったMerkle treeの根
+	merkleRoot [32]byte
+	// ハッシュが満たすべき目標値のcompact表現
+	bits  uint32
+	nonce int
+}
+
+// nonce以外が決まったブロックヘッダーの新規作成
+func NewBlockHeader(height uint64, previousHash [32]byte, bits uint32, transactions []*Transaction) *BlockHeader {
+	h := new(BlockHeader)
+	h.version = BLOCK_VERSION
+	h.height = height
+	h.timestamp = time.Now().UnixNano()
+	h.previousHash = previousHash
+	h.merkleRoot = TransactionsMerkleRoot(transactions)
+	h.bits = bits
+	return h
+}
+
+func (h *BlockHeader) Version() uint32 {
+	return h.version
+}
+
+func (h *BlockHeader) Height() uint64 {
+	return h.height
+}
+
+func (h *BlockHeader) Timestamp() int64 {
+	return h.timestamp
+}
+
+func (h *BlockHeader) PreviousHash() [32]byte {
+	return h.previousHash
+}
+
+func (h *BlockHeader) MerkleRoot() [32]byte {
+	return h.merkleRoot
+}
+
+func (h *BlockHeader) Bits() uint32 {
+	return h.bits
+}
+
+func (h *BlockHeader) Nonce() int {
+	return h.nonce
+}
+
+// ヘッダーのバイナリ形式のハッシュ
+func (h *BlockHeader) Hash() [32]byte {
+	return sha256.Sum256(h.Encode())
+}
+
+func (h *BlockHeader) Print() {
+	fmt.Printf("version          %d\n", h.version)
+	fmt.Printf("height           %d\n", h.height)
+	fmt.Printf("timestamp        %d\n", h.timestamp)
+	fmt.Printf("nonce            %d\n", h.nonce)
+	fmt.Printf("previous_hash    %x\n", h.previousHash)
+	fmt.Printf("merkle_root      %x\n", h.merkleRoot)
+	fmt.Printf("bits             %08x\n", h.bits)
+}
+
+func (h *BlockHeader) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Version      uint32 `json:"version"`
+		Height       uint64 `json:"height"`
+		Timestamp    int64  `json:"timestamp"`
+		Nonce        int    `json:"nonce"`
+		PreviousHash string `json:"previous_hash"`
+		MerkleRoot   string `json:"merkle_root"`
+		Bits         uint32 `json:"bits"`
+	}{
+		Version:      h.version,
+		Height:       h.height,
+		Timestamp:    h.timestamp,
+		Nonce:        h.nonce,
+		PreviousHash: fmt.Sprintf("%x", h.previousHash),
+		MerkleRoot:   fmt.Sprintf("%x", h.merkleRoot),
+		Bits:         h.bits,
+	})
+}
+
+func (h *BlockHeader) UnmarshalJSON(data []byte) error {
+	var previousHash, merkleRoot string
+	v := &struct {
+		Version      *uint32 `json:"version"`
+		Height       *uint64 `json:"height"`
+		Timestamp    *int64  `json:"timestamp"`
+		Nonce        *int    `json:"nonce"`
+		PreviousHash *string `json:"previous_hash"`
+		MerkleRoot   *string `json:"merkle_root"`
+		Bits         *uint32 `json:"bits"`
+	}{
+		Version:      &h.version,
+		Height:       &h.height,
+		Timestamp:    &h.timestamp,
+		Nonce:        &h.nonce,
+		PreviousHash: &previousHash,
+		MerkleRoot:   &merkleRoot,
+		Bits:         &h.bits,
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	var err error
+	if h.previousHash, err = ParseHash(previousHash); err != nil {
+		return fmt.Errorf("invalid previous_hash %q", previousHash)
+	}
+	if h.merkleRoot, err = ParseHash(merkleRoot); err != nil {
+		return fmt.Errorf("invalid merkle_root %q", merkleRoot)
+	}
+	return nil
+}
+
+// 16進数の文字列を32byteのハッシュに変換
+func ParseHash(s string) ([32]byte, error) {
+	var hash [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return hash, err
+	}
+	if len(b) != 32 {
+		return hash, fmt.Errorf("hash must be 32 bytes: %q", s)
+	}
+	copy(hash[:], b)
+	return hash, nil
+}
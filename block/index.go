@@ -0,0 +1,201 @@
+package block
+
+import (
+	"block/utils"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	ADDRESS_DIRECTION_SENT     = "sent"
+	ADDRESS_DIRECTION_RECEIVED = "received"
+	// 自分宛ての送金(手数料のみ残高から減る)
+	ADDRESS_DIRECTION_SELF = "self"
+
+	ADDRESS_HISTORY_DEFAULT_LIMIT = 20
+	ADDRESS_HISTORY_MAX_LIMIT     = 100
+)
+
+// アドレスから見たトランザクションの履歴の1件
+type AddressTransaction struct {
+	TxID      [32]byte
+	Direction string
+	// 送信の場合は受信者、受信の場合は送信者
+	Counterparty string
+	Value        uint64
+	Fee          uint64
+	Height       uint64
+	Timestamp    int64
+}
+
+func (at *AddressTransaction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		TxID         string `json:"txid"`
+		Direction    string `json:"direction"`
+		Counterparty string `json:"counterparty"`
+		Value        string `json:"value"`
+		Fee          string `json:"fee"`
+		Height       uint64 `json:"height"`
+		Timestamp    int64  `json:"timestamp"`
+	}{
+		TxID:         fmt.Sprintf("%x", at.TxID),
+		Direction:    at.Direction,
+		Counterparty: at.Counterparty,
+		Value:        utils.FormatAmount(at.Value),
+		Fee:          utils.FormatAmount(at.Fee),
+		Height:       at.Height,
+		Timestamp:    at.Timestamp,
+	})
+}
+
+// 承認済みのブロックから作るアドレスごとの残高、nonce、履歴の索引
+// ブロックの追加時に差分だけ更新するため、残高の問い合わせでチェーンを走査する必要がない
+// Blockchainのbc.muxで保護される
+type AddressIndex struct {
+	balances map[string]uint64
+	nonces   map[string]uint64
+	// 古い順
+	history map[string][]*AddressTransaction
+}
+
+func NewAddressIndex() *AddressIndex {
+	return &AddressIndex{
+		balances: make(map[string]uint64),
+		nonces:   make(map[string]uint64),
+		history:  make(map[string][]*AddressTransaction),
+	}
+}
+
+// チェーン全体から索引を作り直す(他のノードのチェーンを採用した場合)
+func NewAddressIndexFromChain(chain []*Block) *AddressIndex {
+	idx := NewAddressIndex()
+	for _, b := range chain {
+		idx.connectBlock(b)
+	}
+	return idx
+}
+
+// 検証済みのブロックを索引に反映する
+func (idx *AddressIndex) connectBlock(b *Block) {
+	for _, t := range b.transactions {
+		id := t.ID()
+		entry := func(direction string, counterparty string) *AddressTransaction {
+			return &AddressTransaction{
+				TxID:         id,
+				Direction:    direction,
+				Counterparty: counterparty,
+				Value:        t.value,
+				Fee:          t.fee,
+				Height:       b.header.height,
+				Timestamp:    b.header.timestamp,
+			}
+		}
+		sender := t.senderBlockchainAddress
+		recipient := t.recipientBlockchainAddress
+		idx.balances[recipient] += t.value
+		// リワードの送信元は残高を持たないため、受信者側だけを記録する
+		if sender == MINIG_SENDER {
+			idx.history[recipient] = append(idx.history[recipient], entry(ADDRESS_DIRECTION_RECEIVED, sender))
+			continue
+		}
+		// 検証済みのチェーンでは残高が負になることや合計が溢れることはないが、念のため0で止める
+		if spent, ok := t.Cost(); ok && idx.balances[sender] >= spent {
+			idx.balances[sender] -= spent
+		} else {
+			idx.balances[sender] = 0
+		}
+		idx.nonces[sender] += 1
+		if sender == recipient {
+			idx.history[sender] = append(idx.history[sender], entry(ADDRESS_DIRECTION_SELF, recipient))
+			continue
+		}
+		idx.history[sender] = append(idx.history[sender], entry(ADDRESS_DIRECTION_SENT, recipient))
+		idx.history[recipient] = append(idx.history[recipient], entry(ADDRESS_DIRECTION_RECEIVED, sender))
+	}
+}
+
+// 末尾のブロックを索引から取り消す(connectBlockの逆順で戻す)
+func (idx *AddressIndex) disconnectBlock(b *Block) {
+	for i := len(b.transactions) - 1; i >= 0; i-- {
+		t := b.transactions[i]
+		sender := t.senderBlockchainAddress
+		recipient := t.recipientBlockchainAddress
+		if sender == MINIG_SENDER {
+			idx.popHistory(recipient)
+		} else if sender == recipient {
+			idx.popHistory(sender)
+		} else {
+			idx.popHistory(recipient)
+			idx.popHistory(sender)
+		}
+		if sender != MINIG_SENDER {
+			idx.balances[sender] += t.value + t.fee
+			idx.nonces[sender] -= 1
+			if idx.nonces[sender] == 0 {
+				delete(idx.nonces, sender)
+			}
+		}
+		idx.balances[recipient] -= t.value
+		if idx.balances[recipient] == 0 {
+			delete(idx.balances, recipient)
+		}
+	}
+}
+
+func (idx *AddressIndex) popHistory(blockchainAddress string) {
+	history := idx.history[blockchainAddress]
+	if len(history) <= 1 {
+		delete(idx.history, blockchainAddress)
+		return
+	}
+	idx.history[blockchainAddress] = history[:len(history)-1]
+}
+
+// 送信者ごとのnonceとアドレスごとの残高の複製(チェーンの続きを検証する際の初期状態)
+func (idx *AddressIndex) state() (map[string]uint64, map[string]uint64) {
+	nonces := make(map[string]uint64, len(idx.nonces))
+	for addr, n := range idx.nonces {
+		nonces[addr] = n
+	}
+	balances := make(map[string]uint64, len(idx.balances))
+	for addr, v := range idx.balances {
+		balances[addr] = v
+	}
+	return nonces, balances
+}
+
+func (idx *AddressIndex) Balance(blockchainAddress string) uint64 {
+	return idx.balances[blockchainAddress]
+}
+
+// 承認済みのトランザクション数(送信者が次に使うべきnonce)
+func (idx *AddressIndex) Nonce(blockchainAddress string) uint64 {
+	return idx.nonces[blockchainAddress]
+}
+
+// 新しい順にoffset件目からlimit件の履歴と、履歴の総数を返す
+func (idx *AddressIndex) History(blockchainAddress string, offset int, limit int) ([]*AddressTransaction, int) {
+	history := idx.history[blockchainAddress]
+	total := len(history)
+	if limit <= 0 {
+		limit = ADDRESS_HISTORY_DEFAULT_LIMIT
+	}
+	if limit > ADDRESS_HISTORY_MAX_LIMIT {
+		limit = ADDRESS_HISTORY_MAX_LIMIT
+	}
+	page := make([]*AddressTransaction, 0, limit)
+	if offset < 0 {
+		offset = 0
+	}
+	for i := total - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, history[i])
+	}
+	return page, total
+}
+
+// アドレスの承認済みのトランザクションの履歴(新しい順)
+func (bc *Blockchain) AddressHistory(blockchainAddress string, offset int, limit int) ([]*AddressTransaction, int) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.index.History(blockchainAddress, offset, limit)
+}
@@ -0,0 +1,55 @@
+package block
+
+import (
+	"testing"
+)
+
+// 索引の残高とnonceは、チェーンを走査した結果と一致する
+func TestAddressIndex(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		bc.connectTestBlock(mineTestBlock(bc, bc.chain, "miner", alice.transfer(t, bob.address, 100, 10, nonce)))
+	}
+	rebuilt := NewAddressIndexFromChain(bc.chain)
+	for _, address := range []string{alice.address, bob.address, "miner"} {
+		if bc.index.Balance(address) != rebuilt.Balance(address) {
+			t.Fatalf("balance of %s is %d, want %d", address, bc.index.Balance(address), rebuilt.Balance(address))
+		}
+	}
+	if got := bc.index.Balance(bob.address); got != 300 {
+		t.Fatalf("balance of bob is %d, want 300", got)
+	}
+	if got := bc.index.Balance(alice.address); got != MINIG_REWARD-330 {
+		t.Fatalf("balance of alice is %d, want %d", got, MINIG_REWARD-330)
+	}
+	if got := bc.index.Nonce(alice.address); got != 3 {
+		t.Fatalf("nonce of alice is %d, want 3", got)
+	}
+}
+
+// 履歴は新しい順に返し、offsetとlimitでページを分ける
+func TestAddressIndexHistory(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		bc.connectTestBlock(mineTestBlock(bc, bc.chain, "miner", alice.transfer(t, bob.address, 100, 10, nonce)))
+	}
+	// リワードの受信と3件の送信
+	page, total := bc.index.History(alice.address, 0, 2)
+	if total != 4 || len(page) != 2 {
+		t.Fatalf("%d of %d entries, want 2 of 4", len(page), total)
+	}
+	if page[0].Direction != ADDRESS_DIRECTION_SENT || page[0].Height <= page[1].Height {
+		t.Fatalf("first entry %+v is not the newest transfer", page[0])
+	}
+	page, _ = bc.index.History(alice.address, 3, 2)
+	if len(page) != 1 || page[0].Direction != ADDRESS_DIRECTION_RECEIVED || page[0].Counterparty != MINIG_SENDER {
+		t.Fatalf("last page %+v, want the mining reward only", page)
+	}
+	if page, _ := bc.index.History(bob.address, 0, 0); len(page) != 3 {
+		t.Fatalf("%d entries with the default limit, want 3", len(page))
+	}
+}
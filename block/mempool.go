@@ -0,0 +1,485 @@
+package block
+
+import (
+	"block/utils"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	// 未承認トランザクションのバイナリ形式の合計サイズの上限のデフォルト値(byte)
+	MEMPOOL_MAX_BYTES_DEFAULT = 50 * MAX_BLOCK_SIZE
+	// この時間を過ぎても承認されないトランザクションは破棄する
+	MEMPOOL_EXPIRY_DEFAULT = 72 * time.Hour
+	// 1つの送信者が持てる未承認トランザクション数の上限のデフォルト値
+	MEMPOOL_MAX_PER_SENDER_DEFAULT = 25
+)
+
+var (
+	ErrAlreadyInMempool = errors.New("transaction already in the mempool")
+	ErrMempoolFull      = errors.New("mempool is full")
+	ErrSenderLimit      = errors.New("too many pending transactions from the sender")
+)
+
+type MempoolLimits struct {
+	// 合計サイズの上限(byte)
+	MaxBytes int
+	Expiry   time.Duration
+	// 送信者ごとの件数の上限
+	MaxPerSender int
+}
+
+func DefaultMempoolLimits() MempoolLimits {
+	return MempoolLimits{
+		MaxBytes:     MEMPOOL_MAX_BYTES_DEFAULT,
+		Expiry:       MEMPOOL_EXPIRY_DEFAULT,
+		MaxPerSender: MEMPOOL_MAX_PER_SENDER_DEFAULT,
+	}
+}
+
+// 未承認トランザクションと、受け付けた際の情報
+type MempoolEntry struct {
+	tx      *Transaction
+	id      [32]byte
+	size    int
+	feeRate float64
+	arrival time.Time
+	// 送ってきたノード(自分のAPIで受け付けたものは空)
+	source string
+	// mempoolに加えた順番
+	seq uint64
+	// ヒープの中の位置
+	feeIndex     int
+	arrivalIndex int
+}
+
+func newMempoolEntry(t *Transaction, source string, arrival time.Time) *MempoolEntry {
+	return &MempoolEntry{
+		tx:      t,
+		id:      t.ID(),
+		size:    t.Size(),
+		feeRate: t.FeeRate(),
+		arrival: arrival,
+		source:  source,
+	}
+}
+
+// 手数料率の低い順(同じ場合は先に加えた順)のヒープ
+type feeRateHeap []*MempoolEntry
+
+func (h feeRateHeap) Len() int { return len(h) }
+func (h feeRateHeap) Less(i, j int) bool {
+	if h[i].feeRate != h[j].feeRate {
+		return h[i].feeRate < h[j].feeRate
+	}
+	return h[i].seq < h[j].seq
+}
+func (h feeRateHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].feeIndex = i
+	h[j].feeIndex = j
+}
+func (h *feeRateHeap) Push(x interface{}) {
+	e := x.(*MempoolEntry)
+	e.feeIndex = len(*h)
+	*h = append(*h, e)
+}
+func (h *feeRateHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.feeIndex = -1
+	*h = old[:len(old)-1]
+	return e
+}
+
+// 到着時刻の古い順(同じ場合は先に加えた順)のヒープ
+type arrivalHeap []*MempoolEntry
+
+func (h arrivalHeap) Len() int { return len(h) }
+func (h arrivalHeap) Less(i, j int) bool {
+	if !h[i].arrival.Equal(h[j].arrival) {
+		return h[i].arrival.Before(h[j].arrival)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h arrivalHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].arrivalIndex = i
+	h[j].arrivalIndex = j
+}
+func (h *arrivalHeap) Push(x interface{}) {
+	e := x.(*MempoolEntry)
+	e.arrivalIndex = len(*h)
+	*h = append(*h, e)
+}
+func (h *arrivalHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	e.arrivalIndex = -1
+	*h = old[:len(old)-1]
+	return e
+}
+
+// 前回の保存から後のmempoolの変更(txは取り除いた場合はnil)
+type mempoolChange struct {
+	id [32]byte
+	tx *Transaction
+}
+
+// 検証済みの未承認トランザクション
+// 送信者ごとにnonce順のキューで保持し、txidで重複を、消費している出力で二重支払いを検出する
+// 合計サイズが上限を超える場合は手数料率の低いものから追い出し、期限を過ぎたものは破棄する
+// Blockchainのbc.muxで保護される
+type Mempool struct {
+	limits MempoolLimits
+	byID   map[[32]byte]*MempoolEntry
+	// 送信者ごとのnonce順のキュー(nonceは承認済みのnonceから連続している)
+	bySender map[string][]*MempoolEntry
+	// 未承認のトランザクションが消費している出力と、消費しているトランザクション
+	spent     map[OutPoint][32]byte
+	byFeeRate feeRateHeap
+	byArrival arrivalHeap
+	// アドレスごとの未承認の送金(手数料を含む)と受け取りの合計
+	outgoing map[string]uint64
+	incoming map[string]uint64
+	seq      uint64
+	bytes    int
+	// ストレージにまだ書き込んでいない変更
+	changes []*mempoolChange
+}
+
+func NewMempool(limits MempoolLimits) *Mempool {
+	return &Mempool{
+		limits:    limits,
+		byID:      make(map[[32]byte]*MempoolEntry),
+		bySender:  make(map[string][]*MempoolEntry),
+		spent:     make(map[OutPoint][32]byte),
+		byFeeRate: make(feeRateHeap, 0),
+		byArrival: make(arrivalHeap, 0),
+		outgoing:  make(map[string]uint64),
+		incoming:  make(map[string]uint64),
+		changes:   make([]*mempoolChange, 0),
+	}
+}
+
+// 同じ上限の空のMempool
+func (mp *Mempool) empty() *Mempool {
+	return NewMempool(mp.limits)
+}
+
+func (mp *Mempool) Len() int {
+	return len(mp.byID)
+}
+
+// 加えた順のトランザクション(送信者ごとにはnonce順)
+func (mp *Mempool) Transactions() []*Transaction {
+	entries := make([]*MempoolEntry, 0, len(mp.byID))
+	for _, e := range mp.byID {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].seq < entries[j].seq
+	})
+	transactions := make([]*Transaction, 0, len(entries))
+	for _, e := range entries {
+		transactions = append(transactions, e.tx)
+	}
+	return transactions
+}
+
+func (mp *Mempool) entry(txid [32]byte) *MempoolEntry {
+	return mp.byID[txid]
+}
+
+func (mp *Mempool) Transaction(txid [32]byte) *Transaction {
+	if e := mp.byID[txid]; e != nil {
+		return e.tx
+	}
+	return nil
+}
+
+func (mp *Mempool) senderCount(sender string) int {
+	return len(mp.bySender[sender])
+}
+
+// 送信者の未承認トランザクション(nonce順)
+func (mp *Mempool) senderEntries(sender string) []*MempoolEntry {
+	return mp.bySender[sender]
+}
+
+// outpointを消費している未承認トランザクション
+func (mp *Mempool) spender(op OutPoint) *MempoolEntry {
+	if txid, ok := mp.spent[op]; ok {
+		return mp.byID[txid]
+	}
+	return nil
+}
+
+// eと、同じ送信者のより大きいnonceのエントリー
+func (mp *Mempool) descendants(e *MempoolEntry) []*MempoolEntry {
+	q := mp.bySender[e.tx.senderBlockchainAddress]
+	for i, d := range q {
+		if d == e {
+			return q[i:]
+		}
+	}
+	return nil
+}
+
+// アドレスの未承認の送金(手数料を含む)の合計
+func (mp *Mempool) outgoingTotal(address string) uint64 {
+	return mp.outgoing[address]
+}
+
+// アドレスの未承認の受け取りの合計
+func (mp *Mempool) incomingTotal(address string) uint64 {
+	return mp.incoming[address]
+}
+
+// 検証済みのエントリーを加える
+// 上限を超える場合は手数料率がeより低いものを追い出し、追い出せない場合はErrMempoolFullを返す
+// 送信者の送金の合計か受信者の受け取りの合計がuint64に収まらなくなる場合は受け付けない
+func (mp *Mempool) add(e *MempoolEntry) ([]*MempoolEntry, error) {
+	if mp.byID[e.id] != nil {
+		return nil, ErrAlreadyInMempool
+	}
+	sender := e.tx.senderBlockchainAddress
+	recipient := e.tx.recipientBlockchainAddress
+	if mp.limits.MaxPerSender > 0 && len(mp.bySender[sender]) >= mp.limits.MaxPerSender {
+		return nil, fmt.Errorf("%w: %d pending transactions from %s", ErrSenderLimit, mp.limits.MaxPerSender, sender)
+	}
+	cost, ok := e.tx.Cost()
+	if !ok {
+		return nil, utils.ErrAmountOverflow
+	}
+	if _, ok := utils.AddAmount(mp.outgoing[sender], cost); !ok {
+		return nil, fmt.Errorf("%w: pending transfers from %s", utils.ErrAmountOverflow, sender)
+	}
+	if _, ok := utils.AddAmount(mp.incoming[recipient], e.tx.value); !ok {
+		return nil, fmt.Errorf("%w: pending transfers to %s", utils.ErrAmountOverflow, recipient)
+	}
+	evicted, err := mp.evictionPlan(e)
+	if err != nil {
+		return nil, err
+	}
+	mp.remove(evicted)
+	mp.seq += 1
+	e.seq = mp.seq
+	mp.byID[e.id] = e
+	mp.bySender[sender] = append(mp.bySender[sender], e)
+	for _, in := range e.tx.inputs {
+		mp.spent[in.prevOut] = e.id
+	}
+	heap.Push(&mp.byFeeRate, e)
+	heap.Push(&mp.byArrival, e)
+	// 追い出しでは合計が減るだけなので、上で確かめた範囲に収まる
+	mp.outgoing[sender] += cost
+	mp.incoming[recipient] += e.tx.value
+	mp.bytes += e.size
+	mp.changes = append(mp.changes, &mempoolChange{id: e.id, tx: e.tx})
+	return evicted, nil
+}
+
+// eを加えるために追い出すエントリー
+// 手数料率の低い順に選び、nonceを飛ばさないよう同じ送信者のより大きいnonceのものも一緒に追い出す
+// eの送信者のものは追い出さない(eのnonceが繋がらなくなるため)
+// 調べた分だけヒープから取り出し、最後に戻す
+func (mp *Mempool) evictionPlan(e *MempoolEntry) ([]*MempoolEntry, error) {
+	if mp.limits.MaxBytes <= 0 || mp.bytes+e.size <= mp.limits.MaxBytes {
+		return nil, nil
+	}
+	if e.size > mp.limits.MaxBytes {
+		return nil, fmt.Errorf("%w: transaction of %d bytes exceeds the limit of %d bytes", ErrMempoolFull, e.size, mp.limits.MaxBytes)
+	}
+	popped := make([]*MempoolEntry, 0)
+	defer func() {
+		for _, p := range popped {
+			heap.Push(&mp.byFeeRate, p)
+		}
+	}()
+	selected := make(map[[32]byte]bool)
+	evicted := make([]*MempoolEntry, 0)
+	freed := 0
+	for mp.bytes-freed+e.size > mp.limits.MaxBytes && mp.byFeeRate.Len() > 0 {
+		victim := heap.Pop(&mp.byFeeRate).(*MempoolEntry)
+		popped = append(popped, victim)
+		if victim.feeRate >= e.feeRate {
+			break
+		}
+		if selected[victim.id] || victim.tx.senderBlockchainAddress == e.tx.senderBlockchainAddress {
+			continue
+		}
+		for _, d := range mp.descendants(victim) {
+			if !selected[d.id] {
+				selected[d.id] = true
+				evicted = append(evicted, d)
+				freed += d.size
+			}
+		}
+	}
+	if mp.bytes-freed+e.size > mp.limits.MaxBytes {
+		return nil, fmt.Errorf("%w: fee rate %.4f is too low", ErrMempoolFull, e.feeRate)
+	}
+	return evicted, nil
+}
+
+// エントリーを取り除く(既に取り除いたものは無視する)
+// 送信者のnonceが連続するよう、呼び出し側はキューの先頭か末尾から取り除く
+func (mp *Mempool) remove(removed []*MempoolEntry) {
+	for _, e := range removed {
+		if mp.byID[e.id] != e {
+			continue
+		}
+		delete(mp.byID, e.id)
+		sender := e.tx.senderBlockchainAddress
+		q := mp.bySender[sender]
+		for i, d := range q {
+			if d == e {
+				q = append(q[:i:i], q[i+1:]...)
+				break
+			}
+		}
+		if len(q) == 0 {
+			delete(mp.bySender, sender)
+		} else {
+			mp.bySender[sender] = q
+		}
+		for _, in := range e.tx.inputs {
+			if mp.spent[in.prevOut] == e.id {
+				delete(mp.spent, in.prevOut)
+			}
+		}
+		heap.Remove(&mp.byFeeRate, e.feeIndex)
+		heap.Remove(&mp.byArrival, e.arrivalIndex)
+		cost, _ := e.tx.Cost()
+		if mp.outgoing[sender] -= cost; mp.outgoing[sender] == 0 {
+			delete(mp.outgoing, sender)
+		}
+		recipient := e.tx.recipientBlockchainAddress
+		if mp.incoming[recipient] -= e.tx.value; mp.incoming[recipient] == 0 {
+			delete(mp.incoming, recipient)
+		}
+		mp.bytes -= e.size
+		mp.changes = append(mp.changes, &mempoolChange{id: e.id})
+	}
+}
+
+// 期限を過ぎたエントリーを、同じ送信者のより大きいnonceのものと一緒に取り除く
+func (mp *Mempool) expire(now time.Time) []*MempoolEntry {
+	if mp.limits.Expiry <= 0 {
+		return nil
+	}
+	expired := make([]*MempoolEntry, 0)
+	for mp.byArrival.Len() > 0 && now.Sub(mp.byArrival[0].arrival) >= mp.limits.Expiry {
+		removed := mp.descendants(mp.byArrival[0])
+		mp.remove(removed)
+		expired = append(expired, removed...)
+	}
+	return expired
+}
+
+// ストレージにまだ書き込んでいない変更を取り出す
+func (mp *Mempool) takeChanges() []*mempoolChange {
+	changes := mp.changes
+	mp.changes = make([]*mempoolChange, 0)
+	return changes
+}
+
+// 期限を過ぎた未承認トランザクションを破棄する
+// bc.muxを保持した状態で呼び出す
+func (bc *Blockchain) expireTransactions() {
+	expired := bc.mempool.expire(time.Now())
+	if len(expired) == 0 {
+		return
+	}
+	for _, e := range expired {
+		log.Printf("action=expire_transaction, txid=%x, arrival=%s", e.id, e.arrival.Format(time.RFC3339))
+	}
+	bc.journalTransactionPool()
+}
+
+// GET /mempool/statsのレスポンス
+type MempoolStats struct {
+	Count    int
+	Bytes    int
+	MaxBytes int
+	Senders  int
+	TotalFee uint64
+	// 手数料率(1byteあたりの手数料)の最小値と最大値
+	MinFeeRate float64
+	MaxFeeRate float64
+	// 最も古いトランザクションの到着時刻(空の場合はゼロ値)
+	Oldest       time.Time
+	Expiry       time.Duration
+	MaxPerSender int
+}
+
+func (ms *MempoolStats) MarshalJSON() ([]byte, error) {
+	var oldest int64
+	if !ms.Oldest.IsZero() {
+		oldest = ms.Oldest.Unix()
+	}
+	return json.Marshal(struct {
+		Count        int     `json:"count"`
+		Bytes        int     `json:"bytes"`
+		MaxBytes     int     `json:"max_bytes"`
+		Senders      int     `json:"senders"`
+		TotalFee     string  `json:"total_fee"`
+		MinFeeRate   float64 `json:"min_fee_rate"`
+		MaxFeeRate   float64 `json:"max_fee_rate"`
+		Oldest       int64   `json:"oldest_arrival"`
+		ExpirySec    int64   `json:"expiry_sec"`
+		MaxPerSender int     `json:"max_per_sender"`
+	}{
+		Count:        ms.Count,
+		Bytes:        ms.Bytes,
+		MaxBytes:     ms.MaxBytes,
+		Senders:      ms.Senders,
+		TotalFee:     utils.FormatAmount(ms.TotalFee),
+		MinFeeRate:   ms.MinFeeRate,
+		MaxFeeRate:   ms.MaxFeeRate,
+		Oldest:       oldest,
+		ExpirySec:    int64(ms.Expiry / time.Second),
+		MaxPerSender: ms.MaxPerSender,
+	})
+}
+
+func (bc *Blockchain) MempoolStats() *MempoolStats {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	bc.expireTransactions()
+	mp := bc.mempool
+	ms := &MempoolStats{
+		Count:        len(mp.byID),
+		Bytes:        mp.bytes,
+		MaxBytes:     mp.limits.MaxBytes,
+		Senders:      len(mp.bySender),
+		Expiry:       mp.limits.Expiry,
+		MaxPerSender: mp.limits.MaxPerSender,
+	}
+	if len(mp.byID) > 0 {
+		ms.MinFeeRate = mp.byFeeRate[0].feeRate
+		ms.Oldest = mp.byArrival[0].arrival
+	}
+	for _, e := range mp.byID {
+		ms.TotalFee += e.tx.fee
+		if e.feeRate > ms.MaxFeeRate {
+			ms.MaxFeeRate = e.feeRate
+		}
+	}
+	return ms
+}
+
+// 未承認トランザクションの上限を変更する(既に受け付けたものは追い出さない)
+func (bc *Blockchain) SetMempoolLimits(limits MempoolLimits) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	bc.mempool.limits = limits
+}
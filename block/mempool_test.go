@@ -0,0 +1,175 @@
+package block
+
+import (
+	"block/utils"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func testEntry(sender string, fee uint64, nonce uint64, arrival time.Time) *MempoolEntry {
+	return newMempoolEntry(NewTransaction(sender, "recipient", 1, fee, nonce), "", arrival)
+}
+
+func TestMempoolEvictsLowestFeeRateWithHigherNonces(t *testing.T) {
+	now := time.Now()
+	low0 := testEntry("low", 1, 0, now)
+	low1 := testEntry("low", 50, 1, now)
+	mid := testEntry("mid", 10, 0, now)
+	mp := NewMempool(MempoolLimits{MaxBytes: low0.size + low1.size + mid.size})
+	for _, e := range []*MempoolEntry{low0, low1, mid} {
+		if _, err := mp.add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// low0を追い出すと、nonceが繋がらなくなるlow1も一緒に追い出される
+	high := testEntry("high", 100, 0, now)
+	evicted, err := mp.add(high)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(evicted) != 2 || evicted[0] != low0 || evicted[1] != low1 {
+		t.Fatalf("evicted %v, want low0 and low1", evicted)
+	}
+	if mp.Len() != 2 || mp.entry(mid.id) == nil || mp.entry(high.id) == nil {
+		t.Fatalf("pool has %d entries, want mid and high", mp.Len())
+	}
+	if mp.senderCount("low") != 0 {
+		t.Fatalf("low still has %d entries", mp.senderCount("low"))
+	}
+
+	// 手数料率が残っているものより低い場合は受け付けない
+	if _, err := mp.add(testEntry("other", 0, 0, now)); err == nil {
+		t.Fatal("accepted a transaction with the lowest fee rate into a full pool")
+	}
+	if mp.Len() != 2 || mp.byFeeRate.Len() != 2 {
+		t.Fatalf("failed add changed the pool: %d entries, %d in the heap", mp.Len(), mp.byFeeRate.Len())
+	}
+}
+
+func TestMempoolDoesNotEvictOwnSender(t *testing.T) {
+	now := time.Now()
+	a0 := testEntry("a", 1, 0, now)
+	mp := NewMempool(MempoolLimits{MaxBytes: a0.size})
+	if _, err := mp.add(a0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mp.add(testEntry("a", 100, 1, now)); err == nil {
+		t.Fatal("evicted an entry of the same sender")
+	}
+}
+
+func TestMempoolExpireRemovesHigherNonces(t *testing.T) {
+	now := time.Now()
+	old := testEntry("a", 1, 0, now.Add(-2*time.Hour))
+	next := testEntry("a", 1, 1, now)
+	other := testEntry("b", 1, 0, now)
+	mp := NewMempool(MempoolLimits{Expiry: time.Hour})
+	for _, e := range []*MempoolEntry{old, next, other} {
+		if _, err := mp.add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expired := mp.expire(now)
+	if len(expired) != 2 || expired[0] != old || expired[1] != next {
+		t.Fatalf("expired %v, want both entries of a", expired)
+	}
+	if mp.Len() != 1 || mp.entry(other.id) == nil {
+		t.Fatalf("pool has %d entries, want only b", mp.Len())
+	}
+	if expired := mp.expire(now); len(expired) != 0 {
+		t.Fatalf("expired %d entries again", len(expired))
+	}
+}
+
+func TestMempoolTransactionsInArrivalOrder(t *testing.T) {
+	now := time.Now()
+	mp := NewMempool(DefaultMempoolLimits())
+	want := []*MempoolEntry{testEntry("a", 1, 0, now), testEntry("b", 9, 0, now), testEntry("a", 5, 1, now)}
+	for _, e := range want {
+		if _, err := mp.add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, tx := range mp.Transactions() {
+		if tx != want[i].tx {
+			t.Fatalf("transaction %d is out of order", i)
+		}
+	}
+}
+
+func TestRemoveMinedTransactionsKeepsRemainingNonces(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	txs := make([]*Transaction, 0)
+	for nonce := uint64(0); nonce < 3; nonce++ {
+		tx := alice.transfer(t, bob.address, 1, 1, nonce)
+		if _, err := bc.AddSignedTransaction(tx, ""); err != nil {
+			t.Fatal(err)
+		}
+		txs = append(txs, tx)
+	}
+
+	bc.processTestBlock(t, mineTestBlock(bc, bc.chain, "miner", txs[0]))
+	if bc.mempool.Len() != 2 || bc.mempool.entry(txs[0].ID()) != nil {
+		t.Fatalf("pool has %d entries after mining nonce 0, want nonces 1 and 2", bc.mempool.Len())
+	}
+	if next := bc.NextNonce(alice.address); next != 3 {
+		t.Fatalf("next nonce %d, want 3", next)
+	}
+
+	// 他のノードが同じnonceの別のトランザクションを承認した場合、続くnonceも無効になる
+	bc.processTestBlock(t, mineTestBlock(bc, bc.chain, "miner", alice.transfer(t, bob.address, 2, 1, 1)))
+	if bc.mempool.Len() != 0 {
+		t.Fatalf("pool has %d entries, want none", bc.mempool.Len())
+	}
+}
+
+func TestMempoolRejectsDuplicatesAndSenderLimit(t *testing.T) {
+	now := time.Now()
+	mp := NewMempool(MempoolLimits{MaxPerSender: 2})
+	a0 := testEntry("a", 1, 0, now)
+	for _, e := range []*MempoolEntry{a0, testEntry("a", 1, 1, now)} {
+		if _, err := mp.add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := mp.add(newMempoolEntry(a0.tx, "", now)); !errors.Is(err, ErrAlreadyInMempool) {
+		t.Fatalf("error %v, want %v", err, ErrAlreadyInMempool)
+	}
+	if _, err := mp.add(testEntry("a", 1, 2, now)); !errors.Is(err, ErrSenderLimit) {
+		t.Fatalf("error %v, want %v", err, ErrSenderLimit)
+	}
+	if _, err := mp.add(testEntry("b", 1, 0, now)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMempoolPendingTotals(t *testing.T) {
+	now := time.Now()
+	mp := NewMempool(DefaultMempoolLimits())
+	a0 := newMempoolEntry(NewTransaction("a", "b", 100, 10, 0), "", now)
+	a1 := newMempoolEntry(NewTransaction("a", "b", 200, 20, 1), "", now)
+	for _, e := range []*MempoolEntry{a0, a1} {
+		if _, err := mp.add(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if mp.outgoingTotal("a") != 330 || mp.incomingTotal("b") != 300 {
+		t.Fatalf("outgoing %d, incoming %d, want 330 and 300", mp.outgoingTotal("a"), mp.incomingTotal("b"))
+	}
+
+	// 合計が溢れるトランザクションは受け付けない
+	if _, err := mp.add(newMempoolEntry(NewTransaction("c", "b", math.MaxUint64-299, 0, 0), "", now)); !errors.Is(err, utils.ErrAmountOverflow) {
+		t.Fatalf("error %v, want %v", err, utils.ErrAmountOverflow)
+	}
+
+	mp.remove(mp.descendants(a0))
+	if mp.outgoingTotal("a") != 0 || mp.incomingTotal("b") != 0 || len(mp.outgoing) != 0 || len(mp.incoming) != 0 {
+		t.Fatalf("totals remain after removing all entries: outgoing %d, incoming %d", mp.outgoingTotal("a"), mp.incomingTotal("b"))
+	}
+}
@@ -0,0 +1,236 @@
+package block
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrBlockNotFound       = errors.New("block not found")
+	ErrTransactionNotFound = errors.New("transaction not found")
+)
+
+// 葉と内部ノードのハッシュを区別する接頭辞
+// 区別しないと、2つのトランザクションIDを連結した64byteを内部ノードとして
+// 偽のトランザクションの包含を証明できてしまう(second preimage)
+const (
+	MERKLE_LEAF_PREFIX byte = 0x00
+	MERKLE_NODE_PREFIX byte = 0x01
+)
+
+// トランザクションIDの葉のハッシュ
+func merkleLeaf(txid [32]byte) [32]byte {
+	var buf [33]byte
+	buf[0] = MERKLE_LEAF_PREFIX
+	copy(buf[1:], txid[:])
+	return sha256.Sum256(buf[:])
+}
+
+// 2つの子ノードを連結したハッシュ
+func merkleParent(left [32]byte, right [32]byte) [32]byte {
+	var buf [65]byte
+	buf[0] = MERKLE_NODE_PREFIX
+	copy(buf[1:33], left[:])
+	copy(buf[33:], right[:])
+	return sha256.Sum256(buf[:])
+}
+
+func merkleLeaves(ids [][32]byte) [][32]byte {
+	leaves := make([][32]byte, len(ids))
+	for i, id := range ids {
+		leaves[i] = merkleLeaf(id)
+	}
+	return leaves
+}
+
+// 1つ上の階層のノードを計算する
+// ノードの数が奇数の場合は末尾のノードを複製して対にする
+func merkleLevel(nodes [][32]byte) [][32]byte {
+	parents := make([][32]byte, 0, (len(nodes)+1)/2)
+	for i := 0; i < len(nodes); i += 2 {
+		right := nodes[i]
+		if i+1 < len(nodes) {
+			right = nodes[i+1]
+		}
+		parents = append(parents, merkleParent(nodes[i], right))
+	}
+	return parents
+}
+
+// count個の葉を持つ木の深さ(包含証明の兄弟ノードの数)
+func merkleDepth(count int) int {
+	depth := 0
+	for n := count; n > 1; n = (n + 1) / 2 {
+		depth += 1
+	}
+	return depth
+}
+
+// トランザクションIDの列からMerkle rootを計算する
+// トランザクションがない場合はゼロのハッシュ
+func MerkleRoot(ids [][32]byte) [32]byte {
+	if len(ids) == 0 {
+		return [32]byte{}
+	}
+	nodes := merkleLeaves(ids)
+	for len(nodes) > 1 {
+		nodes = merkleLevel(nodes)
+	}
+	return nodes[0]
+}
+
+func TransactionIDs(transactions []*Transaction) [][32]byte {
+	ids := make([][32]byte, len(transactions))
+	for i, t := range transactions {
+		ids[i] = t.ID()
+	}
+	return ids
+}
+
+func TransactionsMerkleRoot(transactions []*Transaction) [32]byte {
+	return MerkleRoot(TransactionIDs(transactions))
+}
+
+// index番目のトランザクションからrootまでの経路上にある兄弟ノードを葉に近い順に返す
+func MerkleBranch(ids [][32]byte, index int) [][32]byte {
+	branch := make([][32]byte, 0)
+	nodes := merkleLeaves(ids)
+	for len(nodes) > 1 {
+		sibling := index ^ 1
+		if sibling >= len(nodes) {
+			sibling = index
+		}
+		branch = append(branch, nodes[sibling])
+		nodes = merkleLevel(nodes)
+		index /= 2
+	}
+	return branch
+}
+
+// 兄弟ノードを順に連結してrootを再計算し、トランザクションがブロックに含まれていることを確認する
+// indexの各bitが、その階層で自分が右側のノードであるかを表す
+// 兄弟ノードの数はcount個のトランザクションの木の深さと一致しなければならず、
+// 奇数個の階層の末尾では兄弟ノードは自分自身の複製でなければならない
+func VerifyMerkleProof(txid [32]byte, index int, count int, branch [][32]byte, root [32]byte) bool {
+	if count <= 0 || index < 0 || index >= count || len(branch) != merkleDepth(count) {
+		return false
+	}
+	node := merkleLeaf(txid)
+	n := count
+	for _, sibling := range branch {
+		if index&1 == 1 {
+			node = merkleParent(sibling, node)
+		} else {
+			if index == n-1 && sibling != node {
+				return false
+			}
+			node = merkleParent(node, sibling)
+		}
+		index >>= 1
+		n = (n + 1) / 2
+	}
+	return node == root
+}
+
+// ライトクライアントに返すトランザクションの包含証明
+// ブロックヘッダーさえ持っていれば、ブロック全体を取得せずに検証できる
+type MerkleProof struct {
+	BlockHash  [32]byte
+	MerkleRoot [32]byte
+	TxID       [32]byte
+	Index      int
+	// ブロック内のトランザクション数(木の深さを決める)
+	Count  int
+	Branch [][32]byte
+}
+
+func (p *MerkleProof) Verify() bool {
+	return VerifyMerkleProof(p.TxID, p.Index, p.Count, p.Branch, p.MerkleRoot)
+}
+
+func (p *MerkleProof) MarshalJSON() ([]byte, error) {
+	branch := make([]string, len(p.Branch))
+	for i, h := range p.Branch {
+		branch[i] = fmt.Sprintf("%x", h)
+	}
+	return json.Marshal(struct {
+		BlockHash  string   `json:"block_hash"`
+		MerkleRoot string   `json:"merkle_root"`
+		TxID       string   `json:"txid"`
+		Index      int      `json:"index"`
+		Count      int      `json:"tx_count"`
+		Branch     []string `json:"branch"`
+	}{
+		BlockHash:  fmt.Sprintf("%x", p.BlockHash),
+		MerkleRoot: fmt.Sprintf("%x", p.MerkleRoot),
+		TxID:       fmt.Sprintf("%x", p.TxID),
+		Index:      p.Index,
+		Count:      p.Count,
+		Branch:     branch,
+	})
+}
+
+func (p *MerkleProof) UnmarshalJSON(data []byte) error {
+	var v struct {
+		BlockHash  string   `json:"block_hash"`
+		MerkleRoot string   `json:"merkle_root"`
+		TxID       string   `json:"txid"`
+		Index      int      `json:"index"`
+		Count      int      `json:"tx_count"`
+		Branch     []string `json:"branch"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	var err error
+	if p.BlockHash, err = ParseHash(v.BlockHash); err != nil {
+		return fmt.Errorf("invalid block_hash %q", v.BlockHash)
+	}
+	if p.MerkleRoot, err = ParseHash(v.MerkleRoot); err != nil {
+		return fmt.Errorf("invalid merkle_root %q", v.MerkleRoot)
+	}
+	if p.TxID, err = ParseHash(v.TxID); err != nil {
+		return fmt.Errorf("invalid txid %q", v.TxID)
+	}
+	p.Index = v.Index
+	p.Count = v.Count
+	p.Branch = make([][32]byte, len(v.Branch))
+	for i, s := range v.Branch {
+		if p.Branch[i], err = ParseHash(s); err != nil {
+			return fmt.Errorf("invalid branch %q", s)
+		}
+	}
+	return nil
+}
+
+// ハッシュがblockHashのブロックにtxidのトランザクションが含まれていることの証明を作る
+// 採用中のチェーン以外の分岐にあるブロックは対象としない
+func (bc *Blockchain) TransactionProof(blockHash [32]byte, txid [32]byte) (*MerkleProof, error) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	n := bc.tree.node(blockHash)
+	if n == nil {
+		return nil, ErrBlockNotFound
+	}
+	height := n.block.header.height
+	if height >= uint64(len(bc.chain)) || bc.chain[height].Hash() != blockHash {
+		return nil, ErrBlockNotFound
+	}
+	b := n.block
+	ids := TransactionIDs(b.transactions)
+	for i, id := range ids {
+		if id == txid {
+			return &MerkleProof{
+				BlockHash:  blockHash,
+				MerkleRoot: b.header.merkleRoot,
+				TxID:       txid,
+				Index:      i,
+				Count:      len(ids),
+				Branch:     MerkleBranch(ids, i),
+			}, nil
+		}
+	}
+	return nil, ErrTransactionNotFound
+}
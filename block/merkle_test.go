@@ -0,0 +1,103 @@
+package block
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func testTransactionIDs(n int) [][32]byte {
+	ids := make([][32]byte, n)
+	for i := range ids {
+		ids[i] = [32]byte{byte(i + 1)}
+	}
+	return ids
+}
+
+// 奇数個の階層を含む様々な木で、全ての葉の包含証明が検証できる
+func TestMerkleBranch(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		ids := testTransactionIDs(n)
+		root := MerkleRoot(ids)
+		for i := range ids {
+			branch := MerkleBranch(ids, i)
+			if !VerifyMerkleProof(ids[i], i, n, branch, root) {
+				t.Fatalf("proof of %d in %d transactions was rejected", i, n)
+			}
+			if n > 1 && VerifyMerkleProof(ids[i], (i+1)%n, n, branch, root) {
+				t.Fatalf("proof of %d in %d transactions was accepted at another index", i, n)
+			}
+		}
+	}
+}
+
+func TestVerifyMerkleProofRejects(t *testing.T) {
+	ids := testTransactionIDs(3)
+	root := MerkleRoot(ids)
+	branch := MerkleBranch(ids, 2)
+	tests := []struct {
+		name   string
+		txid   [32]byte
+		index  int
+		count  int
+		branch [][32]byte
+	}{
+		{"other txid", [32]byte{9}, 2, 3, branch},
+		{"index out of range", ids[2], 3, 3, branch},
+		{"short branch", ids[2], 2, 3, branch[:1]},
+		{"wrong count", ids[2], 2, 5, branch},
+		// 奇数個の階層の末尾で、複製ではない兄弟ノードを使った偽の証明
+		{"forged duplicate", ids[2], 2, 3, [][32]byte{{7}, branch[1]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if VerifyMerkleProof(tt.txid, tt.index, tt.count, tt.branch, root) {
+				t.Fatal("accepted an invalid proof")
+			}
+		})
+	}
+}
+
+// 葉と内部ノードを区別するため、内部ノードの値を葉として渡しても同じrootにならない
+func TestMerkleRootSeparatesLeaves(t *testing.T) {
+	ids := testTransactionIDs(2)
+	inner := merkleParent(merkleLeaf(ids[0]), merkleLeaf(ids[1]))
+	if MerkleRoot([][32]byte{inner}) == MerkleRoot(ids) {
+		t.Fatal("an inner node was accepted as a leaf")
+	}
+}
+
+func TestTransactionProof(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	tx := alice.transfer(t, bob.address, 1, 0, 0)
+	b := mineTestBlock(bc, bc.chain, bob.address, tx)
+	bc.connectTestBlock(b)
+
+	proof, err := bc.TransactionProof(b.Hash(), tx.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proof.Verify() || proof.MerkleRoot != b.header.merkleRoot {
+		t.Fatal("proof does not verify against the block header")
+	}
+	data, err := json.Marshal(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded MerkleProof
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Verify() {
+		t.Fatal("decoded proof does not verify")
+	}
+
+	if _, err := bc.TransactionProof(b.Hash(), [32]byte{1}); !errors.Is(err, ErrTransactionNotFound) {
+		t.Fatalf("error %v, want %v", err, ErrTransactionNotFound)
+	}
+	if _, err := bc.TransactionProof([32]byte{1}, tx.ID()); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("error %v, want %v", err, ErrBlockNotFound)
+	}
+}
@@ -0,0 +1,166 @@
+package block
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 各ワーカーがキャンセルの確認とハッシュ数の集計を行う間隔
+	MINER_CHECK_INTERVAL = 1024
+)
+
+var ErrInvalidTarget = errors.New("invalid proof of work target")
+
+// nonceの探索を複数のgoroutineで並列に行うマイナー
+type Miner struct {
+	mux sync.Mutex
+	// ワーカー数の変更は次の探索から反映される
+	workers int
+	// 現在(または直前)の探索の開始時刻と計算したハッシュの数
+	searching   bool
+	searchStart time.Time
+	hashes      uint64
+	// 直前に完了した探索のハッシュレート(hash/s)
+	lastHashrate float64
+}
+
+func NewMiner(workers int) *Miner {
+	m := new(Miner)
+	m.SetWorkers(workers)
+	return m
+}
+
+func (m *Miner) Workers() int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.workers
+}
+
+// 探索に使うgoroutineの数を変更する
+func (m *Miner) SetWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	m.mux.Lock()
+	m.workers = workers
+	m.mux.Unlock()
+}
+
+// 1秒あたりのハッシュの計算回数
+// 探索中はその探索の開始からの平均、探索していない場合は直前の探索の値を返す
+func (m *Miner) Hashrate() float64 {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if !m.searching {
+		return m.lastHashrate
+	}
+	elapsed := time.Since(m.searchStart).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(atomic.LoadUint64(&m.hashes)) / elapsed
+}
+
+func (m *Miner) MarshalJSON() ([]byte, error) {
+	m.mux.Lock()
+	workers := m.workers
+	searching := m.searching
+	m.mux.Unlock()
+	return json.Marshal(struct {
+		Workers   int     `json:"workers"`
+		Searching bool    `json:"searching"`
+		Hashrate  float64 `json:"hashrate"`
+	}{
+		Workers:   workers,
+		Searching: searching,
+		Hashrate:  m.Hashrate(),
+	})
+}
+
+// 目標値を満たすnonceを探索し、nonceとタイムスタンプを埋めたヘッダーを返す
+// ワーカーiはi, i+workers, i+2*workers...のnonceを担当し、誰かが見つけるかctxがキャンセルされると全員が終了する
+// ヘッダーのタイムスタンプがrefreshより古くなった場合やnonceの範囲を使い切った場合は、
+// タイムスタンプを現在時刻に更新してnonceを最初から探索し直す(refreshが0以下なら経過時間では更新しない)
+func (m *Miner) Search(ctx context.Context, header BlockHeader, refresh time.Duration) (BlockHeader, error) {
+	target, ok := CompactToTarget(header.bits)
+	if !ok {
+		return header, ErrInvalidTarget
+	}
+
+	m.mux.Lock()
+	workers := m.workers
+	m.searching = true
+	m.searchStart = time.Now()
+	atomic.StoreUint64(&m.hashes, 0)
+	m.mux.Unlock()
+
+	searchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	found := make(chan BlockHeader, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+			// ワーカーごとにヘッダーをコピーしてnonceとタイムスタンプだけを書き換える
+			h := header
+			stale := func() bool {
+				return refresh > 0 && time.Since(time.Unix(0, h.timestamp)) >= refresh
+			}
+			if stale() {
+				h.timestamp = time.Now().UnixNano()
+			}
+			var count uint64 = 0
+			nonce := start
+			for {
+				if count == MINER_CHECK_INTERVAL {
+					atomic.AddUint64(&m.hashes, count)
+					count = 0
+					if searchCtx.Err() != nil {
+						return
+					}
+					if stale() {
+						h.timestamp = time.Now().UnixNano()
+						nonce = start
+					}
+				}
+				count += 1
+				h.nonce = nonce
+				if validPloof(&h, &target) {
+					atomic.AddUint64(&m.hashes, count)
+					found <- h
+					cancel()
+					return
+				}
+				if nonce > math.MaxInt-workers {
+					// 担当するnonceを使い切った
+					h.timestamp = time.Now().UnixNano()
+					nonce = start
+				} else {
+					nonce += workers
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	m.mux.Lock()
+	m.searching = false
+	if elapsed := time.Since(m.searchStart).Seconds(); elapsed > 0 {
+		m.lastHashrate = float64(atomic.LoadUint64(&m.hashes)) / elapsed
+	}
+	m.mux.Unlock()
+
+	select {
+	case solved := <-found:
+		return solved, nil
+	default:
+		return header, ctx.Err()
+	}
+}
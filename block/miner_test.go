@@ -0,0 +1,78 @@
+package block
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMinerSearch(t *testing.T) {
+	m := NewMiner(4)
+	transactions := []*Transaction{NewTransaction(MINIG_SENDER, "miner", MINIG_REWARD, 0, 1)}
+	header := NewBlockHeader(1, [32]byte{1}, MINIG_INITIAL_BITS, transactions)
+	solved, err := m.Search(context.Background(), *header, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, _ := CompactToTarget(MINIG_INITIAL_BITS)
+	if !validPloof(&solved, &target) {
+		t.Fatalf("nonce %d does not meet the target", solved.nonce)
+	}
+	if solved.merkleRoot != header.merkleRoot || solved.previousHash != header.previousHash {
+		t.Fatal("search changed the header other than the nonce and the timestamp")
+	}
+}
+
+// 生成間隔より古くなったタイムスタンプは現在時刻に更新して探索する
+func TestMinerSearchRefreshesTimestamp(t *testing.T) {
+	m := NewMiner(2)
+	header := NewBlockHeader(1, [32]byte{1}, MINIG_POW_LIMIT_BITS, nil)
+	stale := time.Now().Add(-time.Hour)
+	header.timestamp = stale.UnixNano()
+	solved, err := m.Search(context.Background(), *header, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Unix(0, solved.timestamp).Sub(stale) < time.Hour {
+		t.Fatalf("timestamp %v was not refreshed", time.Unix(0, solved.timestamp))
+	}
+	target, _ := CompactToTarget(MINIG_POW_LIMIT_BITS)
+	if !validPloof(&solved, &target) {
+		t.Fatal("refreshed header does not meet the target")
+	}
+
+	// refreshが0なら古いタイムスタンプのまま探索する
+	solved, err = m.Search(context.Background(), *header, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if solved.timestamp != header.timestamp {
+		t.Fatalf("timestamp %d, want %d", solved.timestamp, header.timestamp)
+	}
+}
+
+// キャンセルされると見つかっていなくても全ワーカーが終了する
+func TestMinerSearchCanceled(t *testing.T) {
+	m := NewMiner(2)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	// 目標値1はほぼ満たせない
+	if _, err := m.Search(ctx, *NewBlockHeader(1, [32]byte{}, 0x01010000, nil), time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error %v, want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := m.Search(context.Background(), *NewBlockHeader(1, [32]byte{}, 0, nil), time.Minute); !errors.Is(err, ErrInvalidTarget) {
+		t.Fatalf("error %v, want %v", err, ErrInvalidTarget)
+	}
+}
+
+func TestMinerSetWorkers(t *testing.T) {
+	m := NewMiner(0)
+	if m.Workers() != 1 {
+		t.Fatalf("%d workers, want 1", m.Workers())
+	}
+	m.SetWorkers(8)
+	if m.Workers() != 8 {
+		t.Fatalf("%d workers, want 8", m.Workers())
+	}
+}
@@ -0,0 +1,74 @@
+package block
+
+import (
+	"block/p2p"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// 他のノードにブロックとトランザクションを送る、または問い合わせる際のタイムアウト
+// 応答しないノードがあっても中継やorphanの親の取得が止まらないようにする
+const RELAY_REQUEST_TIMEOUT = 10 * time.Second
+
+var relayClient = &http.Client{Timeout: RELAY_REQUEST_TIMEOUT}
+
+// ブロックを他のノードに送る
+// 受け取ったノードは未知のブロックのみ検証して木に追加し、さらに自分の他のノードに送る
+// 既知のブロックは送り返されても追加されないため、中継はネットワーク全体に届いた時点で止まる
+// TCPで接続中のノードにはinvを送り、それ以外の近隣ノードにはHTTPで本体を送る
+// bc.muxを保持せずに呼び出す
+func (bc *Blockchain) announceBlock(b *Block) {
+	hash := b.Hash()
+	bc.broadcastInv(p2p.INV_TYPE_BLOCK, hash)
+	m, _ := json.Marshal(b)
+	for _, n := range bc.httpNeighbors() {
+		endpoint := fmt.Sprintf("http://%s/blocks", n)
+		resp, err := relayClient.Post(endpoint, "application/json", bytes.NewBuffer(m))
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			bc.peerFailed(n)
+			continue
+		}
+		resp.Body.Close()
+		log.Printf("action=announce_block, hash=%x, to=%s, status=%d", hash, n, resp.StatusCode)
+	}
+}
+
+// POSTメソッドの処理
+// 他のノードから送られたブロックを追加し、新しいブロックであれば他のノードに中継する
+// 親が未知の場合はErrOrphanBlockを返し、親は他のノードにハッシュで問い合わせる
+func (bc *Blockchain) ReceiveBlock(b *Block) error {
+	connected, err := bc.ProcessBlock(b)
+	// bがorphanを繋げた場合は、繋がったorphanも中継する
+	if len(connected) > 0 {
+		go func() {
+			for _, c := range connected {
+				bc.announceBlock(c)
+			}
+		}()
+	}
+	return err
+}
+
+// 受け付けたトランザクションを他のノードに同期する
+// 受け取ったノードはAddSignedTransactionで追加し、HTTPで受け取った場合はそれ以上中継しない
+// bc.muxを保持せずに呼び出す
+func (bc *Blockchain) announceTransaction(t *Transaction) {
+	bc.broadcastInv(p2p.INV_TYPE_TX, t.ID())
+	m, _ := json.Marshal(t.Request())
+	for _, n := range bc.httpNeighbors() {
+		endpoint := fmt.Sprintf("http://%s/transactions", n)
+		req, _ := http.NewRequest("PUT", endpoint, bytes.NewBuffer(m))
+		resp, err := relayClient.Do(req)
+		if err != nil {
+			bc.peerFailed(n)
+			continue
+		}
+		resp.Body.Close()
+		log.Printf("%v", resp)
+	}
+}
@@ -0,0 +1,128 @@
+package block
+
+import (
+	"log"
+)
+
+// チェーンの付け替え(reorg)の内容
+type ReorgEvent struct {
+	// 共通する最後のブロックの高さ(genesisから異なる場合は-1)
+	ForkHeight int64
+	// 取り消したブロックの数
+	Depth     int
+	OldTip    [32]byte
+	NewTip    [32]byte
+	Connected int
+	// 取り消したブロックからmempoolに戻したトランザクションの数と、無効になり破棄した数
+	Returned int
+	Dropped  int
+}
+
+// reorgが起きたときに呼ばれる関数を登録する
+// 関数はbc.muxを解放した後に呼ばれる
+func (bc *Blockchain) OnReorg(f func(*ReorgEvent)) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	bc.reorgListeners = append(bc.reorgListeners, f)
+}
+
+func (bc *Blockchain) emitReorg(e *ReorgEvent) {
+	bc.mux.Lock()
+	listeners := append([]func(*ReorgEvent){}, bc.reorgListeners...)
+	bc.mux.Unlock()
+	for _, f := range listeners {
+		f(e)
+	}
+}
+
+// 2つのチェーンで共通する最後のブロックの位置(共通するブロックがなければ-1)
+func forkPoint(a []*Block, b []*Block) int {
+	fork := -1
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i].Hash() != b[i].Hash() {
+			break
+		}
+		fork = i
+	}
+	return fork
+}
+
+// 検証済みのchainに付け替える
+// 分岐点まで末尾からブロックを取り消し、新しいブロックを順に追加して索引を差分で更新する
+// 取り消したブロックのトランザクション(リワードを除く)はmempoolに戻し、新しい末尾に対して再検証する
+// bc.muxを保持した状態で呼び出す
+func (bc *Blockchain) reorganize(chain []*Block) *ReorgEvent {
+	fork := forkPoint(bc.chain, chain)
+	e := &ReorgEvent{
+		ForkHeight: int64(fork),
+		Depth:      len(bc.chain) - 1 - fork,
+		OldTip:     bc.LastBlock().Hash(),
+		NewTip:     chain[len(chain)-1].Hash(),
+		Connected:  len(chain) - 1 - fork,
+	}
+
+	// 末尾から取り消す(取り消したトランザクションは古い順に並べ直す)
+	returned := make([][]*Transaction, 0, e.Depth)
+	for i := len(bc.chain) - 1; i > fork; i-- {
+		b := bc.chain[i]
+		bc.index.disconnectBlock(b)
+		bc.txIndex.disconnectBlock(b)
+		if bc.utxos != nil {
+			if err := bc.utxos.DisconnectBlock(b); err != nil {
+				// 取り消しの情報がない場合は作り直す
+				log.Printf("ERROR: %v", err)
+				bc.utxos = NewUTXOSetFromChain(bc.chain[:i])
+			}
+		}
+		txs := make([]*Transaction, 0, len(b.transactions))
+		for _, t := range b.transactions {
+			if t.senderBlockchainAddress != MINIG_SENDER {
+				txs = append(txs, t)
+			}
+		}
+		returned = append([][]*Transaction{txs}, returned...)
+	}
+
+	// 新しいブランチを追加する
+	connected := make(map[[32]byte]bool)
+	for _, b := range chain[fork+1:] {
+		bc.index.connectBlock(b)
+		bc.txIndex.connectBlock(b)
+		if bc.utxos != nil {
+			bc.utxos.ConnectBlock(b)
+		}
+		for _, t := range b.transactions {
+			connected[t.ID()] = true
+		}
+	}
+	bc.chain = chain
+	bc.tree.pruneStale(chain)
+	if bc.store != nil {
+		if err := bc.store.ReplaceChain(chain); err != nil {
+			log.Printf("ERROR: %v", err)
+		}
+	}
+
+	// 取り消したトランザクションを既存の未承認トランザクションより先に並べ、nonceの順序を保ったまま受け付け直す
+	// 新しいブランチに含まれているものと、新しい末尾では無効になったものは破棄される
+	candidates := make([]*Transaction, 0)
+	for _, txs := range returned {
+		candidates = append(candidates, txs...)
+	}
+	returnedCount := len(candidates)
+	candidates = append(candidates, bc.mempool.Transactions()...)
+	for i, ok := range bc.readmitTransactions(candidates, connected) {
+		switch {
+		case connected[candidates[i].ID()]:
+		case !ok:
+			e.Dropped += 1
+		case i < returnedCount:
+			e.Returned += 1
+		}
+	}
+	bc.saveTransactionPool()
+	bc.tipChanged()
+	log.Printf("action=reorg, depth=%d, fork_height=%d, connected=%d, returned=%d, dropped=%d, old_tip=%x, new_tip=%x",
+		e.Depth, e.ForkHeight, e.Connected, e.Returned, e.Dropped, e.OldTip, e.NewTip)
+	return e
+}
@@ -0,0 +1,92 @@
+package block
+
+import (
+	"testing"
+)
+
+// 取り消したブロックのトランザクションはmempoolに戻り、新しいブランチに含まれるものは戻らない
+func TestReorganizeReturnsTransactions(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	fork := append([]*Block{}, bc.chain...)
+	returned := alice.transfer(t, bob.address, 100, 10, 0)
+	bc.connectTestBlock(mineTestBlock(bc, bc.chain, "miner", returned))
+	oldTip := bc.LastBlock().Hash()
+
+	b1 := mineTestBlock(bc, fork, "other")
+	b2 := mineTestBlock(bc, append(fork, b1), "other")
+	bc.mux.Lock()
+	e := bc.reorganize(append(fork, b1, b2))
+	bc.mux.Unlock()
+
+	if bc.LastBlock() != b2 {
+		t.Fatal("did not switch to the new branch")
+	}
+	if e.ForkHeight != int64(len(fork)-1) || e.Depth != 1 || e.Connected != 2 || e.OldTip != oldTip || e.NewTip != b2.Hash() {
+		t.Fatalf("unexpected reorg event %+v", e)
+	}
+	if e.Returned != 1 || e.Dropped != 0 {
+		t.Fatalf("returned %d, dropped %d, want 1 and 0", e.Returned, e.Dropped)
+	}
+	if ts := bc.TransactionStatus(returned.ID()); ts.Status != TRANSACTION_STATUS_PENDING {
+		t.Fatalf("status %s of the disconnected transaction, want %s", ts.Status, TRANSACTION_STATUS_PENDING)
+	}
+	if err := bc.VerifyChain(bc.chain); err != nil {
+		t.Fatal(err)
+	}
+	if balance := bc.calculateTotalAmount(bob.address); balance != 0 {
+		t.Fatalf("balance of the recipient is %d after the reorg, want 0", balance)
+	}
+}
+
+func TestReorganizeDropsTransactionsMinedInNewBranch(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	fork := append([]*Block{}, bc.chain...)
+	tx := alice.transfer(t, bob.address, 100, 10, 0)
+	bc.connectTestBlock(mineTestBlock(bc, bc.chain, "miner", tx))
+
+	b1 := mineTestBlock(bc, fork, "other", tx)
+	b2 := mineTestBlock(bc, append(fork, b1), "other")
+	bc.mux.Lock()
+	e := bc.reorganize(append(fork, b1, b2))
+	bc.mux.Unlock()
+	if e.Returned != 0 || len(bc.TransactionPool()) != 0 {
+		t.Fatalf("returned %d, %d in the pool, want none", e.Returned, len(bc.TransactionPool()))
+	}
+	if nonce := bc.NextNonce(alice.address); nonce != 1 {
+		t.Fatalf("next nonce %d, want 1", nonce)
+	}
+	// 承認状況は新しいブランチのブロックを指す
+	if ts := bc.TransactionStatus(tx.ID()); ts.Status != TRANSACTION_STATUS_CONFIRMED || ts.BlockHash != b1.Hash() {
+		t.Fatalf("status %+v, want confirmed in block %x", ts, b1.Hash())
+	}
+}
+
+// UTXOモデルでは取り消したブロックが消費した出力が戻る
+func TestReorganizeRestoresUTXOs(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestUTXOBlockchain(t, alice.address)
+	fork := append([]*Block{}, bc.chain...)
+	reward := bc.utxos.AddressUTXOs(alice.address)[0].OutPoint
+	tx := alice.spend(t, bob.address, 100, 10, 0, []OutPoint{reward}, MINIG_REWARD-110)
+	bc.connectTestBlock(mineTestBlock(bc, bc.chain, "miner", tx))
+
+	b1 := mineTestBlock(bc, fork, "other")
+	b2 := mineTestBlock(bc, append(fork, b1), "other")
+	bc.mux.Lock()
+	e := bc.reorganize(append(fork, b1, b2))
+	bc.mux.Unlock()
+	if bc.utxos.Get(reward) == nil {
+		t.Fatal("output spent in the disconnected block was not restored")
+	}
+	if len(bc.utxos.AddressUTXOs(bob.address)) != 0 {
+		t.Fatal("output created in the disconnected block remains")
+	}
+	if e.Returned != 1 {
+		t.Fatalf("returned %d, want 1", e.Returned)
+	}
+}
@@ -0,0 +1,336 @@
+package block
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	BLOCKS_FILE_NAME                   = "blocks.jsonl"
+	TRANSACTION_POOL_FILE_NAME         = "transaction_pool.json"
+	TRANSACTION_POOL_JOURNAL_FILE_NAME = "transaction_pool.journal"
+	// 追記した変更がこの大きさを超え、かつ保存済みの内容より大きくなったら1つのファイルにまとめ直す(byte)
+	TRANSACTION_POOL_JOURNAL_COMPACT_BYTES = 1 << 20
+)
+
+// ブロックチェーンの永続化を行うストレージ
+// Blockchainはこのインターフェースを通してのみディスクにアクセスする
+type Store interface {
+	// 保存済みのブロックを先頭から順に読み込む
+	LoadChain() ([]*Block, error)
+	// ブロックを末尾に追記する
+	AppendBlock(b *Block) error
+	// チェーン全体を置き換える(ResolveConflictsで他ノードのチェーンを採用した場合)
+	ReplaceChain(chain []*Block) error
+	// 未承認トランザクションを署名と公開鍵ごと読み込む(保存した内容に追記した変更を順に適用したもの)
+	LoadTransactionPool() ([]*TransactionRequest, error)
+	// 未承認トランザクションの現在の内容を保存する(追記した変更は不要になる)
+	SaveTransactionPool(pool []*TransactionRequest) error
+	// 未承認トランザクションの追加と削除を追記する
+	AppendTransactionPoolJournal(changes []*TransactionPoolChange) error
+}
+
+// 未承認トランザクションの1件の追加または削除
+type TransactionPoolChange struct {
+	TxID [32]byte
+	// 追加したトランザクション(取り除いた場合はnil)
+	Transaction *TransactionRequest
+}
+
+func (tc *TransactionPoolChange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		TxID        string              `json:"txid"`
+		Transaction *TransactionRequest `json:"transaction,omitempty"`
+	}{
+		TxID:        fmt.Sprintf("%x", tc.TxID),
+		Transaction: tc.Transaction,
+	})
+}
+
+func (tc *TransactionPoolChange) UnmarshalJSON(data []byte) error {
+	var v struct {
+		TxID        string              `json:"txid"`
+		Transaction *TransactionRequest `json:"transaction"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	txid, err := ParseHash(v.TxID)
+	if err != nil {
+		return fmt.Errorf("invalid txid %q", v.TxID)
+	}
+	tc.TxID = txid
+	tc.Transaction = v.Transaction
+	return nil
+}
+
+// 1行1ブロックのJSONを追記していくファイルストレージ
+type FileStore struct {
+	dir string
+	mux sync.Mutex
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (fs *FileStore) Dir() string {
+	return fs.dir
+}
+
+func (fs *FileStore) blocksPath() string {
+	return filepath.Join(fs.dir, BLOCKS_FILE_NAME)
+}
+
+func (fs *FileStore) LoadChain() ([]*Block, error) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	f, err := os.Open(fs.blocksPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	chain := make([]*Block, 0)
+	r := bufio.NewReader(f)
+	for lineNo := 1; ; lineNo++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// 改行で終わっていない最終行は書き込み途中でクラッシュしたものとして捨てる
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("WARN: discard incomplete block at line %d of %s", lineNo, fs.blocksPath())
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var b Block
+		if err := json.Unmarshal(line, &b); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", fs.blocksPath(), lineNo, err)
+		}
+		chain = append(chain, &b)
+	}
+	return chain, nil
+}
+
+func (fs *FileStore) AppendBlock(b *Block) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	m, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(fs.blocksPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(m, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+func (fs *FileStore) ReplaceChain(chain []*Block) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	var buf bytes.Buffer
+	for _, b := range chain {
+		m, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		buf.Write(m)
+		buf.WriteByte('\n')
+	}
+	return writeFileAtomic(fs.blocksPath(), buf.Bytes())
+}
+
+func (fs *FileStore) transactionPoolPath() string {
+	return filepath.Join(fs.dir, TRANSACTION_POOL_FILE_NAME)
+}
+
+func (fs *FileStore) transactionPoolJournalPath() string {
+	return filepath.Join(fs.dir, TRANSACTION_POOL_JOURNAL_FILE_NAME)
+}
+
+func (fs *FileStore) LoadTransactionPool() ([]*TransactionRequest, error) {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	return fs.loadTransactionPool()
+}
+
+// 保存した内容に追記した変更を順に適用する
+// fs.muxを保持した状態で呼び出す
+func (fs *FileStore) loadTransactionPool() ([]*TransactionRequest, error) {
+	var pool []*TransactionRequest
+	m, err := os.ReadFile(fs.transactionPoolPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(m, &pool); err != nil {
+			return nil, fmt.Errorf("%s: %v", fs.transactionPoolPath(), err)
+		}
+	}
+
+	f, err := os.Open(fs.transactionPoolJournalPath())
+	if os.IsNotExist(err) {
+		return pool, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// 削除の記録と照らし合わせるため、保存した内容のtxidを求める(形式が不正なものは復元時の検証で破棄される)
+	index := make(map[[32]byte]int)
+	for i, tr := range pool {
+		if !tr.Validate() {
+			continue
+		}
+		if t, err := tr.Transaction(); err == nil {
+			index[t.ID()] = i
+		}
+	}
+	r := bufio.NewReader(f)
+	for lineNo := 1; ; lineNo++ {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// 改行で終わっていない最終行は書き込み途中でクラッシュしたものとして捨てる
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("WARN: discard incomplete change at line %d of %s", lineNo, fs.transactionPoolJournalPath())
+			}
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var tc TransactionPoolChange
+		if err := json.Unmarshal(line, &tc); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", fs.transactionPoolJournalPath(), lineNo, err)
+		}
+		i, ok := index[tc.TxID]
+		switch {
+		case tc.Transaction == nil && ok:
+			pool[i] = nil
+			delete(index, tc.TxID)
+		case tc.Transaction != nil && !ok:
+			index[tc.TxID] = len(pool)
+			pool = append(pool, tc.Transaction)
+		}
+	}
+	restored := make([]*TransactionRequest, 0, len(index))
+	for _, tr := range pool {
+		if tr != nil {
+			restored = append(restored, tr)
+		}
+	}
+	return restored, nil
+}
+
+// 内容を保存してから追記した変更を消す
+// 間でクラッシュした場合は古い変更が重ねて適用されるが、復元時の検証で無効なものは破棄される
+func (fs *FileStore) SaveTransactionPool(pool []*TransactionRequest) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+	return fs.saveTransactionPool(pool)
+}
+
+// fs.muxを保持した状態で呼び出す
+func (fs *FileStore) saveTransactionPool(pool []*TransactionRequest) error {
+	m, err := json.Marshal(pool)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(fs.transactionPoolPath(), m); err != nil {
+		return err
+	}
+	if err := os.Remove(fs.transactionPoolJournalPath()); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 1行1件の変更を追記する
+// 追記した分が大きくなったら、適用した内容を保存し直して追記した変更を消す
+func (fs *FileStore) AppendTransactionPoolJournal(changes []*TransactionPoolChange) error {
+	fs.mux.Lock()
+	defer fs.mux.Unlock()
+
+	var buf bytes.Buffer
+	for _, tc := range changes {
+		m, err := json.Marshal(tc)
+		if err != nil {
+			return err
+		}
+		buf.Write(m)
+		buf.WriteByte('\n')
+	}
+	f, err := os.OpenFile(fs.transactionPoolJournalPath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	journal, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	var saved int64
+	if st, err := os.Stat(fs.transactionPoolPath()); err == nil {
+		saved = st.Size()
+	}
+	if journal.Size() <= TRANSACTION_POOL_JOURNAL_COMPACT_BYTES || journal.Size() <= saved {
+		return nil
+	}
+	pool, err := fs.loadTransactionPool()
+	if err != nil {
+		return err
+	}
+	return fs.saveTransactionPool(pool)
+}
+
+// 一時ファイルに書き込んでからrenameすることで、途中でクラッシュしても元のファイルを壊さない
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,182 @@
+package block
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func testChain() []*Block {
+	genesis := NewBlock(*NewBlockHeader(0, [32]byte{}, 0, nil), nil)
+	transactions := []*Transaction{NewTransaction("alice", "bob", 1, 0, 0)}
+	b := NewBlock(*NewBlockHeader(1, genesis.Hash(), MINIG_INITIAL_BITS, transactions), transactions)
+	return []*Block{genesis, b}
+}
+
+// 追記したブロックと置き換えたチェーンを先頭から順に読み込める
+func TestFileStoreChain(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := testChain()
+	for _, b := range chain {
+		if err := store.AppendBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loaded, err := store.LoadChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != len(chain) {
+		t.Fatalf("loaded %d blocks, want %d", len(loaded), len(chain))
+	}
+	for i := range chain {
+		if loaded[i].Hash() != chain[i].Hash() {
+			t.Fatalf("block %d is %x, want %x", i, loaded[i].Hash(), chain[i].Hash())
+		}
+	}
+
+	if err := store.ReplaceChain(chain[:1]); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err = store.LoadChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 1 || loaded[0].Hash() != chain[0].Hash() {
+		t.Fatalf("loaded %d blocks after replacing the chain, want the genesis block only", len(loaded))
+	}
+}
+
+// 書き込み途中でクラッシュした最終行は捨てる
+func TestFileStoreDiscardsIncompleteBlock(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := testChain()
+	if err := store.AppendBlock(chain[0]); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(store.blocksPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"nonce":1,`)
+	f.Close()
+
+	loaded, err := store.LoadChain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded) != 1 {
+		t.Fatalf("loaded %d blocks, want 1", len(loaded))
+	}
+}
+
+// 保存した未承認トランザクションをそのまま読み込める
+func TestFileStoreTransactionPool(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := store.LoadTransactionPool()
+	if err != nil || pool != nil {
+		t.Fatalf("loaded %v, %v before saving, want nothing", pool, err)
+	}
+	saved := []*TransactionRequest{NewTransaction("alice", "bob", 1, 0, 0).Request(), NewTransaction("bob", "carol", 2, 0, 0).Request()}
+	if err := store.SaveTransactionPool(saved); err != nil {
+		t.Fatal(err)
+	}
+	pool, err = store.LoadTransactionPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pool) != len(saved) {
+		t.Fatalf("loaded %d transactions, want %d", len(pool), len(saved))
+	}
+	for i := range saved {
+		if *pool[i].SenderBlockchainAddress != *saved[i].SenderBlockchainAddress || *pool[i].Value != *saved[i].Value {
+			t.Fatalf("transaction %d is %+v, want %+v", i, pool[i], saved[i])
+		}
+	}
+}
+
+// 起動時に再検証し、無効になったトランザクションはファイルからも取り除く
+func TestNewBlockchainEvictsInvalidTransactions(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 署名のないトランザクション
+	if err := store.SaveTransactionPool([]*TransactionRequest{NewTransaction("alice", "bob", 1, 0, 0).Request()}); err != nil {
+		t.Fatal(err)
+	}
+	bc, err := NewBlockchain("miner", 0, store, time.Minute, LEDGER_ACCOUNT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bc.TransactionPool()) != 0 {
+		t.Fatalf("restored %d transactions, want 0", len(bc.TransactionPool()))
+	}
+	pool, err := store.LoadTransactionPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pool) != 0 {
+		t.Fatalf("%d transactions left in the file, want 0", len(pool))
+	}
+}
+
+// 保存した内容に、追記した追加と削除が順に適用される
+func TestTransactionPoolJournal(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed := alice.transfer(t, bob.address, 1, 1, 0)
+	added := alice.transfer(t, bob.address, 1, 1, 1)
+	if err := store.SaveTransactionPool([]*TransactionRequest{removed.Request()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AppendTransactionPoolJournal([]*TransactionPoolChange{
+		{TxID: added.ID(), Transaction: added.Request()},
+		{TxID: removed.ID()},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// 書き込み途中でクラッシュした最終行は捨てる
+	f, err := os.OpenFile(store.transactionPoolJournalPath(), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"txid":"00`)
+	f.Close()
+
+	pool, err := store.LoadTransactionPool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pool) != 1 {
+		t.Fatalf("loaded %d transactions, want 1", len(pool))
+	}
+	tx, err := pool[0].Transaction()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.ID() != added.ID() {
+		t.Fatalf("loaded %x, want %x", tx.ID(), added.ID())
+	}
+
+	// 保存し直すと追記した変更は消える
+	if err := store.SaveTransactionPool(pool); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(store.transactionPoolJournalPath()); !os.IsNotExist(err) {
+		t.Fatalf("journal remains after saving: %v", err)
+	}
+}
@@ -0,0 +1,487 @@
+package block
+
+import (
+	"block/p2p"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	BLOCKS_PAGE_DEFAULT_LIMIT  = 20
+	BLOCKS_PAGE_MAX_LIMIT      = 100
+	HEADERS_PAGE_DEFAULT_LIMIT = 500
+	HEADERS_PAGE_MAX_LIMIT     = 2000
+	// 同期で1回のリクエストで取得するブロック数
+	SYNC_BLOCKS_PER_REQUEST = 50
+	SYNC_REQUEST_TIMEOUT    = 30 * time.Second
+	// ブロックロケーターに末尾から1つずつ含めるブロック数(それより前は間隔を倍にしていく)
+	LOCATOR_DENSE_BLOCKS = 10
+	// 受け付けるブロックロケーターのハッシュ数の上限
+	MAX_LOCATOR_HASHES = 64
+	// ヘッダーの取得中にノードが別のチェーンに付け替えた場合に、分岐点からやり直す回数の上限
+	SYNC_MAX_HEADER_RESTARTS = 3
+)
+
+var (
+	errInvalidHeader = errors.New("invalid header")
+	// 取得中にノードのチェーンが変わり続けた(不正ではないため評価は下げない)
+	errPeerReorged = errors.New("peer switched chains during sync")
+)
+
+// 同期で他のノードに問い合わせる際のクライアント(応答しないノードで同期が止まらないようにする)
+var syncClient = &http.Client{Timeout: SYNC_REQUEST_TIMEOUT}
+
+// GET /blocks?from=&limit=のレスポンス
+type BlocksResponse struct {
+	// 採用中のチェーンの末尾の高さ
+	Height uint64   `json:"height"`
+	From   uint64   `json:"from"`
+	Blocks []*Block `json:"blocks"`
+}
+
+// GET /headers?from=&limit=とGET /headers?locator=&limit=のレスポンス
+type HeadersResponse struct {
+	Height uint64 `json:"height"`
+	// 先頭のヘッダーの高さ
+	From    uint64         `json:"from"`
+	Headers []*BlockHeader `json:"headers"`
+}
+
+// 採用中のチェーンの高さfromからlimit件のブロックと、末尾の高さ
+func (bc *Blockchain) Blocks(from uint64, limit int) ([]*Block, uint64) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	blocks := make([]*Block, 0, limit)
+	for h := from; h < uint64(len(bc.chain)) && len(blocks) < limit; h++ {
+		blocks = append(blocks, bc.chain[h])
+	}
+	return blocks, bc.LastBlock().header.height
+}
+
+// 採用中のチェーンの高さfromからlimit件のヘッダーと、末尾の高さ
+func (bc *Blockchain) Headers(from uint64, limit int) ([]*BlockHeader, uint64) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.headers(from, limit), bc.LastBlock().header.height
+}
+
+// bc.muxを保持した状態で呼び出す
+func (bc *Blockchain) headers(from uint64, limit int) []*BlockHeader {
+	headers := make([]*BlockHeader, 0, limit)
+	for h := from; h < uint64(len(bc.chain)) && len(headers) < limit; h++ {
+		headers = append(headers, &bc.chain[h].header)
+	}
+	return headers
+}
+
+// 同期するノードに自分のチェーンを伝えるブロックロケーター
+// 末尾からLOCATOR_DENSE_BLOCKS個は1つずつ、それより前は間隔を倍にしながら選び、最後にgenesisを含める
+// 受け取ったノードは採用中のチェーンにある最初のハッシュを分岐点とし、その次からヘッダーを返す
+func blockLocator(chain []*Block) [][32]byte {
+	locator := make([][32]byte, 0, LOCATOR_DENSE_BLOCKS+32)
+	step := 1
+	for i := len(chain) - 1; i > 0; i -= step {
+		locator = append(locator, chain[i].Hash())
+		if len(locator) >= LOCATOR_DENSE_BLOCKS {
+			step *= 2
+		}
+	}
+	if len(chain) > 0 {
+		locator = append(locator, chain[0].Hash())
+	}
+	return locator
+}
+
+// ロケーターのハッシュのうち採用中のチェーンにある最初のものの次から、limit件のヘッダー
+// どのハッシュもチェーンにない場合はgenesisから返す
+// 先頭のヘッダーの高さと、末尾の高さも返す
+func (bc *Blockchain) HeadersAfter(locator [][32]byte, limit int) ([]*BlockHeader, uint64, uint64) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	var from uint64 = 0
+	for _, hash := range locator {
+		n := bc.tree.node(hash)
+		if n == nil {
+			continue
+		}
+		if h := n.block.header.height; h < uint64(len(bc.chain)) && bc.chain[h].Hash() == hash {
+			from = h + 1
+			break
+		}
+	}
+	return bc.headers(from, limit), from, bc.LastBlock().header.height
+}
+
+// GET /headers?locator=のクエリの形式(ハッシュの16進数をカンマで区切る)
+func EncodeLocator(locator [][32]byte) string {
+	hashes := make([]string, len(locator))
+	for i, hash := range locator {
+		hashes[i] = fmt.Sprintf("%x", hash)
+	}
+	return strings.Join(hashes, ",")
+}
+
+func ParseLocator(s string) ([][32]byte, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) > MAX_LOCATOR_HASHES {
+		return nil, fmt.Errorf("locator has %d hashes (max %d)", len(parts), MAX_LOCATOR_HASHES)
+	}
+	locator := make([][32]byte, len(parts))
+	for i, part := range parts {
+		hash, err := ParseHash(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid locator hash %q", part)
+		}
+		locator[i] = hash
+	}
+	return locator, nil
+}
+
+// 同期の進捗
+type SyncProgress struct {
+	Syncing bool
+	// ヘッダーを採用したノードと、その末尾の高さ
+	Peer         string
+	TargetHeight uint64
+	// 検証済みのヘッダー数
+	Headers int
+	// 本体を取得したブロック数と、取得が必要なブロック数
+	Downloaded int
+	Total      int
+}
+
+func (sp *SyncProgress) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Syncing      bool   `json:"syncing"`
+		Peer         string `json:"peer"`
+		TargetHeight uint64 `json:"target_height"`
+		Headers      int    `json:"headers"`
+		Downloaded   int    `json:"blocks_downloaded"`
+		Total        int    `json:"blocks_total"`
+	}{
+		Syncing:      sp.Syncing,
+		Peer:         sp.Peer,
+		TargetHeight: sp.TargetHeight,
+		Headers:      sp.Headers,
+		Downloaded:   sp.Downloaded,
+		Total:        sp.Total,
+	})
+}
+
+// 実行中または最後に実行した同期の進捗
+func (bc *Blockchain) SyncProgress() SyncProgress {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	return bc.syncProgress
+}
+
+func (bc *Blockchain) updateSyncProgress(f func(sp *SyncProgress)) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	f(&bc.syncProgress)
+}
+
+func getJSON(endpoint string, v interface{}) error {
+	resp, err := syncClient.Get(endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: status %d", endpoint, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// ノードnのヘッダーを自分のチェーンとの分岐点からブロックロケーターで取得し、繋がりとProof of Workを検証する
+// genesisからnの末尾までのチェーンを返す(分岐点までは木にあるブロック、それより後はトランザクションを持たないブロック)
+// nが自分のチェーンより先に進んでいない場合は空を返す
+// 取得中にnが別のチェーンに付け替えた場合は、新しいページが繋がる位置からやり直す(nの不正とはしない)
+func (bc *Blockchain) downloadHeaders(n syncPeer) ([]*Block, error) {
+	bc.mux.Lock()
+	locator := blockLocator(bc.chain)
+	bc.mux.Unlock()
+	chain := make([]*Block, 0)
+	// chainのうちnから取得したヘッダーの位置
+	downloaded := make(map[[32]byte]int)
+	restarts := 0
+	pageLocator := locator
+	for {
+		page, err := n.getHeaders(pageLocator, HEADERS_PAGE_MAX_LIMIT)
+		if err != nil {
+			return nil, err
+		}
+		if len(page.Headers) > HEADERS_PAGE_MAX_LIMIT {
+			return nil, fmt.Errorf("%w: %d headers from %s (max %d)", errInvalidHeader, len(page.Headers), n, HEADERS_PAGE_MAX_LIMIT)
+		}
+		for i, h := range page.Headers {
+			if h == nil {
+				return nil, fmt.Errorf("%w: null header from %s", errInvalidHeader, n)
+			}
+			if i == 0 {
+				base, restarted, err := bc.headersBase(h, chain, downloaded)
+				if err != nil {
+					return nil, fmt.Errorf("%w %d from %s: %v", errInvalidHeader, h.height, n, err)
+				}
+				if restarted {
+					if restarts += 1; restarts > SYNC_MAX_HEADER_RESTARTS {
+						return nil, fmt.Errorf("%w: %s", errPeerReorged, n)
+					}
+					log.Printf("action=sync, stage=headers, peer=%s, status=restart, height=%d", n, h.height)
+				}
+				chain = base
+			}
+			b := NewBlock(*h, nil)
+			var err error
+			if len(chain) == 0 {
+				err = checkGenesis(b)
+			} else {
+				err = bc.checkHeader(h, chain)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%w %d from %s: %v", errInvalidHeader, len(chain), n, err)
+			}
+			downloaded[b.Hash()] = len(chain)
+			chain = append(chain, b)
+		}
+		if len(page.Headers) < HEADERS_PAGE_MAX_LIMIT {
+			return chain, nil
+		}
+		// 次のページは取得した末尾から(nが付け替えていた場合は元のロケーターで分岐点を探す)
+		last := chain[len(chain)-1].Hash()
+		pageLocator = append([][32]byte{last}, locator...)
+		if len(pageLocator) > MAX_LOCATOR_HASHES {
+			pageLocator = pageLocator[:MAX_LOCATOR_HASHES]
+		}
+	}
+}
+
+// ページの先頭のヘッダーhが繋がるチェーン(hの直前まで)
+// 取得済みのヘッダー、木にあるブロック、genesisの順に探し、取得済みのヘッダーの途中や木に繋がった場合はrestartedを返す
+// どこにも繋がらない場合は、ロケーターに従っていないためエラーとする
+func (bc *Blockchain) headersBase(h *BlockHeader, chain []*Block, downloaded map[[32]byte]int) ([]*Block, bool, error) {
+	if h.height == 0 {
+		restarted := len(chain) > 0
+		for hash := range downloaded {
+			delete(downloaded, hash)
+		}
+		return nil, restarted, nil
+	}
+	if i, ok := downloaded[h.previousHash]; ok {
+		if i+1 == len(chain) {
+			return chain, false, nil
+		}
+		for _, b := range chain[i+1:] {
+			delete(downloaded, b.Hash())
+		}
+		return chain[:i+1], true, nil
+	}
+	bc.mux.Lock()
+	parent := bc.tree.node(h.previousHash)
+	var base []*Block
+	if parent != nil {
+		base = parent.path()
+	}
+	bc.mux.Unlock()
+	if parent == nil {
+		return nil, false, fmt.Errorf("previous block %x is unknown", h.previousHash)
+	}
+	restarted := len(downloaded) > 0
+	for hash := range downloaded {
+		delete(downloaded, hash)
+	}
+	return base, restarted, nil
+}
+
+// headers[start:]の本体を複数のノードから並列に取得する
+// peersはヘッダーの末尾がheadersと一致したノードで、ノードごとにワーカーを立てる
+// ヘッダーと一致しないブロックを返したノードは取得中に付け替えたとみなし、評価は下げずにその分を他のノードが取得し直す
+// 先頭から連続して取得できたブロックを返す
+func (bc *Blockchain) downloadBodies(peers []syncPeer, headers []*Block, start int) []*Block {
+	type batch struct {
+		from  int
+		limit int
+	}
+	batches := make([]batch, 0)
+	for from := start; from < len(headers); from += SYNC_BLOCKS_PER_REQUEST {
+		limit := SYNC_BLOCKS_PER_REQUEST
+		if from+limit > len(headers) {
+			limit = len(headers) - from
+		}
+		batches = append(batches, batch{from, limit})
+	}
+	if len(batches) == 0 {
+		return nil
+	}
+	// 失敗したバッチを戻してもブロックしないよう、全バッチ分の容量を持たせる
+	jobs := make(chan batch, len(batches))
+	for _, j := range batches {
+		jobs <- j
+	}
+	bodies := make([]*Block, len(headers))
+	var mux sync.Mutex
+	pending := len(batches)
+	downloaded := 0
+
+	var wg sync.WaitGroup
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer syncPeer) {
+			defer wg.Done()
+			for j := range jobs {
+				blocks, err := peer.getBlocks(headers[j.from : j.from+j.limit])
+				if err != nil {
+					// このノードからの取得はやめ、残りのワーカーに任せる
+					log.Printf("ERROR: %v", err)
+					peer.failed()
+					jobs <- j
+					return
+				}
+				if len(blocks) > j.limit {
+					err = fmt.Errorf("%s returned %d blocks (expected %d)", peer, len(blocks), j.limit)
+				}
+				for i := 0; err == nil && i < len(blocks); i++ {
+					if blocks[i] == nil {
+						err = fmt.Errorf("%s: block %d is null", peer, j.from+i)
+					}
+				}
+				if err != nil {
+					log.Printf("ERROR: %v", err)
+					peer.misbehaving(p2p.PENALTY_UNEXPECTED_BLOCK, err.Error())
+					jobs <- j
+					return
+				}
+				// 先頭から一致した分を受け取り、残りは再び取得する(応答の大きさの上限で一部だけ返される場合もある)
+				matched := 0
+				for matched < len(blocks) && blocks[matched].Hash() == headers[j.from+matched].Hash() {
+					matched += 1
+				}
+				if matched == 0 {
+					log.Printf("action=sync, stage=blocks, peer=%s, status=switched_chain, from=%d", peer, j.from)
+					jobs <- j
+					return
+				}
+				mux.Lock()
+				copy(bodies[j.from:], blocks[:matched])
+				downloaded += matched
+				if matched < j.limit {
+					jobs <- batch{j.from + matched, j.limit - matched}
+				} else {
+					pending -= 1
+				}
+				done, remaining := downloaded, pending
+				if remaining == 0 {
+					close(jobs)
+				}
+				mux.Unlock()
+				bc.updateSyncProgress(func(sp *SyncProgress) { sp.Downloaded = done })
+				log.Printf("action=sync, stage=blocks, downloaded=%d/%d, peer=%s", done, len(headers)-start, peer)
+			}
+		}(peer)
+	}
+	wg.Wait()
+
+	blocks := make([]*Block, 0, len(headers)-start)
+	for _, b := range bodies[start:] {
+		if b == nil {
+			break
+		}
+		blocks = append(blocks, b)
+	}
+	return blocks
+}
+
+// ヘッダーを先に取得して累積の仕事量が最大のチェーンを選び、木にないブロックの本体だけを並列に取得する
+// 取得したブロックは木に追加して検証し、末尾が変わった場合はtrueを返す
+// 同期中に呼ばれた場合は何もしない
+func (bc *Blockchain) SyncBlocks() bool {
+	bc.mux.Lock()
+	if bc.syncProgress.Syncing {
+		bc.mux.Unlock()
+		return false
+	}
+	bc.syncProgress = SyncProgress{Syncing: true}
+	tip := bc.LastBlock().Hash()
+	maxWork := new(big.Int).Set(bc.tree.node(tip).work)
+	bc.mux.Unlock()
+	defer bc.updateSyncProgress(func(sp *SyncProgress) { sp.Syncing = false })
+
+	// ヘッダーの取得と検証はロックを保持せずに行う
+	var best []*Block
+	var bestPeer syncPeer
+	chains := make(map[syncPeer][]*Block)
+	for _, n := range bc.syncPeers() {
+		headers, err := bc.downloadHeaders(n)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			switch {
+			case errors.Is(err, errInvalidHeader):
+				n.misbehaving(p2p.PENALTY_INVALID_CHAIN, err.Error())
+			case errors.Is(err, errPeerReorged):
+			default:
+				n.failed()
+			}
+			continue
+		}
+		if len(headers) == 0 {
+			continue
+		}
+		chains[n] = headers
+		if work := ChainWork(headers); work.Cmp(maxWork) > 0 {
+			maxWork = work
+			best = headers
+			bestPeer = n
+		}
+	}
+	if best == nil {
+		log.Printf("action=sync, status=up_to_date")
+		return false
+	}
+
+	bc.mux.Lock()
+	// 既に木にあるブロックは取得しない
+	start := 0
+	for start < len(best) && bc.tree.node(best[start].Hash()) != nil {
+		start += 1
+	}
+	bc.syncProgress.Peer = bestPeer.String()
+	bc.syncProgress.TargetHeight = uint64(len(best) - 1)
+	bc.syncProgress.Headers = len(best)
+	bc.syncProgress.Total = len(best) - start
+	bc.mux.Unlock()
+	log.Printf("action=sync, stage=headers, peer=%s, height=%d, missing=%d", bestPeer, len(best)-1, len(best)-start)
+
+	// 本体は同じチェーンのヘッダーを返したノードからのみ取得する(別の分岐のノードは同じ高さに別のブロックを持つ)
+	tipHash := best[len(best)-1].Hash()
+	peers := make([]syncPeer, 0, len(chains))
+	for n, headers := range chains {
+		if len(headers) >= len(best) && headers[len(best)-1].Hash() == tipHash {
+			peers = append(peers, n)
+		}
+	}
+
+	blocks := bc.downloadBodies(peers, best, start)
+
+	bc.mux.Lock()
+	for _, b := range blocks {
+		if _, err := bc.addBlock(b); err != nil && !errors.Is(err, ErrDuplicateBlock) {
+			log.Printf("ERROR: %v", err)
+			break
+		}
+	}
+	e := bc.activateBestChain()
+	replaced := bc.LastBlock().Hash() != tip
+	bc.mux.Unlock()
+	if e != nil {
+		bc.emitReorg(e)
+	}
+	log.Printf("action=sync, status=done, downloaded=%d/%d, replaced=%t", len(blocks), len(best)-start, replaced)
+	return replaced
+}
@@ -0,0 +1,100 @@
+package block
+
+import (
+	"strings"
+	"testing"
+)
+
+// 末尾からLOCATOR_DENSE_BLOCKS個は連続し、それより前は間引きながら高さの降順に並び、最後はgenesis
+func TestBlockLocator(t *testing.T) {
+	genesis := NewBlock(*NewBlockHeader(0, (&BlockHeader{}).Hash(), 0, nil), nil)
+	chain := append([]*Block{genesis}, testBranch(genesis, 100, "miner")...)
+	locator := blockLocator(chain)
+	heights := make(map[[32]byte]int)
+	for i, b := range chain {
+		heights[b.Hash()] = i
+	}
+	for i := 0; i < LOCATOR_DENSE_BLOCKS; i++ {
+		if got := heights[locator[i]]; got != len(chain)-1-i {
+			t.Fatalf("locator[%d] is at height %d, want %d", i, got, len(chain)-1-i)
+		}
+	}
+	for i := 1; i < len(locator); i++ {
+		if heights[locator[i]] >= heights[locator[i-1]] {
+			t.Fatalf("locator[%d] at height %d is not below %d", i, heights[locator[i]], heights[locator[i-1]])
+		}
+	}
+	if locator[len(locator)-1] != genesis.Hash() {
+		t.Fatal("locator does not end with the genesis block")
+	}
+	if len(locator) >= MAX_LOCATOR_HASHES {
+		t.Fatalf("locator has %d hashes", len(locator))
+	}
+}
+
+// ロケーターのうち採用中のチェーンにある最初のハッシュの次から返し、分岐のハッシュは飛ばす
+func TestHeadersAfter(t *testing.T) {
+	bc := newTestBlockchain(t, "a", "b", "c")
+	side := mineTestBlock(bc, bc.chain[:2], "side")
+	bc.processTestBlock(t, side)
+
+	headers, from, height := bc.HeadersAfter([][32]byte{side.Hash(), bc.chain[1].Hash()}, 10)
+	if from != 2 || height != 3 || len(headers) != 2 || headers[0].Hash() != bc.chain[2].Hash() {
+		t.Fatalf("%d headers from %d (tip %d), want 2 from 2", len(headers), from, height)
+	}
+	if headers, from, _ := bc.HeadersAfter([][32]byte{{1}}, 1); from != 0 || len(headers) != 1 {
+		t.Fatalf("%d headers from %d for an unknown locator, want 1 from genesis", len(headers), from)
+	}
+}
+
+func TestParseLocator(t *testing.T) {
+	locator := [][32]byte{{1}, {2}}
+	parsed, err := ParseLocator(EncodeLocator(locator))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 2 || parsed[0] != locator[0] || parsed[1] != locator[1] {
+		t.Fatalf("parsed %x, want %x", parsed, locator)
+	}
+	if _, err := ParseLocator("zz"); err == nil {
+		t.Fatal("accepted an invalid hash")
+	}
+	long := strings.Repeat(EncodeLocator(locator[:1])+",", MAX_LOCATOR_HASHES) + EncodeLocator(locator[:1])
+	if _, err := ParseLocator(long); err == nil {
+		t.Fatal("accepted a locator over the limit")
+	}
+}
+
+// 取得済みのヘッダーの途中に繋がった場合はそこまで戻し、木のブロックに繋がった場合はその経路から続ける
+func TestHeadersBase(t *testing.T) {
+	bc := newTestBlockchain(t, "a", "b")
+	downloaded := make(map[[32]byte]int)
+	chain := append([]*Block{}, bc.chain...)
+	for i, b := range chain {
+		downloaded[b.Hash()] = i
+	}
+
+	next := mineTestBlock(bc, chain, "c")
+	base, restarted, err := bc.headersBase(&next.header, chain, downloaded)
+	if err != nil || restarted || len(base) != len(chain) {
+		t.Fatalf("base of %d blocks, restarted %v, %v, want the whole chain", len(base), restarted, err)
+	}
+
+	fork := mineTestBlock(bc, chain[:2], "fork")
+	base, restarted, err = bc.headersBase(&fork.header, chain, downloaded)
+	if err != nil || !restarted || len(base) != 2 {
+		t.Fatalf("base of %d blocks, restarted %v, %v, want 2 blocks after a restart", len(base), restarted, err)
+	}
+	if _, ok := downloaded[chain[2].Hash()]; ok {
+		t.Fatal("headers after the fork point are still marked downloaded")
+	}
+
+	base, _, err = bc.headersBase(&fork.header, nil, make(map[[32]byte]int))
+	if err != nil || len(base) != 2 || base[1].Hash() != chain[1].Hash() {
+		t.Fatalf("base of %d blocks, %v, want the path in the tree", len(base), err)
+	}
+	unknown := NewBlockHeader(5, [32]byte{1}, MINIG_INITIAL_BITS, nil)
+	if _, _, err := bc.headersBase(unknown, nil, make(map[[32]byte]int)); err == nil {
+		t.Fatal("accepted a header with an unknown parent")
+	}
+}
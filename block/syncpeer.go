@@ -0,0 +1,168 @@
+package block
+
+import (
+	"block/p2p"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// 同期でヘッダーとブロックを問い合わせるノード
+// TCPを使う場合は相互に認証したTLSの接続で問い合わせ、使わない場合のみHTTPで問い合わせる
+type syncPeer interface {
+	// ログに表示するノード
+	String() string
+	// ロケーターとの分岐点からのヘッダー
+	getHeaders(locator [][32]byte, limit int) (*HeadersResponse, error)
+	// headersのブロック(先頭から返せた分のみ返してもよい)
+	getBlocks(headers []*Block) ([]*Block, error)
+	getBlock(hash [32]byte) (*Block, error)
+	// 通信の失敗と、不正なデータを送ってきたことを記録する
+	failed()
+	misbehaving(penalty int, reason string)
+}
+
+// 同期で問い合わせるノード
+// TCPを使う場合は接続中のノード、使わない場合は近隣ノード
+func (bc *Blockchain) syncPeers() []syncPeer {
+	peers := make([]syncPeer, 0)
+	if bc.node != nil {
+		for _, c := range bc.node.Conns() {
+			peers = append(peers, &tcpPeer{bc: bc, conn: c})
+		}
+		return peers
+	}
+	for _, n := range bc.Neighbors() {
+		peers = append(peers, &httpPeer{bc: bc, address: n})
+	}
+	return peers
+}
+
+// HTTPで問い合わせるノード
+type httpPeer struct {
+	bc      *Blockchain
+	address string
+}
+
+func (p *httpPeer) String() string {
+	return p.address
+}
+
+func (p *httpPeer) getHeaders(locator [][32]byte, limit int) (*HeadersResponse, error) {
+	var page HeadersResponse
+	endpoint := fmt.Sprintf("http://%s/headers?locator=%s&limit=%d", p.address, EncodeLocator(locator), limit)
+	if err := getJSON(endpoint, &page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (p *httpPeer) getBlocks(headers []*Block) ([]*Block, error) {
+	var page BlocksResponse
+	endpoint := fmt.Sprintf("http://%s/blocks?from=%d&limit=%d", p.address, headers[0].header.height, len(headers))
+	if err := getJSON(endpoint, &page); err != nil {
+		return nil, err
+	}
+	return page.Blocks, nil
+}
+
+func (p *httpPeer) getBlock(hash [32]byte) (*Block, error) {
+	endpoint := fmt.Sprintf("http://%s/blocks/%x", p.address, hash)
+	resp, err := relayClient.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, endpoint)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: status %d", endpoint, resp.StatusCode)
+	}
+	var b Block
+	if err := json.NewDecoder(resp.Body).Decode(&b); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (p *httpPeer) failed() {
+	p.bc.peerFailed(p.address)
+}
+
+func (p *httpPeer) misbehaving(penalty int, reason string) {
+	p.bc.peerMisbehaving(p.address, penalty, reason)
+}
+
+// TCPの接続で問い合わせるノード
+type tcpPeer struct {
+	bc   *Blockchain
+	conn *p2p.Conn
+}
+
+func (p *tcpPeer) String() string {
+	return p.conn.String()
+}
+
+func (p *tcpPeer) getHeaders(locator [][32]byte, limit int) (*HeadersResponse, error) {
+	m, err := p2p.NewMessage(p2p.MSG_GETHEADERS, &p2p.GetHeadersPayload{Locator: EncodeLocator(locator), Limit: limit})
+	if err != nil {
+		return nil, err
+	}
+	reply, err := p.conn.Request(m, p2p.MSG_HEADERS)
+	if err != nil {
+		return nil, err
+	}
+	var page HeadersResponse
+	if err := reply.Decode(&page); err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (p *tcpPeer) getBlocks(headers []*Block) ([]*Block, error) {
+	hashes := make([][32]byte, len(headers))
+	for i, h := range headers {
+		hashes[i] = h.Hash()
+	}
+	return p.requestBlocks(hashes)
+}
+
+func (p *tcpPeer) getBlock(hash [32]byte) (*Block, error) {
+	blocks, err := p.requestBlocks([][32]byte{hash})
+	if err != nil {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		return nil, ErrBlockNotFound
+	}
+	return blocks[0], nil
+}
+
+// ハッシュを指定してブロックを要求する(相手が持っていないブロックは返されない)
+func (p *tcpPeer) requestBlocks(hashes [][32]byte) ([]*Block, error) {
+	items := make([]*p2p.InvItem, len(hashes))
+	for i, hash := range hashes {
+		items[i] = &p2p.InvItem{Type: p2p.INV_TYPE_BLOCK, Hash: hash}
+	}
+	m, err := p2p.NewMessage(p2p.MSG_GETBLOCKS, &p2p.InvPayload{Items: items})
+	if err != nil {
+		return nil, err
+	}
+	reply, err := p.conn.Request(m, p2p.MSG_BLOCKS)
+	if err != nil {
+		return nil, err
+	}
+	var page BlocksResponse
+	if err := reply.Decode(&page); err != nil {
+		return nil, err
+	}
+	return page.Blocks, nil
+}
+
+// TCPの接続は切れた時点で接続中のノードから外れるため、失敗は記録しない
+func (p *tcpPeer) failed() {}
+
+func (p *tcpPeer) misbehaving(penalty int, reason string) {
+	p.bc.node.Misbehaving(p.conn, penalty, reason)
+}
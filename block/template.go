@@ -0,0 +1,185 @@
+package block
+
+import (
+	"block/utils"
+	"log"
+	"math"
+	"time"
+)
+
+// マイニングするブロックに含めるトランザクションを選ぶ
+// 手数料率(手数料/サイズ)の高い順に、送信者ごとのnonceの順序を守りながらMAX_BLOCK_SIZEまで詰め込み、
+// 最後に手数料を加えた自分へのリワードを追加する
+// 選んだ順に残高を更新し、残高が足りなくなるトランザクションは含めない
+func (bc *Blockchain) BlockTemplate() []*Transaction {
+	// 送信者ごとにnonce順のキューを作る(mempoolはnonce順に追加されている)
+	queues := make(map[string][]*Transaction)
+	senders := make([]string, 0)
+	for _, t := range bc.CopyTransactionPool() {
+		if _, ok := queues[t.senderBlockchainAddress]; !ok {
+			senders = append(senders, t.senderBlockchainAddress)
+		}
+		queues[t.senderBlockchainAddress] = append(queues[t.senderBlockchainAddress], t)
+	}
+
+	// 検証と同じくブロック内の前のトランザクションで受け取った分は使える
+	balances := make(map[string]uint64)
+	balance := func(address string) uint64 {
+		if v, ok := balances[address]; ok {
+			return v
+		}
+		return bc.calculateTotalAmount(address)
+	}
+
+	limit := MAX_BLOCK_SIZE - bc.rewardTransactionSize()
+	size := 0
+	var fees uint64 = 0
+	transactions := make([]*Transaction, 0)
+	for {
+		// 各送信者の先頭のトランザクションの中から手数料率が最も高いものを選ぶ
+		var best string
+		bestRate := -1.0
+		for _, sender := range senders {
+			q := queues[sender]
+			if len(q) == 0 {
+				continue
+			}
+			if rate := q[0].FeeRate(); rate > bestRate {
+				best = sender
+				bestRate = rate
+			}
+		}
+		if bestRate < 0 {
+			break
+		}
+		t := queues[best][0]
+		// 受け付けた後に他のノードのチェーンを採用し、入力が消費済みになったトランザクションは含めない
+		if bc.utxos != nil && !bc.utxos.hasInputs(t) {
+			queues[best] = nil
+			continue
+		}
+		if size+t.Size() > limit {
+			// nonceを飛ばすことはできないため、この送信者の残りは次のブロックに回す
+			queues[best] = nil
+			continue
+		}
+		cost, ok := t.Cost()
+		if !ok || balance(best) < cost {
+			// 他のノードのチェーンを採用して残高が減った場合など(nonceが続かないため残りも含めない)
+			log.Printf("action=template_skip_overdraw, txid=%x, sender=%s, skipped=%d", t.ID(), best, len(queues[best]))
+			queues[best] = nil
+			continue
+		}
+		received, ok := utils.AddAmount(balance(t.recipientBlockchainAddress), t.value)
+		totalFee, feeOk := utils.AddAmount(fees, t.fee)
+		_, rewardOk := utils.AddAmount(MINIG_REWARD, totalFee)
+		if !ok || !feeOk || !rewardOk {
+			// 受信者の残高やリワードが溢れるブロックは検証で拒否される
+			log.Printf("action=template_skip_overflow, txid=%x, sender=%s, skipped=%d", t.ID(), best, len(queues[best]))
+			queues[best] = nil
+			continue
+		}
+		balances[best] = balance(best) - cost
+		balances[t.recipientBlockchainAddress] = received
+		size += t.Size()
+		fees = totalFee
+		transactions = append(transactions, t)
+		queues[best] = queues[best][1:]
+	}
+
+	// リワードのnonceには掘るブロックの高さを使う
+	return append(transactions,
+		NewTransaction(MINIG_SENDER, bc.blockchainAddress, MINIG_REWARD+fees, 0, uint64(len(bc.chain))))
+}
+
+// 1byteあたりの手数料
+func (t *Transaction) FeeRate() float64 {
+	return float64(t.fee) / float64(t.Size())
+}
+
+// ブロック内のトランザクションの合計サイズ
+func transactionsSize(transactions []*Transaction) int {
+	size := 0
+	for _, t := range transactions {
+		size += t.Size()
+	}
+	return size
+}
+
+// リワードのトランザクションのために確保しておくサイズ(金額とnonceが最大の場合)
+func (bc *Blockchain) rewardTransactionSize() int {
+	return NewTransaction(MINIG_SENDER, bc.blockchainAddress, math.MaxUint64, 0, math.MaxUint64).Size()
+}
+
+// 接続したブロックに含まれるトランザクションをmempoolから取り除き、影響を受ける送信者の分だけを新しい末尾に対して再検証する
+// 影響を受けるのは、ブロックに含まれた送金の送信者(nonceと残高が変わる)と、ブロックが消費した出力を使っていた送信者
+// 受け取っただけのアドレスは残高が増えるだけなので再検証しない
+// bc.muxを保持した状態で呼び出す
+func (bc *Blockchain) removeMinedTransactions(transactions []*Transaction) {
+	bc.mempool.expire(time.Now())
+	affected := make([]string, 0)
+	seen := make(map[string]bool)
+	mark := func(sender string) {
+		if !seen[sender] {
+			seen[sender] = true
+			affected = append(affected, sender)
+		}
+	}
+	for _, t := range transactions {
+		if t.senderBlockchainAddress == MINIG_SENDER {
+			continue
+		}
+		if e := bc.mempool.entry(t.ID()); e != nil {
+			bc.mempool.remove([]*MempoolEntry{e})
+		}
+		mark(t.senderBlockchainAddress)
+		for _, in := range t.inputs {
+			if e := bc.mempool.spender(in.prevOut); e != nil {
+				mark(e.tx.senderBlockchainAddress)
+			}
+		}
+	}
+	dropped := 0
+	for _, sender := range affected {
+		dropped += bc.revalidateSender(sender)
+	}
+	if dropped > 0 {
+		log.Printf("action=revalidate_pool, senders=%d, remaining=%d, dropped=%d", len(affected), bc.mempool.Len(), dropped)
+	}
+}
+
+// 送信者の未承認トランザクションをnonce順に受け付け直し、破棄した数を返す
+// 受け付けられなかったものより大きいnonceのものは繋がらなくなるため一緒に破棄する
+// bc.muxを保持した状態で呼び出す
+func (bc *Blockchain) revalidateSender(sender string) int {
+	queue := bc.mempool.senderEntries(sender)
+	bc.mempool.remove(queue)
+	for i, e := range queue {
+		if err := bc.addTransaction(e.tx, e.source, e.arrival); err != nil {
+			return len(queue) - i
+		}
+	}
+	return 0
+}
+
+// candidatesを順に受け付け直してmempoolを作り直す(excludeに含まれるものは除く)
+// 既にmempoolにあったものは到着時刻と送ってきたノードを引き継ぐ
+// それぞれを受け付けたかどうかを返す
+// bc.muxを保持した状態で呼び出す
+func (bc *Blockchain) readmitTransactions(candidates []*Transaction, exclude map[[32]byte]bool) []bool {
+	old := bc.mempool
+	bc.mempool = old.empty()
+	now := time.Now()
+	accepted := make([]bool, len(candidates))
+	for i, t := range candidates {
+		if exclude[t.ID()] {
+			continue
+		}
+		source, arrival := "", now
+		if e := old.entry(t.ID()); e != nil {
+			source, arrival = e.source, e.arrival
+		}
+		accepted[i] = bc.addTransaction(t, source, arrival) == nil
+	}
+	return accepted
+}
@@ -0,0 +1,128 @@
+package block
+
+import (
+	"testing"
+	"time"
+)
+
+// 手数料率の高い順に選び、同じ送信者の中ではnonceの順序を守る
+func TestBlockTemplateOrdersByFeeRate(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address, bob.address)
+	a0 := alice.transfer(t, "carol", 1, 1, 0)
+	a1 := alice.transfer(t, "carol", 1, 100, 1)
+	b0 := bob.transfer(t, "carol", 1, 50, 0)
+	for _, tx := range []*Transaction{a0, a1, b0} {
+		if err := bc.addTestTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	transactions := bc.BlockTemplate()
+	want := []*Transaction{b0, a0, a1}
+	if len(transactions) != len(want)+1 {
+		t.Fatalf("template has %d transactions, want %d", len(transactions), len(want)+1)
+	}
+	for i, tx := range want {
+		got := transactions[i]
+		if got.senderBlockchainAddress != tx.senderBlockchainAddress || got.nonce != tx.nonce {
+			t.Fatalf("transaction %d is nonce %d of %s, want nonce %d of %s", i, got.nonce, got.senderBlockchainAddress, tx.nonce, tx.senderBlockchainAddress)
+		}
+	}
+	reward := transactions[len(transactions)-1]
+	if reward.senderBlockchainAddress != MINIG_SENDER || reward.value != MINIG_REWARD+151 {
+		t.Fatalf("reward is %d from %s, want %d", reward.value, reward.senderBlockchainAddress, MINIG_REWARD+151)
+	}
+}
+
+// ブロックを繋げるとブロックに含まれたトランザクションだけがmempoolから取り除かれる
+func TestConnectBlockRemovesMinedTransactions(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address, bob.address)
+	a0 := alice.transfer(t, "carol", 1, 0, 0)
+	a1 := alice.transfer(t, "carol", 1, 0, 1)
+	b0 := bob.transfer(t, "carol", 1, 0, 0)
+	for _, tx := range []*Transaction{a0, a1, b0} {
+		if err := bc.addTestTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bc.connectTestBlock(mineTestBlock(bc, bc.chain, "miner", a0))
+	if bc.mempool.Len() != 2 || bc.mempool.entry(a0.ID()) != nil || bc.mempool.entry(a1.ID()) == nil || bc.mempool.entry(b0.ID()) == nil {
+		t.Fatalf("pool has %d transactions after connecting a block, want a1 and b0", bc.mempool.Len())
+	}
+}
+
+// 他のノードが承認したnonceや、足りなくなった残高のトランザクションは破棄する
+func TestConnectBlockRevalidatesPool(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address, bob.address)
+	a0 := alice.transfer(t, "carol", 1, 0, 0)
+	b0 := bob.transfer(t, "carol", MINIG_REWARD, 0, 0)
+	for _, tx := range []*Transaction{a0, b0} {
+		if err := bc.addTestTransaction(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 同じnonceで別の宛先に送ったものと、bobの残高を使い切るものが承認された
+	other := alice.transfer(t, "dave", 1, 0, 0)
+	spent := bob.transfer(t, "dave", 1, 0, 0)
+	bc.connectTestBlock(mineTestBlock(bc, bc.chain, "miner", other, spent))
+	if pool := bc.TransactionPool(); len(pool) != 0 {
+		t.Fatalf("pool has %d invalidated transactions", len(pool))
+	}
+	if err := bc.addTestTransaction(alice.transfer(t, "carol", 1, 0, 1)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// 残高が足りなくなったトランザクションと、nonceが続く同じ送信者のものは含めない
+func TestBlockTemplateSkipsOverdraw(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address, bob.address)
+	// 受け付けた後に他のノードのチェーンを採用して残高が減った場合を、検証を通さずに加えて再現する
+	a0 := alice.transfer(t, "carol", MINIG_REWARD, 0, 0)
+	a1 := alice.transfer(t, "carol", 1, 0, 1)
+	for _, tx := range []*Transaction{a0, a1} {
+		if _, err := bc.mempool.add(newMempoolEntry(tx, "", time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bc.index.balances[alice.address] = MINIG_REWARD - 1
+	b0 := bob.transfer(t, "carol", 1, 0, 0)
+	if err := bc.addTestTransaction(b0); err != nil {
+		t.Fatal(err)
+	}
+
+	transactions := bc.BlockTemplate()
+	if len(transactions) != 2 || transactions[0].ID() != b0.ID() {
+		t.Fatalf("template has %d transactions, want b0 and the reward", len(transactions))
+	}
+}
+
+// ブロック内の前のトランザクションで受け取った分は続くトランザクションで使える
+func TestBlockTemplateSpendsReceivedInBlock(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	a0 := alice.transfer(t, bob.address, MINIG_REWARD, 0, 0)
+	b0 := bob.transfer(t, "carol", MINIG_REWARD, 0, 0)
+	for _, tx := range []*Transaction{a0, b0} {
+		if _, err := bc.mempool.add(newMempoolEntry(tx, "", time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	transactions := bc.BlockTemplate()
+	if len(transactions) != 3 || transactions[0].ID() != a0.ID() || transactions[1].ID() != b0.ID() {
+		t.Fatalf("template has %d transactions, want a0, b0 and the reward", len(transactions))
+	}
+	if err := bc.VerifyChain(append(append([]*Block{}, bc.chain...), solveTestBlock(bc, bc.chain, transactions))); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,493 @@
+package block
+
+import (
+	"block/p2p"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"time"
+)
+
+const (
+	// 親が未知のまま保持するブロックの上限(超えた場合は古いものから捨てる)
+	MAX_ORPHAN_BLOCKS = 100
+	// 親が届かないまま保持するorphanの期限
+	ORPHAN_EXPIRY = 20 * time.Minute
+	// 採用中の末尾からこの数より深いブロックは確定したものとし、そこから分岐した枝は捨てて受け付けない
+	FINALITY_DEPTH = 100
+
+	// 現在採用しているチェーンの末尾
+	CHAIN_TIP_STATUS_ACTIVE = "active"
+	// チェーン全体の検証を通ったことがある分岐
+	CHAIN_TIP_STATUS_VALID_FORK = "valid-fork"
+	// ヘッダーとProof of Workのみ確認済みで、トランザクションは未検証の分岐
+	CHAIN_TIP_STATUS_VALID_HEADERS = "valid-headers"
+	// 不正なブロックを含む分岐
+	CHAIN_TIP_STATUS_INVALID = "invalid"
+)
+
+var (
+	ErrDuplicateBlock = errors.New("block already known")
+	ErrOrphanBlock    = errors.New("previous block is unknown")
+	ErrInvalidBlock   = errors.New("invalid block")
+	ErrStaleBlock     = errors.New("block forks below the finality depth")
+)
+
+// ブロックの木の節点
+type blockNode struct {
+	block    *Block
+	hash     [32]byte
+	parent   *blockNode
+	children []*blockNode
+	// genesisからこのブロックまでの累積の仕事量(genesis自身の仕事量は0)
+	work *big.Int
+	// チェーン全体の検証を通ったか、不正と判定されたか(不正なブロックの子孫も不正とする)
+	verified bool
+	invalid  bool
+}
+
+// 高さheightの祖先(heightがこのブロックの高さ以上ならこのブロック自身)
+func (n *blockNode) ancestor(height uint64) *blockNode {
+	p := n
+	for p != nil && p.block.header.height > height {
+		p = p.parent
+	}
+	return p
+}
+
+// genesisからこのブロックまでのブロック
+func (n *blockNode) path() []*Block {
+	chain := make([]*Block, n.block.header.height+1)
+	for p := n; p != nil; p = p.parent {
+		chain[p.block.header.height] = p.block
+	}
+	return chain
+}
+
+// 受け取ったブロックをハッシュで引けるように保持する木
+// 採用中のチェーン(bc.chain)以外の分岐と、親が未知のブロック(orphan)も保持する
+// genesisは各ノードで独自に作成されるため、高さ0のブロックごとに根を持つ森になる
+// Blockchainのbc.muxで保護される(分岐はメモリ上のみで、再起動すると採用中のチェーンだけが残る)
+type BlockTree struct {
+	nodes map[[32]byte]*blockNode
+	// 高さ0の節点
+	roots map[[32]byte]*blockNode
+	// 子を持たない節点
+	tips    map[[32]byte]*blockNode
+	orphans map[[32]byte]*orphanBlock
+	// 受け取った順のorphanのハッシュ
+	orphanOrder [][32]byte
+	// 他のノードに問い合わせ中のブロックのハッシュ
+	requested map[[32]byte]bool
+	// 分岐を捨て終えた高さの次(この高さ未満は採用中のチェーンのブロックのみが残っている)
+	pruned uint64
+}
+
+type orphanBlock struct {
+	block    *Block
+	received time.Time
+}
+
+func NewBlockTree() *BlockTree {
+	return &BlockTree{
+		nodes:     make(map[[32]byte]*blockNode),
+		roots:     make(map[[32]byte]*blockNode),
+		tips:      make(map[[32]byte]*blockNode),
+		orphans:   make(map[[32]byte]*orphanBlock),
+		requested: make(map[[32]byte]bool),
+	}
+}
+
+// 検証済みのチェーンから木を作る
+func NewBlockTreeFromChain(chain []*Block) *BlockTree {
+	tree := NewBlockTree()
+	for _, b := range chain {
+		tree.add(b).verified = true
+	}
+	tree.pruneStale(chain)
+	return tree
+}
+
+func (tree *BlockTree) node(hash [32]byte) *blockNode {
+	return tree.nodes[hash]
+}
+
+// 親が木にあるブロック(またはgenesis)を追加する
+func (tree *BlockTree) add(b *Block) *blockNode {
+	n := &blockNode{block: b, hash: b.Hash(), work: BlockWork(b)}
+	if b.header.height > 0 {
+		n.parent = tree.nodes[b.header.previousHash]
+	}
+	if n.parent != nil {
+		n.work.Add(n.work, n.parent.work)
+		n.invalid = n.parent.invalid
+		n.parent.children = append(n.parent.children, n)
+		delete(tree.tips, n.parent.hash)
+	} else {
+		tree.roots[n.hash] = n
+	}
+	tree.nodes[n.hash] = n
+	tree.tips[n.hash] = n
+	return n
+}
+
+// nとその子孫を木から取り除く(親の子のリストは呼び出し側が更新する)
+func (tree *BlockTree) remove(n *blockNode) {
+	stack := []*blockNode{n}
+	for len(stack) > 0 {
+		p := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		delete(tree.nodes, p.hash)
+		delete(tree.roots, p.hash)
+		delete(tree.tips, p.hash)
+		stack = append(stack, p.children...)
+	}
+}
+
+// 採用中のchainでFINALITY_DEPTHより深い高さから分岐した枝を捨てる
+// 確定した高さごとに一度だけ兄弟の節点を調べるため、末尾が伸びるたびに呼び出しても木全体は走査しない
+func (tree *BlockTree) pruneStale(chain []*Block) {
+	if len(chain) <= FINALITY_DEPTH {
+		return
+	}
+	finalized := uint64(len(chain) - 1 - FINALITY_DEPTH)
+	for ; tree.pruned <= finalized; tree.pruned++ {
+		keep := tree.nodes[chain[tree.pruned].Hash()]
+		if keep == nil {
+			continue
+		}
+		siblings := make([]*blockNode, 0)
+		if keep.parent == nil {
+			for _, root := range tree.roots {
+				siblings = append(siblings, root)
+			}
+		} else {
+			siblings = keep.parent.children
+			keep.parent.children = []*blockNode{keep}
+		}
+		for _, n := range siblings {
+			if n != keep {
+				tree.remove(n)
+			}
+		}
+	}
+}
+
+// 確定した高さ以下で採用中のチェーンにないブロック
+func (tree *BlockTree) isStale(b *Block, chain []*Block) bool {
+	height := b.header.height
+	if height >= tree.pruned {
+		return false
+	}
+	return height >= uint64(len(chain)) || chain[height].Hash() != b.Hash()
+}
+
+func (tree *BlockTree) addOrphan(b *Block) {
+	hash := b.Hash()
+	if _, ok := tree.orphans[hash]; ok {
+		return
+	}
+	tree.expireOrphans(time.Now())
+	if len(tree.orphanOrder) >= MAX_ORPHAN_BLOCKS {
+		delete(tree.orphans, tree.orphanOrder[0])
+		tree.orphanOrder = tree.orphanOrder[1:]
+	}
+	tree.orphans[hash] = &orphanBlock{block: b, received: time.Now()}
+	tree.orphanOrder = append(tree.orphanOrder, hash)
+}
+
+// ORPHAN_EXPIRYより前に受け取ったorphanを捨てる
+func (tree *BlockTree) expireOrphans(now time.Time) {
+	expired := 0
+	for _, hash := range tree.orphanOrder {
+		if now.Sub(tree.orphans[hash].received) < ORPHAN_EXPIRY {
+			break
+		}
+		delete(tree.orphans, hash)
+		expired += 1
+	}
+	tree.orphanOrder = tree.orphanOrder[expired:]
+}
+
+// parentを親とするorphanを取り出す
+func (tree *BlockTree) takeOrphans(parent [32]byte) []*Block {
+	children := make([]*Block, 0)
+	order := make([][32]byte, 0, len(tree.orphanOrder))
+	for _, hash := range tree.orphanOrder {
+		b := tree.orphans[hash].block
+		if b.header.previousHash == parent {
+			children = append(children, b)
+			delete(tree.orphans, hash)
+			continue
+		}
+		order = append(order, hash)
+	}
+	tree.orphanOrder = order
+	return children
+}
+
+// badとその子孫を不正とする
+func (tree *BlockTree) markInvalid(bad *blockNode) {
+	stack := []*blockNode{bad}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		n.invalid = true
+		stack = append(stack, n.children...)
+	}
+}
+
+// 不正でない末尾のうち累積の仕事量が最大のもの(同じ場合はcurrentを優先する)
+func (tree *BlockTree) bestTip(current *blockNode) *blockNode {
+	best := current
+	for _, n := range tree.tips {
+		if n.invalid {
+			continue
+		}
+		if best == nil || best.invalid || n.work.Cmp(best.work) > 0 {
+			best = n
+		}
+	}
+	return best
+}
+
+// ブロックを木に追加し、親が未知の場合はorphanとして保持して他のノードに親を問い合わせる
+// ヘッダーとProof of Workまで検証し、トランザクションはチェーンとして採用する際に検証する
+// 木に追加したブロックを返す(bと、bに繋がったorphan)
+// bc.muxを保持した状態で呼び出す
+func (bc *Blockchain) addBlock(b *Block) ([]*Block, error) {
+	hash := b.Hash()
+	if bc.tree.node(hash) != nil {
+		return nil, ErrDuplicateBlock
+	}
+	if bc.tree.isStale(b, bc.chain) {
+		return nil, fmt.Errorf("%w: height %d", ErrStaleBlock, b.header.height)
+	}
+	if b.header.height == 0 {
+		if err := checkGenesis(b); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+		}
+	} else {
+		parent := bc.tree.node(b.header.previousHash)
+		if parent == nil {
+			bc.tree.addOrphan(b)
+			if !bc.tree.requested[b.header.previousHash] {
+				bc.tree.requested[b.header.previousHash] = true
+				go bc.requestBlock(b.header.previousHash)
+			}
+			return nil, ErrOrphanBlock
+		}
+		if parent.invalid {
+			return nil, fmt.Errorf("%w: previous block %x is invalid", ErrInvalidBlock, parent.hash)
+		}
+		// 難易度の調整区間の先頭が必要な場合のみ親から祖先を辿る
+		ancestor := func(height int) *Block {
+			return parent.ancestor(uint64(height)).block
+		}
+		if err := bc.checkBlockAfter(b, parent.block, ancestor); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBlock, err)
+		}
+	}
+	bc.tree.add(b)
+	log.Printf("action=add_block, height=%d, hash=%x", b.header.height, hash)
+
+	// このブロックを待っていたorphanを繋げる
+	added := []*Block{b}
+	for _, orphan := range bc.tree.takeOrphans(hash) {
+		connected, err := bc.addBlock(orphan)
+		if err != nil {
+			log.Printf("ERROR: orphan %x: %v", orphan.Hash(), err)
+			continue
+		}
+		added = append(added, connected...)
+	}
+	return added, nil
+}
+
+// 累積の仕事量が最大の分岐を検証し、採用中のチェーンより大きければ付け替える
+// 検証に失敗した分岐は不正として、次に仕事量の大きい分岐を試す
+// 末尾が伸びただけの場合はブロックを追加し、reorgが起きた場合のみその内容を返す
+// bc.muxを保持した状態で呼び出す
+func (bc *Blockchain) activateBestChain() *ReorgEvent {
+	current := bc.tree.node(bc.LastBlock().Hash())
+	for {
+		best := bc.tree.bestTip(current)
+		if best == current || best.work.Cmp(current.work) <= 0 {
+			return nil
+		}
+		chain := best.path()
+		fork := forkPoint(bc.chain, chain)
+		var index int
+		var err error
+		if fork == len(bc.chain)-1 {
+			// 末尾が伸びるだけの場合は、新しいブロックのみを現在の状態に対して検証する
+			nonces, balances := bc.index.state()
+			var utxos *UTXOSet
+			if bc.utxos != nil {
+				utxos = bc.utxos.clone()
+			}
+			index, err = bc.verifyBlocks(chain, fork+1, nonces, balances, utxos)
+		} else {
+			index, err = bc.verifyChain(chain)
+		}
+		if err != nil {
+			log.Printf("ERROR: branch %x rejected: %v", best.hash, err)
+			if index < 0 {
+				index = 0
+			}
+			bc.tree.markInvalid(bc.tree.node(chain[index].Hash()))
+			continue
+		}
+		for p := best; p != nil && !p.verified; p = p.parent {
+			p.verified = true
+		}
+		if fork == len(bc.chain)-1 {
+			for _, b := range chain[fork+1:] {
+				bc.connectBlock(b)
+			}
+			return nil
+		}
+		return bc.reorganize(chain)
+	}
+}
+
+// 他のノードから受け取ったブロックを追加し、最善のチェーンに付け替える
+// 木に追加されたブロック(bと、bに繋がったorphan)のうち不正と判定されなかったものを返す
+// 付け替えの検証でブロックが不正と判定された場合もErrInvalidBlockを返す
+func (bc *Blockchain) ProcessBlock(b *Block) ([]*Block, error) {
+	bc.mux.Lock()
+	added, err := bc.addBlock(b)
+	var e *ReorgEvent
+	connected := make([]*Block, 0, len(added))
+	if err == nil {
+		e = bc.activateBestChain()
+		for _, a := range added {
+			if !bc.tree.node(a.Hash()).invalid {
+				connected = append(connected, a)
+			}
+		}
+		if bc.tree.node(b.Hash()).invalid {
+			err = ErrInvalidBlock
+		}
+	}
+	bc.mux.Unlock()
+	if e != nil {
+		bc.emitReorg(e)
+	}
+	return connected, err
+}
+
+// hashのブロックを他のノードから取得して追加する
+// 取得したブロックもorphanであれば、addBlockがさらにその親を問い合わせる
+// TCPを使う場合は認証した接続中のノードにのみ問い合わせる
+func (bc *Blockchain) requestBlock(hash [32]byte) {
+	defer func() {
+		bc.mux.Lock()
+		delete(bc.tree.requested, hash)
+		bc.mux.Unlock()
+	}()
+	for _, n := range bc.syncPeers() {
+		b, err := n.getBlock(hash)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			if !errors.Is(err, ErrBlockNotFound) {
+				n.failed()
+			}
+			continue
+		}
+		if b == nil || b.Hash() != hash {
+			n.misbehaving(p2p.PENALTY_UNEXPECTED_BLOCK, "block does not match the requested hash")
+			continue
+		}
+		log.Printf("action=request_block, hash=%x, from=%s", hash, n)
+		connected, err := bc.ProcessBlock(b)
+		if err != nil && !errors.Is(err, ErrOrphanBlock) {
+			log.Printf("ERROR: %v", err)
+		}
+		// 取得したブロックと、それに繋がったorphanを他のノードに送る
+		for _, c := range connected {
+			bc.announceBlock(c)
+		}
+		return
+	}
+}
+
+// 採用中のチェーン以外の分岐も含めてハッシュからブロックを探す
+func (bc *Blockchain) Block(hash [32]byte) (*Block, error) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	n := bc.tree.node(hash)
+	if n == nil {
+		return nil, ErrBlockNotFound
+	}
+	return n.block, nil
+}
+
+// 競合している分岐の末尾
+type ChainTip struct {
+	Hash   [32]byte
+	Height uint64
+	Work   *big.Int
+	// 採用中のチェーンから分岐したブロックの数(採用中の末尾は0)
+	BranchLength int
+	Status       string
+}
+
+func (ct *ChainTip) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Hash         string `json:"hash"`
+		Height       uint64 `json:"height"`
+		Work         string `json:"work"`
+		BranchLength int    `json:"branch_length"`
+		Status       string `json:"status"`
+	}{
+		Hash:         fmt.Sprintf("%x", ct.Hash),
+		Height:       ct.Height,
+		Work:         ct.Work.String(),
+		BranchLength: ct.BranchLength,
+		Status:       ct.Status,
+	})
+}
+
+// 木にある分岐の末尾(高さの降順)
+func (bc *Blockchain) ChainTips() []*ChainTip {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	active := bc.tree.node(bc.LastBlock().Hash())
+	nodes := []*blockNode{active}
+	for _, n := range bc.tree.tips {
+		if n != active {
+			nodes = append(nodes, n)
+		}
+	}
+	tips := make([]*ChainTip, 0, len(nodes))
+	for _, n := range nodes {
+		ct := &ChainTip{Hash: n.hash, Height: n.block.header.height, Work: new(big.Int).Set(n.work)}
+		// 採用中のチェーンに含まれる祖先までの距離
+		for p := n; p != nil; p = p.parent {
+			h := p.block.header.height
+			if h < uint64(len(bc.chain)) && bc.chain[h].Hash() == p.hash {
+				break
+			}
+			ct.BranchLength += 1
+		}
+		switch {
+		case n == active:
+			ct.Status = CHAIN_TIP_STATUS_ACTIVE
+		case n.invalid:
+			ct.Status = CHAIN_TIP_STATUS_INVALID
+		case n.verified:
+			ct.Status = CHAIN_TIP_STATUS_VALID_FORK
+		default:
+			ct.Status = CHAIN_TIP_STATUS_VALID_HEADERS
+		}
+		tips = append(tips, ct)
+	}
+	sort.SliceStable(tips, func(i, j int) bool {
+		return tips[i].Height > tips[j].Height
+	})
+	return tips
+}
@@ -0,0 +1,199 @@
+package block
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func (bc *Blockchain) processTestBlock(t *testing.T, b *Block) {
+	t.Helper()
+	if _, err := bc.ProcessBlock(b); err != nil {
+		t.Fatalf("block %d: %v", b.header.height, err)
+	}
+}
+
+// Proof of Workを満たさないchainの続き(木の操作のみを確かめる)
+func testBranch(parent *Block, length int, miner string) []*Block {
+	branch := make([]*Block, 0, length)
+	for len(branch) < length {
+		transactions := []*Transaction{NewTransaction(MINIG_SENDER, miner, MINIG_REWARD, 0, parent.header.height+1)}
+		b := NewBlock(*NewBlockHeader(parent.header.height+1, parent.Hash(), MINIG_INITIAL_BITS, transactions), transactions)
+		branch = append(branch, b)
+		parent = b
+	}
+	return branch
+}
+
+func TestActivateBestChainExtendsTip(t *testing.T) {
+	bc := newTestBlockchain(t)
+	b := mineTestBlock(bc, bc.chain, "miner")
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	if _, err := bc.addBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	if e := bc.activateBestChain(); e != nil {
+		t.Fatalf("extending the tip caused a reorg: %+v", e)
+	}
+	if bc.LastBlock() != b {
+		t.Fatalf("tip is at height %d, want %d", bc.LastBlock().header.height, b.header.height)
+	}
+	if !bc.tree.node(b.Hash()).verified {
+		t.Fatal("connected block is not marked verified")
+	}
+}
+
+// 仕事量が同じ分岐には付け替えない
+func TestActivateBestChainKeepsCurrentOnTie(t *testing.T) {
+	bc := newTestBlockchain(t)
+	genesis := bc.chain[:1]
+	a := mineTestBlock(bc, genesis, "a")
+	b := mineTestBlock(bc, genesis, "b")
+	bc.processTestBlock(t, a)
+	bc.processTestBlock(t, b)
+	if bc.LastBlock() != a {
+		t.Fatal("switched to a branch with the same work")
+	}
+}
+
+// 仕事量の大きい分岐でも、トランザクションが不正なら不正として現在のチェーンに留まる
+// 不正なブロックの子孫は、先に木にあったものも後から届いたものも不正とする
+func TestActivateBestChainRejectsInvalidBranch(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	fork := append([]*Block{}, bc.chain...)
+	tip := mineTestBlock(bc, bc.chain, "miner")
+	bc.processTestBlock(t, tip)
+
+	bad := mineTestBlock(bc, fork, "miner", alice.transfer(t, bob.address, MINIG_REWARD, 1, 0))
+	child := mineTestBlock(bc, append(fork, bad), "miner")
+	grandchild := mineTestBlock(bc, append(fork, bad, child), "miner")
+	bc.processTestBlock(t, bad)
+	if _, err := bc.ProcessBlock(child); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("error %v, want %v", err, ErrInvalidBlock)
+	}
+	if bc.LastBlock() != tip {
+		t.Fatal("switched to an invalid branch")
+	}
+	if !bc.tree.node(bad.Hash()).invalid || !bc.tree.node(child.Hash()).invalid {
+		t.Fatal("invalid branch is not marked invalid")
+	}
+	if _, err := bc.ProcessBlock(grandchild); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("error %v, want %v", err, ErrInvalidBlock)
+	}
+}
+
+// 親より先に届いたブロックはorphanとして保持し、親が届いたら繋げて両方を中継の対象として返す
+func TestProcessBlockConnectsOrphans(t *testing.T) {
+	bc := newTestBlockchain(t)
+	parent := mineTestBlock(bc, bc.chain, "miner")
+	child := mineTestBlock(bc, append(append([]*Block{}, bc.chain...), parent), "miner")
+	if connected, err := bc.ProcessBlock(child); !errors.Is(err, ErrOrphanBlock) || len(connected) != 0 {
+		t.Fatalf("error %v with %d connected blocks, want %v", err, len(connected), ErrOrphanBlock)
+	}
+	connected, err := bc.ProcessBlock(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(connected) != 2 || connected[0] != parent || connected[1] != child {
+		t.Fatalf("%d connected blocks, want the parent and the orphan", len(connected))
+	}
+	if bc.LastBlock() != child {
+		t.Fatal("orphan was not connected after its parent")
+	}
+	if len(bc.tree.orphans) != 0 {
+		t.Fatalf("%d orphans left, want 0", len(bc.tree.orphans))
+	}
+	// 既知のブロックは中継しない
+	if connected, err := bc.ProcessBlock(parent); !errors.Is(err, ErrDuplicateBlock) || len(connected) != 0 {
+		t.Fatalf("error %v with %d connected blocks, want %v", err, len(connected), ErrDuplicateBlock)
+	}
+}
+
+func TestBlockTreeExpiresOrphans(t *testing.T) {
+	tree := NewBlockTree()
+	genesis := NewBlock(*NewBlockHeader(0, (&BlockHeader{}).Hash(), 0, nil), nil)
+	branch := testBranch(genesis, 2, "miner")
+	tree.addOrphan(branch[1])
+	tree.orphans[branch[1].Hash()].received = time.Now().Add(-ORPHAN_EXPIRY)
+	tree.addOrphan(branch[0])
+	if _, ok := tree.orphans[branch[1].Hash()]; ok {
+		t.Fatal("expired orphan was kept")
+	}
+	if len(tree.orphans) != 1 || len(tree.orphanOrder) != 1 {
+		t.Fatalf("%d orphans, want 1", len(tree.orphans))
+	}
+}
+
+// FINALITY_DEPTHより深い高さから分岐した枝は捨て、その高さのブロックも受け付けない
+func TestBlockTreePrunesStaleBranches(t *testing.T) {
+	genesis := NewBlock(*NewBlockHeader(0, (&BlockHeader{}).Hash(), 0, nil), nil)
+	chain := append([]*Block{genesis}, testBranch(genesis, FINALITY_DEPTH+2, "miner")...)
+	tree := NewBlockTree()
+	for _, b := range chain {
+		tree.add(b)
+	}
+	stale := testBranch(chain[1], 3, "stale")
+	recent := testBranch(chain[50], 1, "recent")
+	for _, b := range append(stale, recent...) {
+		tree.add(b)
+	}
+
+	tree.pruneStale(chain)
+	for _, b := range stale {
+		if tree.node(b.Hash()) != nil {
+			t.Fatalf("stale block at height %d was kept", b.header.height)
+		}
+	}
+	if tree.node(recent[0].Hash()) == nil {
+		t.Fatal("branch above the finality depth was pruned")
+	}
+	for _, b := range chain {
+		if tree.node(b.Hash()) == nil {
+			t.Fatalf("block %d of the chain was pruned", b.header.height)
+		}
+	}
+	if len(tree.tips) != 2 {
+		t.Fatalf("%d tips, want 2", len(tree.tips))
+	}
+	if !tree.isStale(stale[0], chain) || tree.isStale(chain[2], chain) || tree.isStale(stale[1], chain) {
+		t.Fatal("blocks below the finality depth are not classified as stale")
+	}
+}
+
+// 木の節点から祖先を辿った難易度は、チェーン全体から求めたものと一致する
+func TestNextBitsFromTree(t *testing.T) {
+	bc := newTestBlockchain(t)
+	chain := testChainWithInterval(time.Second)
+	tree := NewBlockTree()
+	for _, b := range chain {
+		tree.add(b)
+	}
+	for _, length := range []int{len(chain), len(chain) - 1} {
+		n := tree.node(chain[length-1].Hash())
+		got := bc.nextBits(length, n.block, func(height int) *Block {
+			return n.ancestor(uint64(height)).block
+		})
+		if want := bc.NextBits(chain[:length]); got != want {
+			t.Fatalf("bits %08x at height %d, want %08x", got, length, want)
+		}
+	}
+}
+
+// 採用中のチェーン以外の分岐にあるブロックの包含証明は返さない
+func TestTransactionProofRejectsSideBranch(t *testing.T) {
+	bc := newTestBlockchain(t)
+	genesis := bc.chain[:1]
+	a := mineTestBlock(bc, genesis, "a")
+	b := mineTestBlock(bc, genesis, "b")
+	bc.processTestBlock(t, a)
+	bc.processTestBlock(t, b)
+	if _, err := bc.TransactionProof(b.Hash(), b.transactions[0].ID()); !errors.Is(err, ErrBlockNotFound) {
+		t.Fatalf("error %v, want %v", err, ErrBlockNotFound)
+	}
+	if _, err := bc.TransactionProof(a.Hash(), a.transactions[0].ID()); err != nil {
+		t.Fatal(err)
+	}
+}
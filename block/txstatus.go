@@ -0,0 +1,116 @@
+package block
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	TRANSACTION_STATUS_PENDING   = "pending"
+	TRANSACTION_STATUS_CONFIRMED = "confirmed"
+	TRANSACTION_STATUS_UNKNOWN   = "unknown"
+)
+
+// トランザクションの承認状況
+type TransactionStatus struct {
+	TxID   [32]byte
+	Status string
+	// 以下は承認済みの場合のみ
+	BlockHash [32]byte
+	Height    uint64
+	// 含まれたブロック自身を1とした、その上に積まれたブロックの数
+	Confirmations uint64
+}
+
+// 承認済みのトランザクションを含むブロック
+type txLocation struct {
+	blockHash [32]byte
+	height    uint64
+}
+
+// 現在のチェーンに含まれるトランザクションのtxidからブロックを引く索引
+// ブロックを繋げる時と外す時に更新するため、承認状況の問い合わせでチェーンを走査する必要がない
+// Blockchainのbc.muxで保護される
+type TxIndex struct {
+	locations map[[32]byte]txLocation
+}
+
+func NewTxIndex() *TxIndex {
+	return &TxIndex{locations: make(map[[32]byte]txLocation)}
+}
+
+func (idx *TxIndex) connectBlock(b *Block) {
+	loc := txLocation{blockHash: b.Hash(), height: b.header.height}
+	for _, t := range b.transactions {
+		idx.locations[t.ID()] = loc
+	}
+}
+
+// チェーンの末尾から外したブロックのトランザクションを取り除く
+func (idx *TxIndex) disconnectBlock(b *Block) {
+	blockHash := b.Hash()
+	for _, t := range b.transactions {
+		id := t.ID()
+		if loc, ok := idx.locations[id]; ok && loc.blockHash == blockHash {
+			delete(idx.locations, id)
+		}
+	}
+}
+
+// oldからnewにチェーンを置き換えた場合、分岐点より後のブロックだけを付け替える
+func (idx *TxIndex) replaceChain(old []*Block, new []*Block) {
+	fork := 0
+	for fork < len(old) && fork < len(new) && old[fork].Hash() == new[fork].Hash() {
+		fork += 1
+	}
+	for i := len(old) - 1; i >= fork; i-- {
+		idx.disconnectBlock(old[i])
+	}
+	for _, b := range new[fork:] {
+		idx.connectBlock(b)
+	}
+}
+
+func (idx *TxIndex) lookup(txid [32]byte) (txLocation, bool) {
+	loc, ok := idx.locations[txid]
+	return loc, ok
+}
+
+// txidのトランザクションが未承認か、どのブロックで承認されたかを返す
+func (bc *Blockchain) TransactionStatus(txid [32]byte) *TransactionStatus {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	ts := &TransactionStatus{TxID: txid, Status: TRANSACTION_STATUS_UNKNOWN}
+	if loc, ok := bc.txIndex.lookup(txid); ok {
+		ts.Status = TRANSACTION_STATUS_CONFIRMED
+		ts.BlockHash = loc.blockHash
+		ts.Height = loc.height
+		ts.Confirmations = uint64(len(bc.chain)) - loc.height
+		return ts
+	}
+	if bc.mempool.Transaction(txid) != nil {
+		ts.Status = TRANSACTION_STATUS_PENDING
+		return ts
+	}
+	return ts
+}
+
+func (ts *TransactionStatus) MarshalJSON() ([]byte, error) {
+	v := struct {
+		TxID          string  `json:"txid"`
+		Status        string  `json:"status"`
+		BlockHash     *string `json:"block_hash,omitempty"`
+		Height        *uint64 `json:"height,omitempty"`
+		Confirmations *uint64 `json:"confirmations,omitempty"`
+	}{
+		TxID:   fmt.Sprintf("%x", ts.TxID),
+		Status: ts.Status,
+	}
+	if ts.Status == TRANSACTION_STATUS_CONFIRMED {
+		blockHash := fmt.Sprintf("%x", ts.BlockHash)
+		v.BlockHash = &blockHash
+		v.Height = &ts.Height
+		v.Confirmations = &ts.Confirmations
+	}
+	return json.Marshal(v)
+}
@@ -0,0 +1,65 @@
+package block
+
+import (
+	"testing"
+)
+
+func TestTransactionStatus(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	tx := alice.transfer(t, bob.address, 1, 0, 0)
+	if ts := bc.TransactionStatus(tx.ID()); ts.Status != TRANSACTION_STATUS_UNKNOWN {
+		t.Fatalf("status %s, want %s", ts.Status, TRANSACTION_STATUS_UNKNOWN)
+	}
+	if err := bc.addTestTransaction(tx); err != nil {
+		t.Fatal(err)
+	}
+	if ts := bc.TransactionStatus(tx.ID()); ts.Status != TRANSACTION_STATUS_PENDING {
+		t.Fatalf("status %s, want %s", ts.Status, TRANSACTION_STATUS_PENDING)
+	}
+
+	b := mineTestBlock(bc, bc.chain, bob.address, bc.CopyTransactionPool()...)
+	bc.connectTestBlock(b)
+	next := mineTestBlock(bc, bc.chain, bob.address)
+	bc.connectTestBlock(next)
+	ts := bc.TransactionStatus(tx.ID())
+	if ts.Status != TRANSACTION_STATUS_CONFIRMED || ts.BlockHash != b.Hash() || ts.Height != b.header.height {
+		t.Fatalf("status %+v, want confirmed in block %x", ts, b.Hash())
+	}
+	if ts.Confirmations != 2 {
+		t.Fatalf("%d confirmations, want 2", ts.Confirmations)
+	}
+}
+
+// チェーンを置き換えると、外したブロックのトランザクションは索引から消え、新しいブロックの位置に変わる
+func TestTxIndexReplaceChain(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestBlockchain(t, alice.address)
+	tx := alice.transfer(t, bob.address, 1, 0, 0)
+	base := bc.chain
+
+	withTx := append(append([]*Block{}, base...), mineTestBlock(bc, base, bob.address, tx))
+	without := append(append([]*Block{}, base...), mineTestBlock(bc, base, alice.address))
+	idx := NewTxIndex()
+	idx.replaceChain(nil, withTx)
+	if loc, ok := idx.lookup(tx.ID()); !ok || loc.blockHash != withTx[len(withTx)-1].Hash() {
+		t.Fatal("transaction is not indexed in its block")
+	}
+
+	idx.replaceChain(withTx, without)
+	if _, ok := idx.lookup(tx.ID()); ok {
+		t.Fatal("transaction in a disconnected block is still indexed")
+	}
+	// 共通部分のブロックは残る
+	if _, ok := idx.lookup(base[len(base)-1].transactions[0].ID()); !ok {
+		t.Fatal("transaction before the fork point was removed")
+	}
+
+	moved := append(append([]*Block{}, without...), mineTestBlock(bc, without, bob.address, tx))
+	idx.replaceChain(without, moved)
+	if loc, ok := idx.lookup(tx.ID()); !ok || loc.height != uint64(len(moved)-1) {
+		t.Fatal("transaction is not indexed at its new height")
+	}
+}
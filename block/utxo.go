@@ -0,0 +1,383 @@
+package block
+
+import (
+	"block/utils"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+const (
+	// 送信者ごとの残高で送金額を管理する(デフォルト)
+	LEDGER_ACCOUNT = "account"
+	// トランザクションが未使用の出力(UTXO)を入力として消費し、新しい出力を作る
+	LEDGER_UTXO = "utxo"
+)
+
+var (
+	ErrUnknownLedger   = errors.New("unknown ledger model")
+	ErrLedgerMismatch  = errors.New("transaction does not match the ledger model")
+	ErrMissingOutput   = errors.New("input refers to a missing or spent output")
+	ErrDoubleSpend     = errors.New("output is already spent")
+	ErrInputOwner      = errors.New("input is not owned by the sender")
+	ErrInvalidOutputs  = errors.New("invalid transaction outputs")
+	ErrInputsMismatch  = errors.New("inputs do not match outputs and fee")
+	ErrInvalidInputSig = errors.New("invalid input signature")
+)
+
+// 出力の参照(どのトランザクションの何番目の出力か)
+type OutPoint struct {
+	TxID  [32]byte
+	Index uint32
+}
+
+func (op OutPoint) String() string {
+	return fmt.Sprintf("%x:%d", op.TxID, op.Index)
+}
+
+// 消費する出力と、その出力の所有者(送信者)による署名
+type TxInput struct {
+	prevOut   OutPoint
+	signature *utils.Signature
+}
+
+func NewTxInput(prevOut OutPoint, signature *utils.Signature) *TxInput {
+	return &TxInput{prevOut, signature}
+}
+
+func (in *TxInput) PrevOut() OutPoint {
+	return in.prevOut
+}
+
+type TxOutput struct {
+	address string
+	value   uint64
+}
+
+func NewTxOutput(address string, value uint64) *TxOutput {
+	return &TxOutput{address, value}
+}
+
+func (out *TxOutput) Address() string {
+	return out.address
+}
+
+func (out *TxOutput) Value() uint64 {
+	return out.value
+}
+
+// UTXOモデルのトランザクションの新規作成
+// prevOutsは送信者の未使用の出力で、送金額と手数料を引いた残りはおつりとして送信者への出力になる
+// 各入力の署名は作成後にInputSigningBytesに対して行う
+func NewUTXOTransaction(sender string, recipient string, value uint64, fee uint64, nonce uint64, prevOuts []OutPoint, change uint64) *Transaction {
+	t := NewTransaction(sender, recipient, value, fee, nonce)
+	for _, op := range prevOuts {
+		t.inputs = append(t.inputs, NewTxInput(op, nil))
+	}
+	t.outputs = append(t.outputs, NewTxOutput(recipient, value))
+	if change > 0 {
+		t.outputs = append(t.outputs, NewTxOutput(sender, change))
+	}
+	return t
+}
+
+// 入力を持つ(UTXOモデルの)トランザクションか
+func (t *Transaction) IsUTXO() bool {
+	return len(t.inputs) > 0
+}
+
+func (t *Transaction) Inputs() []*TxInput {
+	return t.inputs
+}
+
+// トランザクションが作る出力
+// 出力を明示しないトランザクション(マイニングの報酬)は受信者への送金額を唯一の出力とする
+func (t *Transaction) Outputs() []*TxOutput {
+	if len(t.outputs) > 0 {
+		return t.outputs
+	}
+	return []*TxOutput{NewTxOutput(t.recipientBlockchainAddress, t.value)}
+}
+
+// i番目の入力の署名の対象となるバイト列
+// 入力の署名を除くトランザクション全体に入力の番号を加え、署名を他の入力に流用できないようにする
+func (t *Transaction) InputSigningBytes(i int) []byte {
+	e := t.encodeSigningFields()
+	e.writeUint32(uint32(i))
+	return e.bytes()
+}
+
+func (t *Transaction) verifyInputSignature(i int, publicKey *ecdsa.PublicKey) bool {
+	s := t.inputs[i].signature
+	if publicKey == nil || s == nil {
+		return false
+	}
+	h := sha256.Sum256(t.InputSigningBytes(i))
+	return ecdsa.Verify(publicKey, h[:], s.R, s.S)
+}
+
+// 未使用の出力と、それを作ったブロックの高さ
+type UTXO struct {
+	OutPoint OutPoint
+	Output   *TxOutput
+	Height   uint64
+}
+
+func (u *UTXO) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		TxID    string `json:"txid"`
+		Index   uint32 `json:"index"`
+		Address string `json:"address"`
+		Value   string `json:"value"`
+		Height  uint64 `json:"height"`
+	}{
+		TxID:    fmt.Sprintf("%x", u.OutPoint.TxID),
+		Index:   u.OutPoint.Index,
+		Address: u.Output.address,
+		Value:   utils.FormatAmount(u.Output.value),
+		Height:  u.Height,
+	})
+}
+
+func (u *UTXO) UnmarshalJSON(data []byte) error {
+	var v struct {
+		TxID    string `json:"txid"`
+		Index   uint32 `json:"index"`
+		Address string `json:"address"`
+		Value   string `json:"value"`
+		Height  uint64 `json:"height"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	txid, err := ParseHash(v.TxID)
+	if err != nil {
+		return fmt.Errorf("invalid txid %q", v.TxID)
+	}
+	value, err := utils.ParseAmount(v.Value)
+	if err != nil {
+		return err
+	}
+	u.OutPoint = OutPoint{txid, v.Index}
+	u.Output = NewTxOutput(v.Address, value)
+	u.Height = v.Height
+	return nil
+}
+
+// 未使用の出力の集合
+// ブロックの追加(ConnectBlock)と取り消し(DisconnectBlock)で差分だけ更新する
+// Blockchainのbc.muxで保護される
+type UTXOSet struct {
+	utxos     map[OutPoint]*UTXO
+	byAddress map[string]map[OutPoint]bool
+	// ブロックごとに消費した出力(取り消し時に復元する)
+	undo map[[32]byte][]*UTXO
+}
+
+func NewUTXOSet() *UTXOSet {
+	return &UTXOSet{
+		utxos:     make(map[OutPoint]*UTXO),
+		byAddress: make(map[string]map[OutPoint]bool),
+		undo:      make(map[[32]byte][]*UTXO),
+	}
+}
+
+func NewUTXOSetFromChain(chain []*Block) *UTXOSet {
+	s := NewUTXOSet()
+	for _, b := range chain {
+		s.ConnectBlock(b)
+	}
+	return s
+}
+
+// 取り消しの情報を除いた複製(チェーンの続きを検証する際の初期状態)
+func (s *UTXOSet) clone() *UTXOSet {
+	c := NewUTXOSet()
+	for _, u := range s.utxos {
+		c.add(u)
+	}
+	return c
+}
+
+func (s *UTXOSet) Get(op OutPoint) *UTXO {
+	return s.utxos[op]
+}
+
+func (s *UTXOSet) add(u *UTXO) {
+	s.utxos[u.OutPoint] = u
+	ops, ok := s.byAddress[u.Output.address]
+	if !ok {
+		ops = make(map[OutPoint]bool)
+		s.byAddress[u.Output.address] = ops
+	}
+	ops[u.OutPoint] = true
+}
+
+func (s *UTXOSet) remove(op OutPoint) *UTXO {
+	u, ok := s.utxos[op]
+	if !ok {
+		return nil
+	}
+	delete(s.utxos, op)
+	if ops := s.byAddress[u.Output.address]; ops != nil {
+		delete(ops, op)
+		if len(ops) == 0 {
+			delete(s.byAddress, u.Output.address)
+		}
+	}
+	return u
+}
+
+// トランザクションの入力を消費して出力を追加し、消費した出力を返す
+func (s *UTXOSet) connectTransaction(t *Transaction, height uint64) []*UTXO {
+	spent := make([]*UTXO, 0, len(t.inputs))
+	for _, in := range t.inputs {
+		if u := s.remove(in.prevOut); u != nil {
+			spent = append(spent, u)
+		}
+	}
+	id := t.ID()
+	for i, out := range t.Outputs() {
+		s.add(&UTXO{OutPoint{id, uint32(i)}, out, height})
+	}
+	return spent
+}
+
+// 検証済みのブロックを反映する
+func (s *UTXOSet) ConnectBlock(b *Block) {
+	spent := make([]*UTXO, 0)
+	for _, t := range b.transactions {
+		spent = append(spent, s.connectTransaction(t, b.header.height)...)
+	}
+	s.undo[b.Hash()] = spent
+}
+
+// 末尾のブロックを取り消し、ブロックが作った出力を削除して消費した出力を復元する
+func (s *UTXOSet) DisconnectBlock(b *Block) error {
+	hash := b.Hash()
+	spent, ok := s.undo[hash]
+	if !ok {
+		return fmt.Errorf("no undo data for block %x", hash)
+	}
+	created := make(map[[32]byte]bool)
+	for _, t := range b.transactions {
+		id := t.ID()
+		created[id] = true
+		for j := range t.Outputs() {
+			s.remove(OutPoint{id, uint32(j)})
+		}
+	}
+	// 同じブロック内で作られて消費された出力は復元しない
+	for _, u := range spent {
+		if !created[u.OutPoint.TxID] {
+			s.add(u)
+		}
+	}
+	delete(s.undo, hash)
+	return nil
+}
+
+// アドレスが所有する未使用の出力(古い順)
+func (s *UTXOSet) AddressUTXOs(blockchainAddress string) []*UTXO {
+	utxos := make([]*UTXO, 0, len(s.byAddress[blockchainAddress]))
+	for op := range s.byAddress[blockchainAddress] {
+		utxos = append(utxos, s.utxos[op])
+	}
+	sort.Slice(utxos, func(i, j int) bool {
+		if utxos[i].Height != utxos[j].Height {
+			return utxos[i].Height < utxos[j].Height
+		}
+		if c := bytes.Compare(utxos[i].OutPoint.TxID[:], utxos[j].OutPoint.TxID[:]); c != 0 {
+			return c < 0
+		}
+		return utxos[i].OutPoint.Index < utxos[j].OutPoint.Index
+	})
+	return utxos
+}
+
+// 全ての入力が未使用の出力を参照しているか
+func (s *UTXOSet) hasInputs(t *Transaction) bool {
+	for _, in := range t.inputs {
+		if s.utxos[in.prevOut] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// UTXOモデルのトランザクションの検証
+// 入力は送信者の未使用の出力で、それぞれ送信者の鍵で署名されている必要がある
+// 出力は受信者への送金額と、任意で送信者へのおつりのみとし、入力の合計は送金額、手数料、おつりの合計と一致する
+// spentは他のトランザクションが既に消費した出力と、消費したトランザクション(未承認のトランザクション同士の二重支払いの検出に使う)
+func (t *Transaction) checkUTXO(utxos *UTXOSet, spent map[OutPoint][32]byte) error {
+	if len(t.outputs) == 0 || len(t.outputs) > 2 ||
+		t.outputs[0].address != t.recipientBlockchainAddress || t.outputs[0].value != t.value {
+		return ErrInvalidOutputs
+	}
+	var change uint64 = 0
+	if len(t.outputs) == 2 {
+		if t.outputs[1].address != t.senderBlockchainAddress || t.outputs[1].value == 0 {
+			return ErrInvalidOutputs
+		}
+		change = t.outputs[1].value
+	}
+	used := make(map[OutPoint]bool)
+	var total uint64 = 0
+	for i, in := range t.inputs {
+		if _, ok := spent[in.prevOut]; ok || used[in.prevOut] {
+			return fmt.Errorf("%w: %s", ErrDoubleSpend, in.prevOut)
+		}
+		used[in.prevOut] = true
+		u := utxos.Get(in.prevOut)
+		if u == nil {
+			return fmt.Errorf("%w: %s", ErrMissingOutput, in.prevOut)
+		}
+		if u.Output.address != t.senderBlockchainAddress {
+			return fmt.Errorf("%w: %s", ErrInputOwner, in.prevOut)
+		}
+		if !t.verifyInputSignature(i, t.senderPublicKey) {
+			return fmt.Errorf("%w: input %d", ErrInvalidInputSig, i)
+		}
+		if total > math.MaxUint64-u.Output.value {
+			return ErrInputsMismatch
+		}
+		total += u.Output.value
+	}
+	if t.value > math.MaxUint64-t.fee || t.value+t.fee > math.MaxUint64-change || total != t.value+t.fee+change {
+		return fmt.Errorf("%w: inputs %s, value %s, fee %s, change %s", ErrInputsMismatch, utils.FormatAmount(total),
+			utils.FormatAmount(t.value), utils.FormatAmount(t.fee), utils.FormatAmount(change))
+	}
+	return nil
+}
+
+// 未承認のトランザクションが消費している出力(mempoolが保持しているものなので変更しない)
+// bc.muxを保持した状態で呼び出す
+func (bc *Blockchain) poolSpentOutputs() map[OutPoint][32]byte {
+	return bc.mempool.spent
+}
+
+func (bc *Blockchain) Ledger() string {
+	return bc.ledger
+}
+
+// アドレスが新しいトランザクションの入力に使える出力(未承認のトランザクションが消費しているものを除く)
+func (bc *Blockchain) SpendableUTXOs(blockchainAddress string) ([]*UTXO, error) {
+	bc.mux.Lock()
+	defer bc.mux.Unlock()
+	if bc.utxos == nil {
+		return nil, fmt.Errorf("%w: ledger model is %s", ErrLedgerMismatch, bc.ledger)
+	}
+	spent := bc.poolSpentOutputs()
+	utxos := make([]*UTXO, 0)
+	for _, u := range bc.utxos.AddressUTXOs(blockchainAddress) {
+		if _, ok := spent[u.OutPoint]; !ok {
+			utxos = append(utxos, u)
+		}
+	}
+	return utxos, nil
+}
@@ -0,0 +1,127 @@
+package block
+
+import (
+	"block/utils"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+)
+
+// UTXOモデルのチェーン(fundedの各アドレスにリワードを1回ずつ与える)
+func newTestUTXOBlockchain(t *testing.T, funded ...string) *Blockchain {
+	t.Helper()
+	bc, err := NewBlockchain("miner", 0, nil, time.Minute, LEDGER_UTXO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, address := range funded {
+		bc.connectTestBlock(mineTestBlock(bc, bc.chain, address))
+	}
+	return bc
+}
+
+// prevOutsを消費し、各入力にaの鍵で署名したトランザクション
+func (a *testAccount) spend(t *testing.T, recipient string, value uint64, fee uint64, nonce uint64, prevOuts []OutPoint, change uint64) *Transaction {
+	t.Helper()
+	tx := NewUTXOTransaction(a.address, recipient, value, fee, nonce, prevOuts, change)
+	tx.senderPublicKey = &a.key.PublicKey
+	for i, in := range tx.inputs {
+		h := sha256.Sum256(tx.InputSigningBytes(i))
+		r, s, err := ecdsa.Sign(rand.Reader, a.key, h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		in.signature = &utils.Signature{R: r, S: s}
+	}
+	return tx
+}
+
+func TestUTXOTransaction(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestUTXOBlockchain(t, alice.address)
+	utxos, err := bc.SpendableUTXOs(alice.address)
+	if err != nil || len(utxos) != 1 {
+		t.Fatalf("%d spendable outputs, %v, want the reward only", len(utxos), err)
+	}
+	reward := utxos[0].OutPoint
+
+	tx := alice.spend(t, bob.address, 100, 10, 0, []OutPoint{reward}, MINIG_REWARD-110)
+	if _, err := bc.AddSignedTransaction(tx, ""); err != nil {
+		t.Fatal(err)
+	}
+	// 未承認のトランザクションが消費した出力は使えない
+	if utxos, _ := bc.SpendableUTXOs(alice.address); len(utxos) != 0 {
+		t.Fatalf("%d spendable outputs, want 0", len(utxos))
+	}
+	again := alice.spend(t, bob.address, 100, 10, 1, []OutPoint{reward}, MINIG_REWARD-110)
+	if _, err := bc.AddSignedTransaction(again, ""); !errors.Is(err, ErrDoubleSpend) {
+		t.Fatalf("error %v, want %v", err, ErrDoubleSpend)
+	}
+	// アカウントモデルのトランザクションは受け付けない
+	if err := bc.addTestTransaction(alice.transfer(t, bob.address, 1, 0, 1)); !errors.Is(err, ErrLedgerMismatch) {
+		t.Fatalf("error %v, want %v", err, ErrLedgerMismatch)
+	}
+}
+
+func TestCheckUTXORejects(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestUTXOBlockchain(t, alice.address, bob.address)
+	aliceOut := bc.utxos.AddressUTXOs(alice.address)[0].OutPoint
+	bobOut := bc.utxos.AddressUTXOs(bob.address)[0].OutPoint
+
+	forged := alice.spend(t, bob.address, 100, 10, 0, []OutPoint{aliceOut}, MINIG_REWARD-110)
+	forged.inputs[0].signature = bob.spend(t, bob.address, 100, 10, 0, []OutPoint{aliceOut}, MINIG_REWARD-110).inputs[0].signature
+	tests := []struct {
+		name string
+		tx   *Transaction
+		want error
+	}{
+		{"missing output", alice.spend(t, bob.address, 100, 10, 0, []OutPoint{{TxID: [32]byte{1}}}, 0), ErrMissingOutput},
+		{"other owner", alice.spend(t, bob.address, 100, 10, 0, []OutPoint{bobOut}, MINIG_REWARD-110), ErrInputOwner},
+		{"forged signature", forged, ErrInvalidInputSig},
+		{"unbalanced", alice.spend(t, bob.address, 100, 10, 0, []OutPoint{aliceOut}, MINIG_REWARD-100), ErrInputsMismatch},
+		{"same input twice", alice.spend(t, bob.address, 100, 10, 0, []OutPoint{aliceOut, aliceOut}, 2*MINIG_REWARD-110), ErrDoubleSpend},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.tx.checkUTXO(bc.utxos, nil); !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// ブロックを取り消すと、作った出力が消えて消費した出力が戻る
+func TestUTXOSetDisconnectBlock(t *testing.T) {
+	alice := newTestAccount(t)
+	bob := newTestAccount(t)
+	bc := newTestUTXOBlockchain(t, alice.address)
+	reward := bc.utxos.AddressUTXOs(alice.address)[0].OutPoint
+	tx := alice.spend(t, bob.address, 100, 10, 0, []OutPoint{reward}, MINIG_REWARD-110)
+	b := mineTestBlock(bc, bc.chain, "miner", tx)
+	bc.connectTestBlock(b)
+	if bc.utxos.Get(reward) != nil {
+		t.Fatal("spent output is still unspent")
+	}
+	if got := bc.utxos.AddressUTXOs(bob.address); len(got) != 1 || got[0].Output.value != 100 {
+		t.Fatalf("outputs of bob %v, want one of 100", got)
+	}
+
+	if err := bc.utxos.DisconnectBlock(b); err != nil {
+		t.Fatal(err)
+	}
+	if bc.utxos.Get(reward) == nil {
+		t.Fatal("spent output was not restored")
+	}
+	if got := bc.utxos.AddressUTXOs(bob.address); len(got) != 0 {
+		t.Fatalf("%d outputs of bob remain, want 0", len(got))
+	}
+	if err := bc.utxos.DisconnectBlock(b); err == nil {
+		t.Fatal("disconnected the same block twice")
+	}
+}
@@ -0,0 +1,269 @@
+package block
+
+import (
+	"block/p2p"
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+// TCPのP2Pネットワークでブロックとトランザクションをやり取りする
+// 新しいブロックとトランザクションはinvでハッシュだけを知らせ、未知のものだけgetdataで要求される
+// 同期とorphanの親の取得もTCPの接続で行い、接続していない近隣ノードにはSetNodeHTTPで許可した場合のみHTTPで送る
+func (bc *Blockchain) SetNode(n *p2p.Node) {
+	bc.node = n
+	r := n.Router()
+	r.Handle(p2p.MSG_INV, bc.handleInv)
+	r.Handle(p2p.MSG_GETDATA, bc.handleGetData)
+	r.Handle(p2p.MSG_BLOCK, bc.handleBlock)
+	r.Handle(p2p.MSG_TX, bc.handleTx)
+	r.Handle(p2p.MSG_GETHEADERS, bc.handleGetHeaders)
+	r.Handle(p2p.MSG_GETBLOCKS, bc.handleGetBlocks)
+	n.SetBestHeight(func() uint64 {
+		bc.mux.Lock()
+		defer bc.mux.Unlock()
+		return bc.LastBlock().header.height
+	})
+	// 自分より長いチェーンを持つノードと接続したら同期する
+	n.OnConnect(func(c *p2p.Conn) {
+		bc.mux.Lock()
+		height := bc.LastBlock().header.height
+		bc.mux.Unlock()
+		if c.BestHeight() > height {
+			go bc.SyncBlocks()
+		}
+	})
+}
+
+func (bc *Blockchain) Node() *p2p.Node {
+	return bc.node
+}
+
+// TCPを使う場合に、接続していない近隣ノードへ認証できないHTTPでブロックとトランザクションを送るか
+func (bc *Blockchain) SetNodeHTTP(enabled bool) {
+	bc.nodeHTTP = enabled
+}
+
+// TCPで接続中のノードにinvを送る(TCPを使わない場合はfalse)
+func (bc *Blockchain) broadcastInv(invType string, hash [32]byte) bool {
+	if bc.node == nil {
+		return false
+	}
+	m, err := p2p.NewMessage(p2p.MSG_INV, &p2p.InvPayload{Items: []*p2p.InvItem{{Type: invType, Hash: hash}}})
+	if err != nil {
+		log.Printf("ERROR: %v", err)
+		return false
+	}
+	bc.node.Broadcast(m, nil)
+	return true
+}
+
+// HTTPでブロックとトランザクションを送る、TCPで接続していない近隣ノード
+// TCPを使う場合はSetNodeHTTPで許可しない限り、認証できないHTTPでは送らない
+func (bc *Blockchain) httpNeighbors() []string {
+	if bc.node == nil {
+		return bc.neighbors
+	}
+	neighbors := make([]string, 0)
+	if !bc.nodeHTTP || bc.node.Private() {
+		return neighbors
+	}
+	for _, n := range bc.neighbors {
+		if bc.node.Conn(n) == nil {
+			neighbors = append(neighbors, n)
+		}
+	}
+	return neighbors
+}
+
+func (bc *Blockchain) handleInv(c *p2p.Conn, m *p2p.Message) error {
+	var inv p2p.InvPayload
+	if err := m.Decode(&inv); err != nil {
+		return err
+	}
+	if len(inv.Items) > p2p.MAX_INV_ITEMS {
+		bc.node.Misbehaving(c, p2p.PENALTY_UNEXPECTED_BLOCK, "too many inventory items")
+		return nil
+	}
+	wanted := make([]*p2p.InvItem, 0)
+	bc.mux.Lock()
+	for _, item := range inv.Items {
+		switch item.Type {
+		case p2p.INV_TYPE_BLOCK:
+			if bc.tree.node(item.Hash) == nil {
+				wanted = append(wanted, item)
+			}
+		case p2p.INV_TYPE_TX:
+			if bc.mempool.Transaction(item.Hash) == nil {
+				wanted = append(wanted, item)
+			}
+		}
+	}
+	bc.mux.Unlock()
+	if len(wanted) == 0 {
+		return nil
+	}
+	getData, err := p2p.NewMessage(p2p.MSG_GETDATA, &p2p.InvPayload{Items: wanted})
+	if err != nil {
+		return err
+	}
+	c.Send(getData)
+	return nil
+}
+
+// 要求されたもののうち持っているものだけ送る
+func (bc *Blockchain) handleGetData(c *p2p.Conn, m *p2p.Message) error {
+	var getData p2p.InvPayload
+	if err := m.Decode(&getData); err != nil {
+		return err
+	}
+	if len(getData.Items) > p2p.MAX_INV_ITEMS {
+		bc.node.Misbehaving(c, p2p.PENALTY_UNEXPECTED_BLOCK, "too many inventory items")
+		return nil
+	}
+	for _, item := range getData.Items {
+		var reply *p2p.Message
+		var err error
+		switch item.Type {
+		case p2p.INV_TYPE_BLOCK:
+			b, e := bc.Block(item.Hash)
+			if e != nil {
+				continue
+			}
+			reply, err = p2p.NewMessage(p2p.MSG_BLOCK, b)
+		case p2p.INV_TYPE_TX:
+			bc.mux.Lock()
+			t := bc.mempool.Transaction(item.Hash)
+			bc.mux.Unlock()
+			if t == nil {
+				continue
+			}
+			reply, err = p2p.NewMessage(p2p.MSG_TX, t.Request())
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		c.Send(reply)
+	}
+	return nil
+}
+
+func (bc *Blockchain) handleBlock(c *p2p.Conn, m *p2p.Message) error {
+	var b Block
+	if err := json.Unmarshal(m.Payload, &b); err != nil {
+		bc.node.Misbehaving(c, p2p.PENALTY_INVALID_CHAIN, err.Error())
+		return err
+	}
+	err := bc.ReceiveBlock(&b)
+	switch {
+	case err == nil:
+		log.Printf("action=receive_block, hash=%x, height=%d, from=%s", b.Hash(), b.header.height, c)
+	case errors.Is(err, ErrDuplicateBlock):
+	case errors.Is(err, ErrOrphanBlock):
+		// 親は送ってきたノードにも要求する
+		parent := &p2p.InvItem{Type: p2p.INV_TYPE_BLOCK, Hash: b.header.previousHash}
+		if getData, e := p2p.NewMessage(p2p.MSG_GETDATA, &p2p.InvPayload{Items: []*p2p.InvItem{parent}}); e == nil {
+			c.Send(getData)
+		}
+	default:
+		log.Printf("ERROR: block %x from %s: %v", b.Hash(), c, err)
+		bc.node.Misbehaving(c, p2p.PENALTY_INVALID_CHAIN, err.Error())
+	}
+	return nil
+}
+
+func (bc *Blockchain) handleTx(c *p2p.Conn, m *p2p.Message) error {
+	var tr TransactionRequest
+	if err := json.Unmarshal(m.Payload, &tr); err != nil {
+		return err
+	}
+	if !tr.Validate() {
+		return errors.New("missing field(s)")
+	}
+	t, err := tr.Transaction()
+	if err != nil {
+		return err
+	}
+	// 他のノードで先に承認された場合などもあるため、受け付けられなくてもピアの評価は下げない
+	if _, err := bc.AddSignedTransaction(t, c.String()); err != nil {
+		log.Printf("action=receive_tx, txid=%x, from=%s, error=%v", t.ID(), c, err)
+		return nil
+	}
+	bc.broadcastInv(p2p.INV_TYPE_TX, t.ID())
+	return nil
+}
+
+// ブロックロケーターとの分岐点からのヘッダーを返す
+func (bc *Blockchain) handleGetHeaders(c *p2p.Conn, m *p2p.Message) error {
+	var req p2p.GetHeadersPayload
+	if err := m.Decode(&req); err != nil {
+		return err
+	}
+	var locator [][32]byte
+	if req.Locator != "" {
+		var err error
+		if locator, err = ParseLocator(req.Locator); err != nil {
+			return err
+		}
+	}
+	limit := req.Limit
+	if limit <= 0 || limit > HEADERS_PAGE_MAX_LIMIT {
+		limit = HEADERS_PAGE_MAX_LIMIT
+	}
+	headers, from, height := bc.HeadersAfter(locator, limit)
+	reply, err := p2p.NewMessage(p2p.MSG_HEADERS, &HeadersResponse{Height: height, From: from, Headers: headers})
+	if err != nil {
+		return err
+	}
+	c.Send(reply)
+	return nil
+}
+
+// 要求されたハッシュのブロックを順に返す
+// 持っていないブロックがあればそこまでとし、メッセージの大きさの上限を超える分は返さない(要求した側が残りを要求し直す)
+func (bc *Blockchain) handleGetBlocks(c *p2p.Conn, m *p2p.Message) error {
+	var req p2p.InvPayload
+	if err := m.Decode(&req); err != nil {
+		return err
+	}
+	if len(req.Items) > BLOCKS_PAGE_MAX_LIMIT {
+		bc.node.Misbehaving(c, p2p.PENALTY_UNEXPECTED_BLOCK, "too many blocks requested")
+		return nil
+	}
+	blocks := make([]*Block, 0, len(req.Items))
+	size := 0
+	for _, item := range req.Items {
+		if item.Type != p2p.INV_TYPE_BLOCK {
+			break
+		}
+		b, err := bc.Block(item.Hash)
+		if err != nil {
+			break
+		}
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		// BlocksResponseの他のフィールドの分の余裕を残す
+		if size+len(data)+1 > p2p.MAX_MESSAGE_PAYLOAD-1024 {
+			break
+		}
+		size += len(data) + 1
+		blocks = append(blocks, b)
+	}
+	bc.mux.Lock()
+	height := bc.LastBlock().header.height
+	bc.mux.Unlock()
+	var from uint64
+	if len(blocks) > 0 {
+		from = blocks[0].header.height
+	}
+	reply, err := p2p.NewMessage(p2p.MSG_BLOCKS, &BlocksResponse{Height: height, From: from, Blocks: blocks})
+	if err != nil {
+		return err
+	}
+	c.Send(reply)
+	return nil
+}
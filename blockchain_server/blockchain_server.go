@@ -2,23 +2,45 @@ package main
 
 import (
 	"block/block"
+	"block/p2p"
 	"block/utils"
 	"block/wallet"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 var cache map[string]*block.Blockchain = make(map[string]*block.Blockchain)
 
 type BlockchainServer struct {
 	port uint16
+	// ブロックチェーンの保存先ディレクトリ
+	dataDir string
+	// 目標とするブロックの生成間隔
+	blockTime time.Duration
+	// マイニングに使うgoroutineの数
+	miningWorkers int
+	// 台帳のモデル(accountかutxo)
+	ledger string
+	// ピアの管理(nilの場合は同じサブネットのポートを走査する)
+	peers *p2p.PeerManager
+	// TCPでの他のノードとの通信(nilの場合はHTTPのみ)
+	node *p2p.Node
+	// 他のノードからのHTTPでの送信を受け付けるか
+	nodeHTTP bool
+	// 未承認トランザクションの上限
+	mempool block.MempoolLimits
 }
 
-func NewBlockchainServer(port uint16) *BlockchainServer {
-	return &BlockchainServer{port}
+func NewBlockchainServer(port uint16, dataDir string, blockTime time.Duration, miningWorkers int, ledger string, peers *p2p.PeerManager, node *p2p.Node, nodeHTTP bool, mempool block.MempoolLimits) *BlockchainServer {
+	return &BlockchainServer{port, dataDir, blockTime, miningWorkers, ledger, peers, node, nodeHTTP, mempool}
 }
 
 func (bcs *BlockchainServer) Port() uint16 {
@@ -29,7 +51,26 @@ func (bcs *BlockchainServer) GetBlockchain() *block.Blockchain {
 	bc, ok := cache["blockchain"]
 	if !ok {
 		minersWallet := wallet.NewWallet()
-		bc = block.NewBlockchain(minersWallet.BlockchainAddress(), bcs.Port())
+		store, err := block.NewFileStore(bcs.dataDir)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		bc, err = block.NewBlockchain(minersWallet.BlockchainAddress(), bcs.Port(), store, bcs.blockTime, bcs.ledger)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		bc.SetMiningWorkers(bcs.miningWorkers)
+		bc.SetMempoolLimits(bcs.mempool)
+		if bcs.peers != nil {
+			bc.SetPeerManager(bcs.peers)
+		}
+		if bcs.node != nil {
+			bc.SetNode(bcs.node)
+			bc.SetNodeHTTP(bcs.nodeHTTP)
+			if err := bcs.node.Listen(); err != nil {
+				log.Fatalf("ERROR: %v", err)
+			}
+		}
 		cache["blockchain"] = bc
 		log.Printf("private_key %v", minersWallet.PrivateKeyStr())
 		log.Printf("public_key %v", minersWallet.PublicKeyStr())
@@ -79,22 +120,33 @@ func (bcs *BlockchainServer) Transactions(w http.ResponseWriter, req *http.Reque
 			io.WriteString(w, string(utils.JsonStatus("fail")))
 			return
 		}
-		publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
-		signature := utils.SignatureFromString(*t.Signature)
+		// 金額や署名の形式が不正な場合は理由を返す
+		transaction, err := t.Transaction()
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatusWithReason("fail", err.Error())))
+			return
+		}
 		bc := bcs.GetBlockchain()
-		isCreated := bc.CreateTransaction(*t.SenderBlockchainAddress, *t.RecipientBlockchainAddress, *t.Value, publicKey, signature)
+		txid, err := bc.CreateSignedTransaction(transaction)
 
 		w.Header().Add("Content-Type", "application/json")
 		var m []byte
-		if !isCreated {
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			m = utils.JsonStatus("fail")
+			m = utils.JsonStatusWithReason("fail", err.Error())
 		} else {
 			w.WriteHeader(http.StatusCreated)
-			m = utils.JsonStatus("success")
+			// 承認状況の問い合わせに使うトランザクションID
+			m, _ = json.Marshal(&block.TransactionCreatedResponse{Message: "success", TxID: fmt.Sprintf("%x", txid)})
 		}
 		io.WriteString(w, string(m))
 	case http.MethodPut:
+		if bcs.rejectNodeRequest(w, req) {
+			return
+		}
 		decoder := json.NewDecoder(req.Body)
 		var t block.TransactionRequest
 		err := decoder.Decode(&t)
@@ -108,25 +160,29 @@ func (bcs *BlockchainServer) Transactions(w http.ResponseWriter, req *http.Reque
 			io.WriteString(w, string(utils.JsonStatus("fail")))
 			return
 		}
-		publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
-		signature := utils.SignatureFromString(*t.Signature)
+		// 金額や署名の形式が不正な場合は理由を返す
+		transaction, err := t.Transaction()
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			w.Header().Add("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatusWithReason("fail", err.Error())))
+			return
+		}
 		bc := bcs.GetBlockchain()
-		// 同期される側は再同期を防ぐためにCreateTransactionではなくAddTransaction
-		isUpdated := bc.AddTransaction(*t.SenderBlockchainAddress, *t.RecipientBlockchainAddress, *t.Value, publicKey, signature)
+		// 同期される側は再同期を防ぐためにCreateSignedTransactionではなくAddSignedTransaction
+		source, _, _ := net.SplitHostPort(req.RemoteAddr)
+		_, err = bc.AddSignedTransaction(transaction, source)
 
 		w.Header().Add("Content-Type", "application/json")
 		var m []byte
-		if !isUpdated {
+		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
-			m = utils.JsonStatus("fail")
+			m = utils.JsonStatusWithReason("fail", err.Error())
 		} else {
 			m = utils.JsonStatus("success")
 		}
 		io.WriteString(w, string(m))
-	case http.MethodDelete:
-		bc := bcs.GetBlockchain()
-		bc.ClearTransactionPool()
-		io.WriteString(w, string(utils.JsonStatus("success")))
 	default:
 		log.Println("ERROR Invalid HTTP Method")
 		w.WriteHeader(http.StatusBadRequest)
@@ -134,6 +190,29 @@ func (bcs *BlockchainServer) Transactions(w http.ResponseWriter, req *http.Reque
 
 }
 
+// /transactions/{txid}
+func (bcs *BlockchainServer) TransactionStatus(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		txid, err := block.ParseHash(strings.Trim(strings.TrimPrefix(req.URL.Path, "/transactions/"), "/"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatusWithReason("fail", "invalid txid")))
+			return
+		}
+		ts := bcs.GetBlockchain().TransactionStatus(txid)
+		if ts.Status == block.TRANSACTION_STATUS_UNKNOWN {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		m, _ := json.Marshal(ts)
+		io.WriteString(w, string(m[:]))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
 func (bcs *BlockchainServer) Mine(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
@@ -170,15 +249,36 @@ func (bcs *BlockchainServer) StartMine(w http.ResponseWriter, req *http.Request)
 	}
 }
 
+func (bcs *BlockchainServer) MiningStatus(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		// ワーカー数とハッシュレート
+		m, _ := json.Marshal(bcs.GetBlockchain().Miner())
+
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m[:]))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
 func (bcs *BlockchainServer) Amount(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
 		// URLの中からパラメータを取得
 		blockchainAddress := req.URL.Query().Get("blockchain_address")
-		amount := bcs.GetBlockchain().CalculateTotalAmount(blockchainAddress)
+		bc := bcs.GetBlockchain()
 
 		// 構造体を初期化&フィールドに値を代入
-		ar := &block.AmountResponse{amount}
+		var ar *block.AmountResponse
+		// pending=trueの場合は未承認のトランザクションによる増減も返す
+		if req.URL.Query().Get("pending") == "true" {
+			pb := bc.PendingBalance(blockchainAddress)
+			ar = &block.AmountResponse{Amount: pb.Confirmed, Pending: pb}
+		} else {
+			ar = &block.AmountResponse{Amount: bc.CalculateTotalAmount(blockchainAddress)}
+		}
 		m, _ := ar.MarshalJSON()
 
 		w.Header().Add("Content-Type", "application/json")
@@ -189,9 +289,113 @@ func (bcs *BlockchainServer) Amount(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// /addresses/{address}/transactions?offset=0&limit=20
+// /addresses/{address}/utxos
+func (bcs *BlockchainServer) Addresses(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(req.URL.Path, "/addresses/"), "/"), "/")
+		if len(parts) != 2 || parts[0] == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch parts[1] {
+		case "transactions":
+			bcs.addressTransactions(w, req, parts[0])
+		case "utxos":
+			bcs.addressUTXOs(w, parts[0])
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// アドレスのトランザクションの履歴(新しい順)
+func (bcs *BlockchainServer) addressTransactions(w http.ResponseWriter, req *http.Request, address string) {
+	w.Header().Add("Content-Type", "application/json")
+	offset, limit := 0, block.ADDRESS_HISTORY_DEFAULT_LIMIT
+	var err error
+	if s := req.URL.Query().Get("offset"); s != "" {
+		if offset, err = strconv.Atoi(s); err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatusWithReason("fail", "invalid offset")))
+			return
+		}
+	}
+	if s := req.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 || limit > block.ADDRESS_HISTORY_MAX_LIMIT {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatusWithReason("fail", fmt.Sprintf("limit must be between 1 and %d", block.ADDRESS_HISTORY_MAX_LIMIT))))
+			return
+		}
+	}
+	transactions, total := bcs.GetBlockchain().AddressHistory(address, offset, limit)
+	m, _ := json.Marshal(struct {
+		Address      string                      `json:"address"`
+		Total        int                         `json:"total"`
+		Offset       int                         `json:"offset"`
+		Limit        int                         `json:"limit"`
+		Transactions []*block.AddressTransaction `json:"transactions"`
+	}{
+		Address:      address,
+		Total:        total,
+		Offset:       offset,
+		Limit:        limit,
+		Transactions: transactions,
+	})
+	io.WriteString(w, string(m[:]))
+}
+
+// アドレスが新しいトランザクションの入力に使える未使用の出力(UTXOモデルのみ)
+func (bcs *BlockchainServer) addressUTXOs(w http.ResponseWriter, address string) {
+	w.Header().Add("Content-Type", "application/json")
+	utxos, err := bcs.GetBlockchain().SpendableUTXOs(address)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, string(utils.JsonStatusWithReason("fail", err.Error())))
+		return
+	}
+	var total uint64 = 0
+	for _, u := range utxos {
+		total += u.Output.Value()
+	}
+	m, _ := json.Marshal(struct {
+		Address string        `json:"address"`
+		Total   string        `json:"total"`
+		UTXOs   []*block.UTXO `json:"utxos"`
+	}{
+		Address: address,
+		Total:   utils.FormatAmount(total),
+		UTXOs:   utxos,
+	})
+	io.WriteString(w, string(m[:]))
+}
+
+func (bcs *BlockchainServer) Nonce(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		blockchainAddress := req.URL.Query().Get("blockchain_address")
+		// 未承認のトランザクションも含めた次のnonceを返す
+		nr := &block.NonceResponse{Nonce: bcs.GetBlockchain().NextNonce(blockchainAddress)}
+		m, _ := json.Marshal(nr)
+
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m[:]))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
 func (bcs *BlockchainServer) Consensus(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodPut:
+		if bcs.rejectNodeRequest(w, req) {
+			return
+		}
 		bc := bcs.GetBlockchain()
 		// ブロックチェーンの同期
 		replaced := bc.ResolveConflicts()
@@ -208,14 +412,266 @@ func (bcs *BlockchainServer) Consensus(w http.ResponseWriter, req *http.Request)
 	}
 }
 
+// /blocks?from=0&limit=20
+// /blocks/{hash}
+// /blocks/{hash}/proof/{txid}
+// パスのパラメータはhttp.ServeMuxでは扱えないため、パスを分割して取り出す
+// POST /blocksは他のノードが掘ったブロックの受け取り
+func (bcs *BlockchainServer) Blocks(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodPost:
+		if bcs.rejectNodeRequest(w, req) {
+			return
+		}
+		var b block.Block
+		if err := json.NewDecoder(req.Body).Decode(&b); err != nil {
+			log.Printf("ERROR: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatusWithReason("fail", err.Error())))
+			return
+		}
+		err := bcs.GetBlockchain().ReceiveBlock(&b)
+
+		w.Header().Add("Content-Type", "application/json")
+		var m []byte
+		switch {
+		case err == nil:
+			w.WriteHeader(http.StatusCreated)
+			m = utils.JsonStatus("success")
+		case errors.Is(err, block.ErrDuplicateBlock):
+			m = utils.JsonStatusWithReason("success", err.Error())
+		case errors.Is(err, block.ErrOrphanBlock):
+			// 親のブロックを取得してから追加する
+			w.WriteHeader(http.StatusAccepted)
+			m = utils.JsonStatusWithReason("success", err.Error())
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			m = utils.JsonStatusWithReason("fail", err.Error())
+		}
+		io.WriteString(w, string(m))
+	case http.MethodGet:
+		path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/blocks"), "/")
+		if path == "" {
+			bcs.blockRange(w, req)
+			return
+		}
+		parts := strings.Split(path, "/")
+		if len(parts) != 1 && (len(parts) != 3 || parts[1] != "proof") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		blockHash, err := block.ParseHash(parts[0])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatusWithReason("fail", "invalid block hash")))
+			return
+		}
+		// 採用中のチェーン以外の分岐のブロックも返す(他のノードがorphanの親を問い合わせる)
+		if len(parts) == 1 {
+			b, err := bcs.GetBlockchain().Block(blockHash)
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				io.WriteString(w, string(utils.JsonStatusWithReason("fail", err.Error())))
+				return
+			}
+			m, _ := json.Marshal(b)
+			io.WriteString(w, string(m[:]))
+			return
+		}
+		txid, err := block.ParseHash(parts[2])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatusWithReason("fail", "invalid txid")))
+			return
+		}
+		proof, err := bcs.GetBlockchain().TransactionProof(blockHash, txid)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, string(utils.JsonStatusWithReason("fail", err.Error())))
+			return
+		}
+		m, _ := json.Marshal(proof)
+		io.WriteString(w, string(m[:]))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// クエリのfromとlimitを取り出す(不正な場合は400を返してfalse)
+func parseRange(w http.ResponseWriter, req *http.Request, defaultLimit int, maxLimit int) (uint64, int, bool) {
+	var from uint64 = 0
+	limit := defaultLimit
+	var err error
+	if s := req.URL.Query().Get("from"); s != "" {
+		if from, err = strconv.ParseUint(s, 10, 64); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatusWithReason("fail", "invalid from")))
+			return 0, 0, false
+		}
+	}
+	if s := req.URL.Query().Get("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 || limit > maxLimit {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, string(utils.JsonStatusWithReason("fail", fmt.Sprintf("limit must be between 1 and %d", maxLimit))))
+			return 0, 0, false
+		}
+	}
+	return from, limit, true
+}
+
+// 採用中のチェーンの高さfromからのブロック
+func (bcs *BlockchainServer) blockRange(w http.ResponseWriter, req *http.Request) {
+	w.Header().Add("Content-Type", "application/json")
+	from, limit, ok := parseRange(w, req, block.BLOCKS_PAGE_DEFAULT_LIMIT, block.BLOCKS_PAGE_MAX_LIMIT)
+	if !ok {
+		return
+	}
+	blocks, height := bcs.GetBlockchain().Blocks(from, limit)
+	m, _ := json.Marshal(&block.BlocksResponse{Height: height, From: from, Blocks: blocks})
+	io.WriteString(w, string(m[:]))
+}
+
+// /headers?from=0&limit=500
+// /headers?locator=<hash>,<hash>,...&limit=500
+// 採用中のチェーンの高さfrom、またはブロックロケーターとの分岐点からのヘッダー(同期で本体より先に取得する)
+func (bcs *BlockchainServer) Headers(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Add("Content-Type", "application/json")
+		from, limit, ok := parseRange(w, req, block.HEADERS_PAGE_DEFAULT_LIMIT, block.HEADERS_PAGE_MAX_LIMIT)
+		if !ok {
+			return
+		}
+		var headers []*block.BlockHeader
+		var height uint64
+		if s := req.URL.Query().Get("locator"); s != "" {
+			locator, err := block.ParseLocator(s)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				io.WriteString(w, string(utils.JsonStatusWithReason("fail", err.Error())))
+				return
+			}
+			headers, from, height = bcs.GetBlockchain().HeadersAfter(locator, limit)
+		} else {
+			headers, height = bcs.GetBlockchain().Headers(from, limit)
+		}
+		m, _ := json.Marshal(&block.HeadersResponse{Height: height, From: from, Headers: headers})
+		io.WriteString(w, string(m[:]))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// 他のノードとの同期の進捗
+func (bcs *BlockchainServer) SyncStatus(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		sp := bcs.GetBlockchain().SyncProgress()
+		m, _ := json.Marshal(&sp)
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m[:]))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// 未承認トランザクションの件数、サイズ、手数料率と上限
+func (bcs *BlockchainServer) MempoolStats(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		m, _ := json.Marshal(bcs.GetBlockchain().MempoolStats())
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m[:]))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// 他のノードからのHTTPでの送信(ブロック、トランザクションの同期、チェーンの同期の要求)を拒否する場合はtrue
+// 送信元を認証できないため、TLSのみで通信する設定では常に拒否する
+// (送信元のポートが分からず、ホストで禁止すると同じホストの他のノードも拒否してしまうため、禁止したノードの判定はTCPのノードIDで行う)
+func (bcs *BlockchainServer) rejectNodeRequest(w http.ResponseWriter, req *http.Request) bool {
+	if !bcs.nodeHTTP {
+		w.WriteHeader(http.StatusForbidden)
+		return true
+	}
+	return false
+}
+
+// /peers?addr={host:port}
+// 知っているピアのアドレスを返し、addrで知らされた相手のアドレスは問い合わせて応答があればアドレス帳に加える
+func (bcs *BlockchainServer) Peers(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		pr := &p2p.PeersResponse{Peers: make([]*p2p.PeerAddress, 0)}
+		if bcs.peers != nil {
+			if addr := req.URL.Query().Get("addr"); addr != "" {
+				bcs.peers.VerifyAddress(addr)
+			}
+			pr.Peers = bcs.peers.SharedAddresses()
+			pr.Connected = bcs.peers.Peers()
+		} else {
+			// ポートを走査している場合は見つかったノードのみ
+			pr.Connected = bcs.GetBlockchain().Neighbors()
+			for _, n := range pr.Connected {
+				pr.Peers = append(pr.Peers, &p2p.PeerAddress{Address: n})
+			}
+		}
+		if bcs.node != nil {
+			pr.NodeID = bcs.node.ID()
+			pr.Streams = bcs.node.Addresses()
+		}
+		m, _ := json.Marshal(pr)
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m[:]))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// 採用中のチェーンと競合している分岐の末尾
+func (bcs *BlockchainServer) ChainTips(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		tips := bcs.GetBlockchain().ChainTips()
+		m, _ := json.Marshal(struct {
+			Tips []*block.ChainTip `json:"tips"`
+		}{
+			Tips: tips,
+		})
+		w.Header().Add("Content-Type", "application/json")
+		io.WriteString(w, string(m[:]))
+	default:
+		log.Println("ERROR: Invalid HTTP Method")
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
 func (bcs *BlockchainServer) Run() {
 	bcs.GetBlockchain().Run()
 
 	http.HandleFunc("/", bcs.GetChain)
+	http.HandleFunc("/chain/tips", bcs.ChainTips)
 	http.HandleFunc("/transactions", bcs.Transactions)
+	http.HandleFunc("/transactions/", bcs.TransactionStatus)
 	http.HandleFunc("/mine", bcs.Mine)
 	http.HandleFunc("/mine/start", bcs.StartMine)
+	http.HandleFunc("/mine/status", bcs.MiningStatus)
 	http.HandleFunc("/amount", bcs.Amount)
+	http.HandleFunc("/nonce", bcs.Nonce)
+	http.HandleFunc("/addresses/", bcs.Addresses)
 	http.HandleFunc("/consensus", bcs.Consensus)
+	http.HandleFunc("/blocks", bcs.Blocks)
+	http.HandleFunc("/blocks/", bcs.Blocks)
+	http.HandleFunc("/headers", bcs.Headers)
+	http.HandleFunc("/sync", bcs.SyncStatus)
+	http.HandleFunc("/peers", bcs.Peers)
+	http.HandleFunc("/mempool/stats", bcs.MempoolStats)
 	log.Fatal(http.ListenAndServe("0.0.0.0:"+strconv.Itoa(int(bcs.port)), nil))
 }
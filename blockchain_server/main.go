@@ -1,8 +1,15 @@
 package main
 
 import (
+	"block/block"
+	"block/p2p"
+	"block/utils"
 	"flag"
+	"fmt"
 	"log"
+	"runtime"
+	"strings"
+	"time"
 )
 
 func init() {
@@ -11,7 +18,62 @@ func init() {
 
 func main() {
 	port := flag.Uint("port", 5000, "TCP Port Number for Blockchain Server")
+	dataDir := flag.String("datadir", "", "Directory to store the blockchain (default: data/<port>)")
+	blockTime := flag.Uint("block_time", block.TARGET_BLOCK_TIME_SEC, "Target block interval in seconds (must be the same on every node)")
+	miningWorkers := flag.Int("miners", runtime.NumCPU(), "Number of goroutines used for mining")
+	ledger := flag.String("ledger", block.LEDGER_ACCOUNT, "Ledger model, account or utxo (must be the same on every node)")
+	discovery := flag.String("discovery", p2p.DISCOVERY_GOSSIP, "Peer discovery, gossip (exchange addresses with seed nodes) or local (scan ports on the local subnet)")
+	seeds := flag.String("seeds", "", "Comma-separated host:port of seed nodes")
+	maxPeers := flag.Int("max_peers", p2p.MAX_PEERS_DEFAULT, "Maximum number of peers to connect to")
+	host := flag.String("host", utils.GetHost(), "Host advertised to other nodes")
+	useP2P := flag.Bool("p2p", true, fmt.Sprintf("Exchange blocks and transactions over persistent TCP connections on the HTTP port + %d", p2p.P2P_PORT_OFFSET))
+	networkID := flag.Uint("network_id", p2p.NETWORK_ID_DEFAULT, "Network ID checked in the TCP handshake (must be the same on every node)")
+	allowlist := flag.String("allowlist", "", "File listing the node IDs allowed to connect, one per line (private network; disables node-to-node HTTP)")
+	nodeHTTP := flag.Bool("node_http", false, "Also exchange blocks and transactions with other nodes over unauthenticated HTTP (always on with -p2p=false)")
+	mempoolMaxBytes := flag.Int("mempool_max_bytes", block.MEMPOOL_MAX_BYTES_DEFAULT, "Maximum total size of pending transactions in bytes (lowest fee rate is evicted first)")
+	mempoolExpiry := flag.Uint("mempool_expiry", uint(block.MEMPOOL_EXPIRY_DEFAULT/time.Hour), "Hours after which unconfirmed transactions are dropped")
+	mempoolMaxPerSender := flag.Int("mempool_max_per_sender", block.MEMPOOL_MAX_PER_SENDER_DEFAULT, "Maximum number of pending transactions per sender")
 	flag.Parse()
-	app := NewBlockchainServer(uint16(*port))
+	if *dataDir == "" {
+		*dataDir = fmt.Sprintf("data/%d", *port)
+	}
+	var peers *p2p.PeerManager
+	switch *discovery {
+	case p2p.DISCOVERY_GOSSIP:
+		peers = p2p.NewPeerManager(fmt.Sprintf("%s:%d", *host, *port), strings.Split(*seeds, ","), *maxPeers)
+	case p2p.DISCOVERY_LOCAL:
+	default:
+		log.Fatalf("ERROR: unknown discovery %s", *discovery)
+	}
+	var node *p2p.Node
+	if !*useP2P && !*nodeHTTP {
+		// TCPを使わない場合は、認証できないHTTPでしか他のノードと通信できない
+		log.Printf("WARNING: -p2p=false exchanges blocks and transactions over unauthenticated HTTP")
+		*nodeHTTP = true
+	}
+	if *useP2P {
+		identity, err := p2p.LoadOrCreateIdentity(*dataDir)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		log.Printf("node_id %s", identity.ID())
+		node = p2p.NewNode(uint32(*networkID), fmt.Sprintf("%s:%d", *host, *port), peers, identity)
+	}
+	if *allowlist != "" {
+		if node == nil {
+			log.Fatalf("ERROR: -allowlist requires -p2p")
+		}
+		ids, err := p2p.LoadAllowlist(*allowlist)
+		if err != nil {
+			log.Fatalf("ERROR: %v", err)
+		}
+		node.SetAllowlist(ids)
+		*nodeHTTP = false
+	}
+	app := NewBlockchainServer(uint16(*port), *dataDir, time.Second*time.Duration(*blockTime), *miningWorkers, *ledger, peers, node, *nodeHTTP, block.MempoolLimits{
+		MaxBytes:     *mempoolMaxBytes,
+		Expiry:       time.Hour * time.Duration(*mempoolExpiry),
+		MaxPerSender: *mempoolMaxPerSender,
+	})
 	app.Run()
 }
@@ -0,0 +1,264 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// versionとverackの交換を終えるまでの時間
+	HANDSHAKE_TIMEOUT = 10 * time.Second
+	// この間隔でpingを送り、IDLE_TIMEOUTの間何も受信しなければ接続を切る
+	PING_INTERVAL = 30 * time.Second
+	IDLE_TIMEOUT  = 90 * time.Second
+	WRITE_TIMEOUT = 30 * time.Second
+	// 送信待ちのメッセージ数の上限(溢れた場合は接続を切る)
+	SEND_QUEUE_SIZE = 100
+	// Requestで応答を待つ時間
+	REQUEST_TIMEOUT = 30 * time.Second
+)
+
+var (
+	ErrRequestTimeout = errors.New("request timed out")
+	ErrConnClosed     = errors.New("connection closed")
+)
+
+// TLSで接続中のピア
+type Conn struct {
+	node    *Node
+	conn    *tls.Conn
+	inbound bool
+	mux     sync.Mutex
+	// 確認済みのピアのHTTPのアドレス(PeerManagerのアドレス帳と同じ形式)
+	// 自分から接続した場合は接続先のアドレスで、接続してきた場合は接続し返して同じノードIDが応答するまで空
+	address string
+	// 接続してきたピアがversionで知らせたアドレス(未確認)
+	claimed string
+	// ピアの証明書の公開鍵から求めたノードID
+	nodeID  string
+	version *VersionPayload
+	send    chan *Message
+	quit    chan struct{}
+	once    sync.Once
+	// Requestは1つずつ行い、応答のコマンドのメッセージをwaiterに渡す
+	requestMux sync.Mutex
+	waiter     chan *Message
+	reply      string
+}
+
+// 確認済みのHTTPのアドレス(未確認の場合は空)
+func (c *Conn) Address() string {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.address
+}
+
+func (c *Conn) setAddress(address string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.address = address
+}
+
+// ログに表示するピア(アドレスが未確認の場合は知らせたアドレスとノードID)
+func (c *Conn) String() string {
+	if address := c.Address(); address != "" {
+		return address
+	}
+	return fmt.Sprintf("%s(unverified, node_id=%s)", c.claimed, c.nodeID)
+}
+
+func (c *Conn) NodeID() string {
+	return c.nodeID
+}
+
+// ピアから接続してきた場合はtrue
+func (c *Conn) Inbound() bool {
+	return c.inbound
+}
+
+// 接続時にピアが知らせた採用中のチェーンの高さ
+func (c *Conn) BestHeight() uint64 {
+	return c.version.BestHeight
+}
+
+// 送信待ちに加える
+// 送信が追いつかないピアは接続を切る
+func (c *Conn) Send(m *Message) {
+	select {
+	case c.send <- m:
+	case <-c.quit:
+	default:
+		log.Printf("ERROR: send queue of %s is full", c)
+		c.Close()
+	}
+}
+
+// mを送り、replyのコマンドの応答を待つ
+// 同じ接続への要求は1つずつ行い、REQUEST_TIMEOUTの間に応答がなければErrRequestTimeoutを返す
+func (c *Conn) Request(m *Message, reply string) (*Message, error) {
+	c.requestMux.Lock()
+	defer c.requestMux.Unlock()
+	waiter := make(chan *Message, 1)
+	c.mux.Lock()
+	c.waiter, c.reply = waiter, reply
+	c.mux.Unlock()
+	defer func() {
+		c.mux.Lock()
+		c.waiter, c.reply = nil, ""
+		c.mux.Unlock()
+	}()
+	c.Send(m)
+	timer := time.NewTimer(REQUEST_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case r := <-waiter:
+		return r, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%w: %s to %s", ErrRequestTimeout, m.Command, c)
+	case <-c.quit:
+		return nil, ErrConnClosed
+	}
+}
+
+// 待っている応答であればRequestに渡してtrueを返す
+func (c *Conn) deliver(m *Message) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if c.waiter == nil || c.reply != m.Command {
+		return false
+	}
+	c.waiter <- m
+	c.waiter, c.reply = nil, ""
+	return true
+}
+
+func (c *Conn) Close() {
+	c.once.Do(func() {
+		close(c.quit)
+		c.conn.Close()
+	})
+}
+
+// TLSのハンドシェイクで互いの鍵を確認した後、versionを送り合い、相手のversionを検証してverackを送り合う
+func (c *Conn) handshake() error {
+	c.conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer c.conn.SetDeadline(time.Time{})
+
+	if err := c.conn.Handshake(); err != nil {
+		return err
+	}
+	certs := c.conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("no peer certificate")
+	}
+	c.nodeID = NodeID(certs[0].PublicKey.(*ecdsa.PublicKey))
+
+	v, err := NewMessage(MSG_VERSION, c.node.versionPayload())
+	if err != nil {
+		return err
+	}
+	if err := WriteMessage(c.conn, c.node.networkID, v); err != nil {
+		return err
+	}
+	m, err := ReadMessage(c.conn, c.node.networkID)
+	if err != nil {
+		return err
+	}
+	if m.Command != MSG_VERSION {
+		return fmt.Errorf("expected %s, got %s", MSG_VERSION, m.Command)
+	}
+	var version VersionPayload
+	if err := m.Decode(&version); err != nil {
+		return err
+	}
+	if err := c.node.checkVersion(&version); err != nil {
+		return err
+	}
+	c.version = &version
+	if c.inbound {
+		c.claimed = version.Address
+	}
+
+	if err := WriteMessage(c.conn, c.node.networkID, &Message{Command: MSG_VERACK}); err != nil {
+		return err
+	}
+	m, err = ReadMessage(c.conn, c.node.networkID)
+	if err != nil {
+		return err
+	}
+	if m.Command != MSG_VERACK {
+		return fmt.Errorf("expected %s, got %s", MSG_VERACK, m.Command)
+	}
+	return nil
+}
+
+func (c *Conn) writeLoop() {
+	ticker := time.NewTicker(PING_INTERVAL)
+	defer ticker.Stop()
+	for {
+		var m *Message
+		select {
+		case m = <-c.send:
+		case <-ticker.C:
+			m, _ = NewMessage(MSG_PING, &PingPayload{Nonce: uint64(time.Now().UnixNano())})
+		case <-c.quit:
+			return
+		}
+		c.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+		if err := WriteMessage(c.conn, c.node.networkID, m); err != nil {
+			log.Printf("ERROR: %v", err)
+			c.Close()
+			return
+		}
+	}
+}
+
+// 接続が切れるまで受信したメッセージを処理する
+func (c *Conn) readLoop() {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(IDLE_TIMEOUT))
+		m, err := ReadMessage(c.conn, c.node.networkID)
+		if err != nil {
+			select {
+			case <-c.quit:
+			default:
+				log.Printf("action=p2p_disconnected, peer=%s, reason=%v", c, err)
+			}
+			return
+		}
+		if err := c.handle(m); err != nil {
+			log.Printf("ERROR: %s from %s: %v", m.Command, c, err)
+			return
+		}
+	}
+}
+
+func (c *Conn) handle(m *Message) error {
+	switch m.Command {
+	case MSG_PING:
+		var ping PingPayload
+		if err := m.Decode(&ping); err != nil {
+			return err
+		}
+		pong, _ := NewMessage(MSG_PONG, &ping)
+		c.Send(pong)
+		return nil
+	case MSG_PONG:
+		return nil
+	case MSG_VERSION, MSG_VERACK:
+		return fmt.Errorf("unexpected %s after handshake", m.Command)
+	case MSG_ADDR:
+		return c.node.handleAddr(c, m)
+	case MSG_HEADERS, MSG_BLOCKS:
+		// 要求していない応答は無視する
+		c.deliver(m)
+		return nil
+	default:
+		return c.node.router.dispatch(c, m)
+	}
+}
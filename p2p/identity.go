@@ -0,0 +1,149 @@
+package p2p
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// データディレクトリに保存するノードの秘密鍵
+	NODE_KEY_FILE = "node.key"
+	// 証明書は起動ごとに秘密鍵から作り直すため、有効期限は接続の検証に使わない
+	NODE_CERT_VALIDITY = 10 * 365 * 24 * time.Hour
+)
+
+var ErrNodeNotAllowed = errors.New("node is not in the allowlist")
+
+// ノードを識別する鍵
+// TCPの接続はこの鍵で自己署名した証明書を使ったTLS 1.3で暗号化し、互いに証明書を要求して相手の鍵を確認する
+// 証明書の発行者は検証せず、公開鍵から求めたノードIDで相手を識別する(許可リストで鍵を固定できる)
+type Identity struct {
+	key  *ecdsa.PrivateKey
+	cert tls.Certificate
+	id   string
+}
+
+// 公開鍵のX,Y座標を連結したもののSHA-256(16進数)
+func NodeID(pub *ecdsa.PublicKey) string {
+	return fmt.Sprintf("%x", sha256.Sum256(elliptic.Marshal(pub.Curve, pub.X, pub.Y)))
+}
+
+// dirに保存した鍵を読み込む(なければ作成して保存する)
+func LoadOrCreateIdentity(dir string) (*Identity, error) {
+	path := filepath.Join(dir, NODE_KEY_FILE)
+	var key *ecdsa.PrivateKey
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data", path)
+		}
+		if key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	case errors.Is(err, os.ErrNotExist):
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+	return NewIdentity(key)
+}
+
+func NewIdentity(key *ecdsa.PrivateKey) (*Identity, error) {
+	id := NodeID(&key.PublicKey)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: id},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(NODE_CERT_VALIDITY),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{
+		key:  key,
+		cert: tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		id:   id,
+	}, nil
+}
+
+func (i *Identity) ID() string {
+	return i.id
+}
+
+// 相手の証明書から求めたノードIDをverifyで確認するTLSの設定
+// 鍵を持っていることはTLSのハンドシェイクで証明されるため、ここでは証明書の鍵の種類だけを確認する
+func (i *Identity) tlsConfig(verify func(nodeID string) error) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{i.cert},
+		MinVersion:   tls.VersionTLS13,
+		ClientAuth:   tls.RequireAnyClientCert,
+		// 発行者の検証はVerifyPeerCertificateで置き換える
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("no peer certificate")
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+			if !ok {
+				return errors.New("peer certificate is not an ECDSA key")
+			}
+			return verify(NodeID(pub))
+		},
+	}
+}
+
+// 接続を許可するノードIDを1行に1つ書いたファイルを読み込む(#以降はコメント)
+func LoadAllowlist(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ids := make([]string, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if id := strings.ToLower(strings.TrimSpace(line)); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids, scanner.Err()
+}
@@ -0,0 +1,56 @@
+package p2p
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// 保存した鍵を読み込むと同じノードIDになる
+func TestLoadOrCreateIdentity(t *testing.T) {
+	dir := t.TempDir()
+	created, err := LoadOrCreateIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, NODE_KEY_FILE))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("key file mode %v", info.Mode().Perm())
+	}
+	loaded, err := LoadOrCreateIdentity(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ID() != created.ID() || loaded.ID() != NodeID(&created.key.PublicKey) {
+		t.Fatalf("node id %s, want %s", loaded.ID(), created.ID())
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, NODE_KEY_FILE), []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrCreateIdentity(dir); err == nil {
+		t.Fatal("loaded a broken key file")
+	}
+}
+
+func TestLoadAllowlist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "allowlist")
+	data := "# nodes\nABCDEF\n\n  012345  # node 2\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := LoadAllowlist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"abcdef", "012345"}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("ids = %v, want %v", ids, want)
+	}
+	if _, err := LoadAllowlist(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("loaded a missing allowlist")
+	}
+}
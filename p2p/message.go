@@ -0,0 +1,202 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// TCPで送受信するメッセージの形式
+//
+//	[ネットワークID 4byte][コマンド 12byte][ペイロードの長さ 4byte][チェックサム 4byte][ペイロード]
+//
+// 整数はビッグエンディアン、コマンドは末尾をNULで埋めたASCII文字列
+// チェックサムはペイロードのSHA-256を2回取った値の先頭4byte
+// ペイロードはblockとtx、headersとblocksがHTTPのAPIと同じJSON、それ以外は各Payload型のJSON
+const (
+	// 異なるネットワークのノードとは接続しない
+	NETWORK_ID_DEFAULT = 0xb10cc4a1
+	// 互換性のない変更をした場合に上げる
+	// 2からTLSで接続する
+	// 3から同期のヘッダーとブロックもTCPで要求する(HTTPでは送信元を認証できないため)
+	PROTOCOL_VERSION     = 3
+	MIN_PROTOCOL_VERSION = 3
+
+	MSG_VERSION = "version"
+	MSG_VERACK  = "verack"
+	// 持っているブロックやトランザクションのハッシュを知らせる
+	MSG_INV = "inv"
+	// invで知らされたもののうち未知のものを要求する
+	MSG_GETDATA = "getdata"
+	MSG_BLOCK   = "block"
+	MSG_TX      = "tx"
+	MSG_PING    = "ping"
+	MSG_PONG    = "pong"
+	// 知っているノードのアドレスを知らせる
+	MSG_ADDR = "addr"
+	// 同期でブロックロケーターとの分岐点からのヘッダーを要求し、headersで返す
+	MSG_GETHEADERS = "getheaders"
+	MSG_HEADERS    = "headers"
+	// 同期でハッシュを指定してブロックを要求し、blocksで返す
+	MSG_GETBLOCKS = "getblocks"
+	MSG_BLOCKS    = "blocks"
+
+	INV_TYPE_BLOCK = "block"
+	INV_TYPE_TX    = "tx"
+
+	MESSAGE_HEADER_SIZE = 24
+	COMMAND_SIZE        = 12
+	// JSONのブロックが収まる大きさ
+	MAX_MESSAGE_PAYLOAD = 8 * 1024 * 1024
+	MAX_INV_ITEMS       = 1000
+)
+
+var (
+	ErrNetworkMismatch = errors.New("network id mismatch")
+	ErrChecksum        = errors.New("message checksum mismatch")
+	ErrMessageTooLarge = errors.New("message payload too large")
+)
+
+type Message struct {
+	Command string
+	Payload []byte
+}
+
+// vをJSONにしたペイロードのメッセージ
+func NewMessage(command string, v interface{}) (*Message, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{Command: command, Payload: payload}, nil
+}
+
+func (m *Message) Decode(v interface{}) error {
+	if err := json.Unmarshal(m.Payload, v); err != nil {
+		return fmt.Errorf("%s: %v", m.Command, err)
+	}
+	return nil
+}
+
+func checksum(payload []byte) [4]byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	var c [4]byte
+	copy(c[:], second[:4])
+	return c
+}
+
+func WriteMessage(w io.Writer, networkID uint32, m *Message) error {
+	if len(m.Command) > COMMAND_SIZE {
+		return fmt.Errorf("command %q is too long", m.Command)
+	}
+	if len(m.Payload) > MAX_MESSAGE_PAYLOAD {
+		return ErrMessageTooLarge
+	}
+	var header [MESSAGE_HEADER_SIZE]byte
+	binary.BigEndian.PutUint32(header[0:4], networkID)
+	copy(header[4:4+COMMAND_SIZE], m.Command)
+	binary.BigEndian.PutUint32(header[16:20], uint32(len(m.Payload)))
+	c := checksum(m.Payload)
+	copy(header[20:24], c[:])
+	// ヘッダーとペイロードを1回で書き込む
+	if _, err := w.Write(append(header[:], m.Payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ネットワークIDと長さ、チェックサムを検証してメッセージを1件読む
+func ReadMessage(r io.Reader, networkID uint32) (*Message, error) {
+	var header [MESSAGE_HEADER_SIZE]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if id := binary.BigEndian.Uint32(header[0:4]); id != networkID {
+		return nil, fmt.Errorf("%w: %08x", ErrNetworkMismatch, id)
+	}
+	command := string(bytes.TrimRight(header[4:4+COMMAND_SIZE], "\x00"))
+	length := binary.BigEndian.Uint32(header[16:20])
+	if length > MAX_MESSAGE_PAYLOAD {
+		return nil, fmt.Errorf("%w: %s %d bytes", ErrMessageTooLarge, command, length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	if c := checksum(payload); !bytes.Equal(c[:], header[20:24]) {
+		return nil, fmt.Errorf("%w: %s", ErrChecksum, command)
+	}
+	return &Message{Command: command, Payload: payload}, nil
+}
+
+// 接続直後に互いに送る
+type VersionPayload struct {
+	NetworkID       uint32 `json:"network_id"`
+	ProtocolVersion uint32 `json:"protocol_version"`
+	// 採用中のチェーンの末尾の高さ
+	BestHeight uint64 `json:"best_height"`
+	// 送信者のHTTPのアドレス(host:port、TCPのポートはこれにP2P_PORT_OFFSETを足したもの)
+	Address string `json:"address"`
+	// 自分自身への接続を検出するための乱数
+	Nonce     uint64 `json:"nonce"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type InvItem struct {
+	Type string
+	Hash [32]byte
+}
+
+func (item *InvItem) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type string `json:"type"`
+		Hash string `json:"hash"`
+	}{
+		Type: item.Type,
+		Hash: fmt.Sprintf("%x", item.Hash),
+	})
+}
+
+func (item *InvItem) UnmarshalJSON(data []byte) error {
+	v := &struct {
+		Type string `json:"type"`
+		Hash string `json:"hash"`
+	}{}
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	h, err := hex.DecodeString(v.Hash)
+	if err != nil || len(h) != 32 {
+		return fmt.Errorf("invalid inventory hash %q", v.Hash)
+	}
+	item.Type = v.Type
+	copy(item.Hash[:], h)
+	return nil
+}
+
+// invとgetdataのペイロード
+type InvPayload struct {
+	Items []*InvItem `json:"items"`
+}
+
+// pingとpongのペイロード(pongはpingのnonceを返す)
+type PingPayload struct {
+	Nonce uint64 `json:"nonce"`
+}
+
+type AddrPayload struct {
+	Addresses []string `json:"addresses"`
+}
+
+// getheadersのペイロード
+type GetHeadersPayload struct {
+	// GET /headers?locator=と同じ形式(ハッシュの16進数をカンマで区切る)
+	Locator string `json:"locator"`
+	Limit   int    `json:"limit"`
+}
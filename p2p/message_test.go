@@ -0,0 +1,119 @@
+package p2p
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"testing"
+)
+
+// {"nonce":1}のpingの固定値(チェックサムはGoの実装とは別に計算したもの)
+const goldenPing = "b10cc4a1" + "70696e670000000000000000" + "0000000b" + "d9185183" + "7b226e6f6e6365223a317d"
+
+func encodeMessage(t *testing.T, networkID uint32, m *Message) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, networkID, m); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestWriteMessageFraming(t *testing.T) {
+	m, err := NewMessage(MSG_PING, &PingPayload{Nonce: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := hex.EncodeToString(encodeMessage(t, NETWORK_ID_DEFAULT, m)); got != goldenPing {
+		t.Fatalf("frame\n got %s\nwant %s", got, goldenPing)
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	frame, _ := hex.DecodeString(goldenPing)
+	// 連続したメッセージを1件ずつ読める
+	r := bytes.NewReader(append(append([]byte{}, frame...), frame...))
+	for i := 0; i < 2; i++ {
+		m, err := ReadMessage(r, NETWORK_ID_DEFAULT)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ping PingPayload
+		if m.Command != MSG_PING || m.Decode(&ping) != nil || ping.Nonce != 1 {
+			t.Fatalf("message %d: %s %s", i, m.Command, m.Payload)
+		}
+	}
+	if _, err := ReadMessage(r, NETWORK_ID_DEFAULT); err != io.EOF {
+		t.Fatalf("error %v at the end of the stream, want EOF", err)
+	}
+}
+
+func TestReadMessageRejectsInvalidFrames(t *testing.T) {
+	valid, _ := hex.DecodeString(goldenPing)
+	modify := func(f func(frame []byte) []byte) []byte {
+		return f(append([]byte{}, valid...))
+	}
+	tests := []struct {
+		name  string
+		frame []byte
+		want  error
+	}{
+		{"network id", modify(func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[0:4], NETWORK_ID_DEFAULT+1)
+			return b
+		}), ErrNetworkMismatch},
+		{"checksum", modify(func(b []byte) []byte {
+			b[20] ^= 0xff
+			return b
+		}), ErrChecksum},
+		{"payload", modify(func(b []byte) []byte {
+			b[len(b)-2] = '2'
+			return b
+		}), ErrChecksum},
+		{"oversize", modify(func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[16:20], MAX_MESSAGE_PAYLOAD+1)
+			return b
+		}), ErrMessageTooLarge},
+		{"truncated header", valid[:MESSAGE_HEADER_SIZE-1], io.ErrUnexpectedEOF},
+		{"truncated payload", valid[:len(valid)-1], io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadMessage(bytes.NewReader(tt.frame), NETWORK_ID_DEFAULT); !errors.Is(err, tt.want) {
+				t.Fatalf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteMessageRejectsOversize(t *testing.T) {
+	m := &Message{Command: MSG_BLOCK, Payload: make([]byte, MAX_MESSAGE_PAYLOAD+1)}
+	if err := WriteMessage(io.Discard, NETWORK_ID_DEFAULT, m); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("error %v, want %v", err, ErrMessageTooLarge)
+	}
+	m = &Message{Command: "commandistoolong"}
+	if err := WriteMessage(io.Discard, NETWORK_ID_DEFAULT, m); err == nil {
+		t.Fatal("wrote a command longer than the header field")
+	}
+}
+
+func TestInvItemJSON(t *testing.T) {
+	item := &InvItem{Type: INV_TYPE_BLOCK, Hash: [32]byte{1, 2, 3}}
+	m, err := NewMessage(MSG_INV, &InvPayload{Items: []*InvItem{item}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inv InvPayload
+	if err := m.Decode(&inv); err != nil {
+		t.Fatal(err)
+	}
+	if len(inv.Items) != 1 || *inv.Items[0] != *item {
+		t.Fatalf("decoded %+v", inv.Items)
+	}
+	bad := &Message{Command: MSG_INV, Payload: []byte(`{"items":[{"type":"block","hash":"0102"}]}`)}
+	if err := bad.Decode(&inv); err == nil {
+		t.Fatal("decoded a short hash")
+	}
+}
@@ -0,0 +1,466 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// HTTPのポートにこの値を足したポートでTCPの接続を待ち受ける
+	// ノードのアドレスはHTTPのアドレスに統一し、TCPのアドレスはそこから求める
+	P2P_PORT_OFFSET = 1000
+	// 受け付ける接続数の上限(自分から接続する数は近隣ノードの数で決まる)
+	MAX_INBOUND_PEERS = 32
+	DIAL_TIMEOUT      = 5 * time.Second
+	// 接続してきたノードが知らせたアドレスに接続し返す回数の上限
+	// 同じアドレスにはこの間隔で1回まで、全体でもこの間隔にMAX_ADDRESS_VERIFICATIONS回までとする
+	ADDRESS_VERIFICATION_INTERVAL = time.Minute
+	MAX_ADDRESS_VERIFICATIONS     = 16
+)
+
+var (
+	ErrAlreadyConnected = errors.New("already connected")
+	ErrNodeBanned       = errors.New("node is banned")
+)
+
+// HTTPのアドレス(host:port)に対応するTCPのアドレス
+func TCPAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(p+P2P_PORT_OFFSET)), nil
+}
+
+// 長時間維持するTCPの接続で他のノードとメッセージを交換する
+// 接続はノードの鍵で相互に認証したTLSで暗号化する
+// 接続直後にversionとverackを交換し、ネットワークIDとプロトコルのバージョンが一致するノードとのみ通信する
+type Node struct {
+	mux       sync.Mutex
+	networkID uint32
+	// 他のノードに知らせる自分のHTTPのアドレス
+	address  string
+	nonce    uint64
+	identity *Identity
+	// 接続を許可するノードID(nilの場合はすべて許可する)
+	allowlist map[string]bool
+	router    *Router
+	// nilの場合はアドレスを交換しない
+	manager *PeerManager
+	// ノードIDごとの接続(アドレスは接続してきたノードが偽れるため、認証したノードIDで区別する)
+	conns map[string]*Conn
+	// 接続中のHTTPのアドレス
+	dialing map[string]bool
+	// アドレスを確認するために接続し返したアドレスと、その時刻(ADDRESS_VERIFICATION_INTERVALを過ぎたものは消す)
+	verifications map[string]time.Time
+	// 採用中のチェーンの高さ(versionで知らせる)
+	bestHeight func() uint64
+	onConnect  []func(*Conn)
+}
+
+func NewNode(networkID uint32, address string, manager *PeerManager, identity *Identity) *Node {
+	var b [8]byte
+	rand.Read(b[:])
+	return &Node{
+		networkID:  networkID,
+		address:    address,
+		nonce:      binary.BigEndian.Uint64(b[:]),
+		identity:   identity,
+		router:     NewRouter(),
+		manager:    manager,
+		conns:      make(map[string]*Conn),
+		dialing:    make(map[string]bool),
+		bestHeight: func() uint64 { return 0 },
+
+		verifications: make(map[string]time.Time),
+	}
+}
+
+func (n *Node) ID() string {
+	return n.identity.ID()
+}
+
+// idsのノードとのみ接続する(限られたノードで構成するネットワーク)
+func (n *Node) SetAllowlist(ids []string) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.allowlist = make(map[string]bool, len(ids))
+	for _, id := range ids {
+		n.allowlist[id] = true
+	}
+}
+
+// 許可リストのノードとのみ接続する場合はtrue
+func (n *Node) Private() bool {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.allowlist != nil
+}
+
+// TLSのハンドシェイクで相手の鍵を確認する
+// 接続の禁止は同じホストの他のノードを巻き込まないよう、ノードIDで判定する
+func (n *Node) verifyPeer(nodeID string) error {
+	if nodeID == n.identity.ID() {
+		return errors.New("connected to self")
+	}
+	if n.manager != nil && n.manager.IsBannedNode(nodeID) {
+		return fmt.Errorf("%w: %s", ErrNodeBanned, nodeID)
+	}
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	if n.allowlist != nil && !n.allowlist[nodeID] {
+		return fmt.Errorf("%w: %s", ErrNodeNotAllowed, nodeID)
+	}
+	return nil
+}
+
+func (n *Node) Router() *Router {
+	return n.router
+}
+
+func (n *Node) SetBestHeight(f func() uint64) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.bestHeight = f
+}
+
+// 接続が確立したときに呼ばれる関数を登録する
+func (n *Node) OnConnect(f func(*Conn)) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	n.onConnect = append(n.onConnect, f)
+}
+
+// TCPの接続の待ち受けを始める
+func (n *Node) Listen() error {
+	address, err := TCPAddress(n.address)
+	if err != nil {
+		return err
+	}
+	_, port, _ := net.SplitHostPort(address)
+	l, err := net.Listen("tcp", "0.0.0.0:"+port)
+	if err != nil {
+		return err
+	}
+	log.Printf("action=p2p_listen, address=%s", l.Addr())
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				log.Printf("ERROR: %v", err)
+				return
+			}
+			go n.accept(conn)
+		}
+	}()
+	return nil
+}
+
+func (n *Node) accept(conn net.Conn) {
+	n.mux.Lock()
+	inbound := 0
+	for _, c := range n.conns {
+		if c.inbound {
+			inbound += 1
+		}
+	}
+	n.mux.Unlock()
+	if inbound >= MAX_INBOUND_PEERS {
+		conn.Close()
+		return
+	}
+	n.run(n.newConn(tls.Server(conn, n.identity.tlsConfig(n.verifyPeer)), true, ""))
+}
+
+// HTTPのアドレスがaddressのノードに接続する
+// 接続が切れるまで戻らない
+func (n *Node) Connect(address string) error {
+	n.mux.Lock()
+	if n.connByAddress(address) != nil || n.dialing[address] {
+		n.mux.Unlock()
+		return ErrAlreadyConnected
+	}
+	n.dialing[address] = true
+	n.mux.Unlock()
+
+	tcpAddress, err := TCPAddress(address)
+	var conn net.Conn
+	if err == nil {
+		conn, err = net.DialTimeout("tcp", tcpAddress, DIAL_TIMEOUT)
+	}
+	n.mux.Lock()
+	delete(n.dialing, address)
+	n.mux.Unlock()
+	if err != nil {
+		return err
+	}
+	n.run(n.newConn(tls.Client(conn, n.identity.tlsConfig(n.verifyPeer)), false, address))
+	return nil
+}
+
+// 接続していないノードに接続する
+func (n *Node) ConnectAll(addresses []string) {
+	for _, address := range addresses {
+		if address == n.address || n.Conn(address) != nil {
+			continue
+		}
+		go func(address string) {
+			if err := n.Connect(address); err != nil && !errors.Is(err, ErrAlreadyConnected) {
+				log.Printf("ERROR: %v", err)
+			}
+		}(address)
+	}
+}
+
+// 確認済みのHTTPのアドレスがaddressのノードとの接続(接続していない場合はnil)
+func (n *Node) Conn(address string) *Conn {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	return n.connByAddress(address)
+}
+
+// n.muxを保持した状態で呼び出す
+func (n *Node) connByAddress(address string) *Conn {
+	for _, c := range n.conns {
+		if c.Address() == address {
+			return c
+		}
+	}
+	return nil
+}
+
+// 接続中のすべてのノード(アドレスが未確認のものも含む)
+func (n *Node) Conns() []*Conn {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	conns := make([]*Conn, 0, len(n.conns))
+	for _, c := range n.conns {
+		conns = append(conns, c)
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].nodeID < conns[j].nodeID })
+	return conns
+}
+
+// 接続中のノードのうち、アドレスを確認したもののHTTPのアドレス
+func (n *Node) Addresses() []string {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+	addresses := make([]string, 0, len(n.conns))
+	for _, c := range n.conns {
+		if address := c.Address(); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+// exceptを除く接続中のすべてのノードに送る
+func (n *Node) Broadcast(m *Message, except *Conn) {
+	n.mux.Lock()
+	conns := make([]*Conn, 0, len(n.conns))
+	for _, c := range n.conns {
+		if c != except {
+			conns = append(conns, c)
+		}
+	}
+	n.mux.Unlock()
+	for _, c := range conns {
+		c.Send(m)
+	}
+}
+
+func (n *Node) newConn(conn *tls.Conn, inbound bool, address string) *Conn {
+	return &Conn{
+		node:    n,
+		conn:    conn,
+		inbound: inbound,
+		address: address,
+		send:    make(chan *Message, SEND_QUEUE_SIZE),
+		quit:    make(chan struct{}),
+	}
+}
+
+func (n *Node) versionPayload() *VersionPayload {
+	n.mux.Lock()
+	bestHeight := n.bestHeight
+	n.mux.Unlock()
+	return &VersionPayload{
+		NetworkID:       n.networkID,
+		ProtocolVersion: PROTOCOL_VERSION,
+		BestHeight:      bestHeight(),
+		Address:         n.address,
+		Nonce:           n.nonce,
+		Timestamp:       time.Now().Unix(),
+	}
+}
+
+func (n *Node) checkVersion(v *VersionPayload) error {
+	if v.NetworkID != n.networkID {
+		return fmt.Errorf("%w: %08x", ErrNetworkMismatch, v.NetworkID)
+	}
+	if v.ProtocolVersion < MIN_PROTOCOL_VERSION {
+		return fmt.Errorf("protocol version %d is not supported", v.ProtocolVersion)
+	}
+	if v.Nonce == n.nonce {
+		return errors.New("connected to self")
+	}
+	if _, _, err := net.SplitHostPort(v.Address); err != nil {
+		return fmt.Errorf("invalid address %q: %v", v.Address, err)
+	}
+	return nil
+}
+
+// 同じノードとの2つの接続のうち残す方
+// 向きが異なる場合(互いに同時に接続した場合や、接続し返した場合)は両端で同じ接続を選ぶよう、ノードIDの小さい側から接続した方を残す
+// 向きが同じ場合は古い方が切れかけている可能性があるため新しい方を残す
+func (n *Node) preferConn(old *Conn, c *Conn) *Conn {
+	if old.inbound == c.inbound {
+		return c
+	}
+	// cを接続した側のノードID
+	initiator := n.ID()
+	if c.inbound {
+		initiator = c.nodeID
+	}
+	if initiator <= old.nodeID && initiator <= n.ID() {
+		return c
+	}
+	return old
+}
+
+// 接続してきたノードが知らせたアドレスに接続し返し、同じノードIDが応答した場合のみアドレスを確認済みとする
+// (知らせたアドレスをそのまま使うと、他のノードのアドレスを名乗ってその評価や禁止を奪える)
+// ピアの探索と同じ検証を通らないアドレスや、他のノードIDで確認済みの接続があるアドレスには接続し返さない
+func (n *Node) verifyClaimedAddress(c *Conn) {
+	address := c.claimed
+	if address == n.address || (n.manager != nil && !n.manager.Dialable(address)) {
+		return
+	}
+	now := time.Now()
+	n.mux.Lock()
+	if other := n.connByAddress(address); other != nil && other.nodeID != c.nodeID {
+		n.mux.Unlock()
+		return
+	}
+	for a, t := range n.verifications {
+		if now.Sub(t) >= ADDRESS_VERIFICATION_INTERVAL {
+			delete(n.verifications, a)
+		}
+	}
+	if _, ok := n.verifications[address]; ok || len(n.verifications) >= MAX_ADDRESS_VERIFICATIONS {
+		n.mux.Unlock()
+		log.Printf("action=verify_address_skip, peer=%s", c)
+		return
+	}
+	n.verifications[address] = now
+	n.mux.Unlock()
+
+	if err := n.Connect(address); err != nil && !errors.Is(err, ErrAlreadyConnected) {
+		log.Printf("action=verify_address, peer=%s, error=%v", c, err)
+	}
+}
+
+// ハンドシェイクを行い、接続が切れるまでメッセージを処理する
+func (n *Node) run(c *Conn) {
+	defer c.Close()
+	if err := c.handshake(); err != nil {
+		log.Printf("ERROR: handshake with %s: %v", c.conn.RemoteAddr(), err)
+		return
+	}
+	n.mux.Lock()
+	if old := n.conns[c.nodeID]; old != nil {
+		keep, drop := old, c
+		if n.preferConn(old, c) == c {
+			keep, drop = c, old
+		}
+		// 捨てる方で確認したアドレスは残す方に引き継ぐ
+		if keep.Address() == "" && drop.Address() != "" {
+			keep.setAddress(drop.Address())
+			log.Printf("action=p2p_address_verified, peer=%s, node_id=%s", keep, keep.nodeID)
+		}
+		if keep == old {
+			n.mux.Unlock()
+			if n.manager != nil && !c.inbound {
+				n.manager.Good(c.address)
+				n.manager.SetNodeID(c.address, c.nodeID)
+			}
+			return
+		}
+		old.Close()
+	}
+	n.conns[c.nodeID] = c
+	onConnect := append([]func(*Conn){}, n.onConnect...)
+	n.mux.Unlock()
+	defer func() {
+		n.mux.Lock()
+		if n.conns[c.nodeID] == c {
+			delete(n.conns, c.nodeID)
+		}
+		n.mux.Unlock()
+	}()
+	log.Printf("action=p2p_connected, peer=%s, node_id=%s, inbound=%t, best_height=%d", c, c.nodeID, c.inbound, c.BestHeight())
+
+	go c.writeLoop()
+	if c.Address() == "" {
+		go n.verifyClaimedAddress(c)
+	}
+	if n.manager != nil {
+		if !c.inbound {
+			n.manager.Good(c.address)
+			n.manager.SetNodeID(c.address, c.nodeID)
+		}
+		shared := n.manager.SharedAddresses()
+		addresses := make([]string, 0, len(shared))
+		for _, pa := range shared {
+			addresses = append(addresses, pa.Address)
+		}
+		if m, err := NewMessage(MSG_ADDR, &AddrPayload{Addresses: addresses}); err == nil {
+			c.Send(m)
+		}
+	}
+	for _, f := range onConnect {
+		f(c)
+	}
+	c.readLoop()
+}
+
+// 接続中のピアが不正なデータを送ってきた
+// スコアはノードIDごとに数え(アドレスを確認済みのピアはアドレスのスコアも下げる)、禁止した場合は接続を切る
+func (n *Node) Misbehaving(c *Conn, penalty int, reason string) {
+	if n.manager == nil {
+		return
+	}
+	if n.manager.MisbehavingNode(c.nodeID, c.Address(), penalty, reason) {
+		c.Close()
+	}
+}
+
+func (n *Node) handleAddr(c *Conn, m *Message) error {
+	var addr AddrPayload
+	if err := m.Decode(&addr); err != nil {
+		return err
+	}
+	if len(addr.Addresses) > MAX_SHARED_ADDRESSES {
+		return fmt.Errorf("too many addresses: %d", len(addr.Addresses))
+	}
+	if n.manager != nil {
+		for _, address := range addr.Addresses {
+			n.manager.AddAddress(address, c.Address())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package p2p
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"net"
+	"testing"
+)
+
+func newTestNode(t *testing.T, address string, manager *PeerManager) *Node {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity, err := NewIdentity(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewNode(NETWORK_ID_DEFAULT, address, manager, identity)
+}
+
+// clientからserverにTLSで接続し、両端でハンドシェイクを行う
+func handshakeTestNodes(t *testing.T, client *Node, server *Node) (*Conn, *Conn, error, error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := client.newConn(tls.Client(raw, client.identity.tlsConfig(client.verifyPeer)), false, server.address)
+	raw2, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	in := server.newConn(tls.Server(raw2, server.identity.tlsConfig(server.verifyPeer)), true, "")
+	errs := make(chan error, 1)
+	go func() {
+		errs <- in.handshake()
+	}()
+	outErr := out.handshake()
+	if outErr != nil {
+		// 相手が拒否した場合にサーバー側の読み込みを終わらせる
+		out.Close()
+	}
+	inErr := <-errs
+	out.Close()
+	in.Close()
+	return out, in, outErr, inErr
+}
+
+func TestTCPAddress(t *testing.T) {
+	got, err := TCPAddress("127.0.0.1:5000")
+	if err != nil || got != "127.0.0.1:6000" {
+		t.Fatalf("TCPAddress = %q, %v", got, err)
+	}
+	for _, address := range []string{"127.0.0.1", "127.0.0.1:http"} {
+		if _, err := TCPAddress(address); err == nil {
+			t.Fatalf("TCPAddress(%q) succeeded", address)
+		}
+	}
+}
+
+func TestCheckVersion(t *testing.T) {
+	n := newTestNode(t, "127.0.0.1:5000", nil)
+	valid := func() *VersionPayload {
+		v := n.versionPayload()
+		v.Nonce = n.nonce + 1
+		v.Address = "127.0.0.1:5001"
+		return v
+	}
+	if err := n.checkVersion(valid()); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		modify func(v *VersionPayload)
+	}{
+		{"network id", func(v *VersionPayload) { v.NetworkID += 1 }},
+		{"protocol version", func(v *VersionPayload) { v.ProtocolVersion = MIN_PROTOCOL_VERSION - 1 }},
+		{"self", func(v *VersionPayload) { v.Nonce = n.nonce }},
+		{"address", func(v *VersionPayload) { v.Address = "127.0.0.1" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := valid()
+			tt.modify(v)
+			if err := n.checkVersion(v); err == nil {
+				t.Fatal("invalid version accepted")
+			}
+		})
+	}
+	v := valid()
+	v.NetworkID += 1
+	if err := n.checkVersion(v); !errors.Is(err, ErrNetworkMismatch) {
+		t.Fatalf("error %v, want %v", err, ErrNetworkMismatch)
+	}
+}
+
+// 同じノードとの接続が2つある場合、両端で同じ接続を残す
+func TestPreferConn(t *testing.T) {
+	a := newTestNode(t, "127.0.0.1:5000", nil)
+	b := newTestNode(t, "127.0.0.1:5001", nil)
+	if a.ID() > b.ID() {
+		a, b = b, a
+	}
+	// aからbへの接続と、bからaへの接続
+	aOut := &Conn{node: a, inbound: false, nodeID: b.ID()}
+	aIn := &Conn{node: a, inbound: true, nodeID: b.ID()}
+	bIn := &Conn{node: b, inbound: true, nodeID: a.ID()}
+	bOut := &Conn{node: b, inbound: false, nodeID: a.ID()}
+	// ノードIDの小さいaから接続した方を残す
+	if a.preferConn(aIn, aOut) != aOut || a.preferConn(aOut, aIn) != aOut {
+		t.Fatal("a did not keep its outbound connection")
+	}
+	if b.preferConn(bOut, bIn) != bIn || b.preferConn(bIn, bOut) != bIn {
+		t.Fatal("b did not keep the connection from a")
+	}
+	// 向きが同じ場合は新しい方を残す
+	newer := &Conn{node: a, inbound: false, nodeID: b.ID()}
+	if a.preferConn(aOut, newer) != newer {
+		t.Fatal("a did not keep the newer connection")
+	}
+}
+
+// TLSで互いの鍵を確認し、証明書の公開鍵から求めたノードIDで相手を識別する
+func TestHandshake(t *testing.T) {
+	a := newTestNode(t, "127.0.0.1:5000", nil)
+	b := newTestNode(t, "127.0.0.1:5001", nil)
+	out, in, outErr, inErr := handshakeTestNodes(t, a, b)
+	if outErr != nil || inErr != nil {
+		t.Fatalf("handshake: %v, %v", outErr, inErr)
+	}
+	if out.NodeID() != b.ID() || in.NodeID() != a.ID() {
+		t.Fatalf("node ids %s, %s", out.NodeID(), in.NodeID())
+	}
+	// 接続してきたノードのアドレスは未確認
+	if in.Address() != "" || in.claimed != "127.0.0.1:5000" {
+		t.Fatalf("inbound address %q, claimed %q", in.Address(), in.claimed)
+	}
+}
+
+func TestHandshakeAllowlist(t *testing.T) {
+	a := newTestNode(t, "127.0.0.1:5000", nil)
+	b := newTestNode(t, "127.0.0.1:5001", nil)
+	c := newTestNode(t, "127.0.0.1:5002", nil)
+	b.SetAllowlist([]string{c.ID()})
+	if !b.Private() || a.Private() {
+		t.Fatal("Private does not reflect the allowlist")
+	}
+	if _, _, outErr, inErr := handshakeTestNodes(t, a, b); outErr == nil || !errors.Is(inErr, ErrNodeNotAllowed) {
+		t.Fatalf("node outside the allowlist connected: %v, %v", outErr, inErr)
+	}
+	if _, _, outErr, inErr := handshakeTestNodes(t, c, b); outErr != nil || inErr != nil {
+		t.Fatalf("node in the allowlist rejected: %v, %v", outErr, inErr)
+	}
+}
+
+// 禁止したノードはアドレスを変えても接続できない
+func TestHandshakeBannedNode(t *testing.T) {
+	pm := NewPeerManager("127.0.0.1:5001", nil, 0)
+	a := newTestNode(t, "127.0.0.1:5000", nil)
+	b := newTestNode(t, "127.0.0.1:5001", pm)
+	if !pm.MisbehavingNode(a.ID(), "", PENALTY_INVALID_CHAIN, "invalid chain") {
+		t.Fatal("node not banned after an invalid chain")
+	}
+	a.address = "127.0.0.1:5100"
+	if _, _, _, inErr := handshakeTestNodes(t, a, b); !errors.Is(inErr, ErrNodeBanned) {
+		t.Fatalf("error %v, want %v", inErr, ErrNodeBanned)
+	}
+}
+
+// Requestは待っているコマンドの応答だけを受け取る
+func TestConnRequest(t *testing.T) {
+	c := &Conn{send: make(chan *Message, SEND_QUEUE_SIZE), quit: make(chan struct{})}
+	go func() {
+		m := <-c.send
+		if c.deliver(&Message{Command: MSG_BLOCKS}) {
+			t.Error("delivered a reply to another command")
+		}
+		c.deliver(&Message{Command: MSG_HEADERS, Payload: m.Payload})
+	}()
+	reply, err := c.Request(&Message{Command: MSG_GETHEADERS, Payload: []byte("{}")}, MSG_HEADERS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Command != MSG_HEADERS || string(reply.Payload) != "{}" {
+		t.Fatalf("reply %s %s", reply.Command, reply.Payload)
+	}
+	// 要求していない応答は受け取らない
+	if c.deliver(&Message{Command: MSG_HEADERS}) {
+		t.Fatal("delivered an unrequested reply")
+	}
+}
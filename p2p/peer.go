@@ -0,0 +1,535 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// ピアの探索方法
+	// gossipはシードノードから始めてGET /peersでアドレスを交換し、localは同じサブネットのポートを走査する
+	DISCOVERY_GOSSIP = "gossip"
+	DISCOVERY_LOCAL  = "local"
+
+	MAX_PEERS_DEFAULT = 8
+	// アドレス帳に保持するアドレスの上限
+	MAX_ADDRESS_BOOK_SIZE = 1000
+	// GET /peersで返すアドレスの上限
+	MAX_SHARED_ADDRESSES = 100
+	// 連続して接続に失敗した場合にアドレス帳から消す回数(シードノードは消さない)
+	MAX_PEER_FAILURES = 10
+	// スコアの上限と、これ以下になると接続を禁止する値
+	MAX_PEER_SCORE     = 100
+	PEER_BAN_THRESHOLD = -100
+	PEER_BAN_DURATION  = 24 * time.Hour
+	// 不正なデータを送ってきたピアのスコアから引く値
+	// チェーンの検証に失敗した場合は即座に禁止し、ヘッダーと一致しないブロックは付け替え中の可能性もあるため小さくする
+	PENALTY_INVALID_CHAIN    = 200
+	PENALTY_UNEXPECTED_BLOCK = 20
+
+	PEER_REQUEST_TIMEOUT = 5 * time.Second
+	// Refreshで同時に接続を試みるアドレス数と、1回のRefreshで試みるアドレス数の上限
+	REFRESH_DIAL_BATCH   = 8
+	MAX_REFRESH_ATTEMPTS = 32
+	// GET /peers?addr=で知らされ、応答を確認中のアドレス数の上限
+	MAX_PENDING_ADDRESSES = 16
+)
+
+// アドレス帳の1件
+type PeerAddress struct {
+	// host:port
+	Address string
+	// TCPで接続して確認したノードID(未確認の場合は空)
+	NodeID string
+	// 最後に応答があった時刻と、最後に接続を試みた時刻
+	LastSeen    time.Time
+	LastAttempt time.Time
+	// 連続して接続に失敗した回数
+	Failures int
+	// 正しい応答で上がり、不正なデータを送ると下がる
+	Score       int
+	BannedUntil time.Time
+	// このアドレスを教えたピア(シードノードや自分から接続してきたノードは空)
+	Source string
+}
+
+func (pa *PeerAddress) banned(now time.Time) bool {
+	return now.Before(pa.BannedUntil)
+}
+
+func (pa *PeerAddress) MarshalJSON() ([]byte, error) {
+	var lastSeen int64
+	if !pa.LastSeen.IsZero() {
+		lastSeen = pa.LastSeen.Unix()
+	}
+	return json.Marshal(struct {
+		Address  string `json:"address"`
+		NodeID   string `json:"node_id,omitempty"`
+		LastSeen int64  `json:"last_seen"`
+		Failures int    `json:"failures"`
+		Score    int    `json:"score"`
+	}{
+		Address:  pa.Address,
+		NodeID:   pa.NodeID,
+		LastSeen: lastSeen,
+		Failures: pa.Failures,
+		Score:    pa.Score,
+	})
+}
+
+// GET /peersのレスポンス
+type PeersResponse struct {
+	// 自分のノードID(TCPで通信しない場合は空)
+	NodeID string `json:"node_id,omitempty"`
+	// 他のノードに教えるアドレス
+	Peers []*PeerAddress `json:"peers"`
+	// 通信中のピア
+	Connected []string `json:"connected"`
+	// TCPで接続中のノード
+	Streams []string `json:"streams"`
+}
+
+// 他のノードのレスポンスはアドレスのみ使う(1回の交換でMAX_SHARED_ADDRESSES件まで)
+type peersResponse struct {
+	Peers []struct {
+		Address string `json:"address"`
+	} `json:"peers"`
+}
+
+// 接続するピアを管理する
+// シードノードとピアから教わったアドレスをアドレス帳に保持し、スコアの高い順に最大maxPeers件と通信する
+// 接続の禁止はアドレス(host:port)とノードIDごとに行い、同じホストの他のノードは禁止しない
+// アドレス帳はメモリ上のみで、再起動するとシードノードから探索し直す
+type PeerManager struct {
+	mux sync.Mutex
+	// 他のノードに知らせる自分のアドレス(host:port)
+	self     string
+	seeds    []string
+	maxPeers int
+	book     map[string]*PeerAddress
+	// 通信中のピア
+	active map[string]bool
+	// TCPで認証したノードIDごとのスコアと、接続を禁止する期限
+	nodeScores  map[string]int
+	bannedNodes map[string]time.Time
+	// GET /peers?addr=で知らされ、応答を確認中のアドレス
+	pending map[string]bool
+	client  *http.Client
+}
+
+func NewPeerManager(self string, seeds []string, maxPeers int) *PeerManager {
+	if maxPeers <= 0 {
+		maxPeers = MAX_PEERS_DEFAULT
+	}
+	pm := &PeerManager{
+		self:        self,
+		maxPeers:    maxPeers,
+		book:        make(map[string]*PeerAddress),
+		active:      make(map[string]bool),
+		nodeScores:  make(map[string]int),
+		bannedNodes: make(map[string]time.Time),
+		pending:     make(map[string]bool),
+		client:      &http.Client{Timeout: PEER_REQUEST_TIMEOUT},
+	}
+	for _, s := range seeds {
+		if s != "" && s != self {
+			pm.seeds = append(pm.seeds, s)
+			pm.addAddress(s, "")
+		}
+	}
+	return pm
+}
+
+func (pm *PeerManager) Self() string {
+	return pm.self
+}
+
+// host:portの形式で、自分自身ではないアドレスのみ受け付ける
+func (pm *PeerManager) validAddress(address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || host == "" || port == "" {
+		return false
+	}
+	return address != pm.self
+}
+
+// 接続してきたノードが知らせたアドレスに接続し返してよい場合はtrue
+// ピアの探索と同じ検証を行い、接続を禁止しているアドレスとノードは除く
+func (pm *PeerManager) Dialable(address string) bool {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	if !pm.validAddress(address) {
+		return false
+	}
+	pa, ok := pm.book[address]
+	if !ok {
+		return true
+	}
+	now := time.Now()
+	return !pa.banned(now) && (pa.NodeID == "" || !pm.isBannedNode(pa.NodeID, now))
+}
+
+// pm.muxを保持した状態で呼び出す
+func (pm *PeerManager) addAddress(address string, source string) *PeerAddress {
+	if !pm.validAddress(address) {
+		return nil
+	}
+	if pa, ok := pm.book[address]; ok {
+		return pa
+	}
+	if len(pm.book) >= MAX_ADDRESS_BOOK_SIZE && !pm.evictStale() {
+		return nil
+	}
+	pa := &PeerAddress{Address: address, Source: source}
+	pm.book[address] = pa
+	return pa
+}
+
+// アドレス帳が一杯の場合に、最も古いアドレスを1件消す(消せるものがない場合はfalse)
+// 応答があったことのないものを優先し、次に最後に応答があった時刻が古いものを消す
+// シードノード、通信中のピア、接続を禁止しているアドレス(禁止を忘れないため)は消さない
+// pm.muxを保持した状態で呼び出す
+func (pm *PeerManager) evictStale() bool {
+	now := time.Now()
+	var stalest *PeerAddress
+	for address, pa := range pm.book {
+		if pm.active[address] || pa.banned(now) || pm.isSeed(address) {
+			continue
+		}
+		if stalest == nil ||
+			(pa.LastSeen.IsZero() && !stalest.LastSeen.IsZero()) ||
+			(pa.LastSeen.IsZero() == stalest.LastSeen.IsZero() && pa.LastSeen.Before(stalest.LastSeen)) {
+			stalest = pa
+		}
+	}
+	if stalest == nil {
+		return false
+	}
+	delete(pm.book, stalest.Address)
+	return true
+}
+
+// アドレス帳に追加する(他のノードから教わったアドレスや、接続して確認したノードのアドレス)
+func (pm *PeerManager) AddAddress(address string, source string) {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	pm.addAddress(address, source)
+}
+
+// 他のノードが自分のアドレスとして知らせたaddressに問い合わせ、応答があればアドレス帳に加える
+// 知らせた側を認証できないため、確認せずに加えると存在しないアドレスでアドレス帳を埋められる
+// 確認はバックグラウンドで行い、確認中のアドレスがMAX_PENDING_ADDRESSES件ある場合は無視する
+func (pm *PeerManager) VerifyAddress(address string) {
+	pm.mux.Lock()
+	_, known := pm.book[address]
+	if known || pm.pending[address] || len(pm.pending) >= MAX_PENDING_ADDRESSES || !pm.validAddress(address) {
+		pm.mux.Unlock()
+		return
+	}
+	pm.pending[address] = true
+	pm.mux.Unlock()
+	go func() {
+		defer func() {
+			pm.mux.Lock()
+			delete(pm.pending, address)
+			pm.mux.Unlock()
+		}()
+		if _, err := pm.fetchPeers(address, false); err != nil {
+			log.Printf("action=verify_address, address=%s, error=%v", address, err)
+			return
+		}
+		pm.AddAddress(address, "")
+		pm.Good(address)
+	}()
+}
+
+// 通信中のピアのアドレス
+func (pm *PeerManager) Peers() []string {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	peers := make([]string, 0, len(pm.active))
+	for address := range pm.active {
+		peers = append(peers, address)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// 他のノードに教えるアドレス(応答があったことのある、接続を禁止していないもの)
+func (pm *PeerManager) SharedAddresses() []*PeerAddress {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	now := time.Now()
+	addresses := make([]*PeerAddress, 0)
+	for _, pa := range pm.book {
+		if pa.LastSeen.IsZero() || pa.banned(now) {
+			continue
+		}
+		c := *pa
+		addresses = append(addresses, &c)
+	}
+	// 最近応答があったものを優先する
+	sort.Slice(addresses, func(i, j int) bool {
+		return addresses[i].LastSeen.After(addresses[j].LastSeen)
+	})
+	if len(addresses) > MAX_SHARED_ADDRESSES {
+		addresses = addresses[:MAX_SHARED_ADDRESSES]
+	}
+	return addresses
+}
+
+// ピアから正しい応答があった
+func (pm *PeerManager) Good(address string) {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	pa := pm.addAddress(address, "")
+	if pa == nil {
+		return
+	}
+	pa.LastSeen = time.Now()
+	pa.Failures = 0
+	if pa.Score < MAX_PEER_SCORE {
+		pa.Score += 1
+	}
+}
+
+// ピアに接続できなかった(通信中のピアからは外す)
+func (pm *PeerManager) Failed(address string) {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	delete(pm.active, address)
+	pa, ok := pm.book[address]
+	if !ok {
+		return
+	}
+	pa.Failures += 1
+	if pa.Failures >= MAX_PEER_FAILURES && !pm.isSeed(address) {
+		delete(pm.book, address)
+	}
+}
+
+// ピアが不正なデータを送ってきた
+// スコアがPEER_BAN_THRESHOLD以下になるとPEER_BAN_DURATIONの間は接続しない
+func (pm *PeerManager) Misbehaving(address string, penalty int, reason string) {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	pm.misbehaving(address, penalty, reason)
+}
+
+// pm.muxを保持した状態で呼び出す
+func (pm *PeerManager) misbehaving(address string, penalty int, reason string) {
+	pa, ok := pm.book[address]
+	if !ok {
+		return
+	}
+	pa.Score -= penalty
+	log.Printf("action=peer_misbehaving, peer=%s, score=%d, reason=%s", address, pa.Score, reason)
+	if pa.Score <= PEER_BAN_THRESHOLD {
+		pa.BannedUntil = time.Now().Add(PEER_BAN_DURATION)
+		delete(pm.active, address)
+		log.Printf("action=peer_banned, peer=%s, until=%s", address, pa.BannedUntil.Format(time.RFC3339))
+	}
+}
+
+// TCPで認証したノードが不正なデータを送ってきた
+// スコアはノードIDごとに数え、確認済みのアドレスがあればそのアドレスのスコアも下げる
+// 禁止した場合はtrueを返す
+func (pm *PeerManager) MisbehavingNode(nodeID string, address string, penalty int, reason string) bool {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	if address != "" {
+		pm.misbehaving(address, penalty, reason)
+	}
+	now := time.Now()
+	if _, ok := pm.nodeScores[nodeID]; !ok && len(pm.nodeScores) >= MAX_ADDRESS_BOOK_SIZE {
+		// 一杯の場合は禁止の期限が過ぎたものと、スコアが残っているものから消す
+		for id := range pm.nodeScores {
+			if until, ok := pm.bannedNodes[id]; !ok || !now.Before(until) {
+				delete(pm.nodeScores, id)
+				delete(pm.bannedNodes, id)
+				break
+			}
+		}
+	}
+	score := pm.nodeScores[nodeID] - penalty
+	pm.nodeScores[nodeID] = score
+	log.Printf("action=node_misbehaving, node_id=%s, score=%d, reason=%s", nodeID, score, reason)
+	if score > PEER_BAN_THRESHOLD {
+		return false
+	}
+	pm.bannedNodes[nodeID] = now.Add(PEER_BAN_DURATION)
+	log.Printf("action=node_banned, node_id=%s, until=%s", nodeID, pm.bannedNodes[nodeID].Format(time.RFC3339))
+	return true
+}
+
+// ノードIDの接続を禁止しているか
+func (pm *PeerManager) IsBannedNode(nodeID string) bool {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	return pm.isBannedNode(nodeID, time.Now())
+}
+
+// pm.muxを保持した状態で呼び出す
+func (pm *PeerManager) isBannedNode(nodeID string, now time.Time) bool {
+	until, ok := pm.bannedNodes[nodeID]
+	return ok && now.Before(until)
+}
+
+// TCPで接続して確認したaddressのノードID
+func (pm *PeerManager) SetNodeID(address string, nodeID string) {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	if pa := pm.book[address]; pa != nil {
+		pa.NodeID = nodeID
+	}
+}
+
+func (pm *PeerManager) isSeed(address string) bool {
+	for _, s := range pm.seeds {
+		if s == address {
+			return true
+		}
+	}
+	return false
+}
+
+// ピアにGET /peersを送る(announceの場合は自分のアドレスも知らせ、相手のアドレス帳に加えてもらう)
+func (pm *PeerManager) fetchPeers(address string, announce bool) (*peersResponse, error) {
+	endpoint := fmt.Sprintf("http://%s/peers", address)
+	if announce {
+		endpoint += "?addr=" + url.QueryEscape(pm.self)
+	}
+	resp, err := pm.client.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: status %d", endpoint, resp.StatusCode)
+	}
+	var pr peersResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+		return nil, err
+	}
+	return &pr, nil
+}
+
+// ピアとアドレスを交換し、教わったアドレスをMAX_SHARED_ADDRESSES件までアドレス帳に加える
+func (pm *PeerManager) exchange(address string) error {
+	pr, err := pm.fetchPeers(address, true)
+	if err != nil {
+		return err
+	}
+	peers := pr.Peers
+	if len(peers) > MAX_SHARED_ADDRESSES {
+		peers = peers[:MAX_SHARED_ADDRESSES]
+	}
+	pm.mux.Lock()
+	for _, p := range peers {
+		pm.addAddress(p.Address, address)
+	}
+	pm.mux.Unlock()
+	return nil
+}
+
+// 接続を試みるアドレス(接続を禁止しておらず、通信中でないもの)をスコアの高い順に返す
+func (pm *PeerManager) candidates() []string {
+	pm.mux.Lock()
+	defer pm.mux.Unlock()
+	now := time.Now()
+	list := make([]*PeerAddress, 0)
+	for address, pa := range pm.book {
+		if pm.active[address] || pa.banned(now) || (pa.NodeID != "" && pm.isBannedNode(pa.NodeID, now)) {
+			continue
+		}
+		list = append(list, pa)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Score != list[j].Score {
+			return list[i].Score > list[j].Score
+		}
+		if list[i].Failures != list[j].Failures {
+			return list[i].Failures < list[j].Failures
+		}
+		return list[i].LastSeen.After(list[j].LastSeen)
+	})
+	addresses := make([]string, 0, len(list))
+	for _, pa := range list {
+		addresses = append(addresses, pa.Address)
+	}
+	return addresses
+}
+
+// 通信中のピアとアドレスを交換し、応答しないピアを外して最大maxPeers件まで補充する
+// 応答しないアドレスでRefreshが長引かないよう、REFRESH_DIAL_BATCH件ずつ並列に問い合わせ、
+// 1回にMAX_REFRESH_ATTEMPTS件まで試みる
+func (pm *PeerManager) Refresh() {
+	var wg sync.WaitGroup
+	for _, address := range pm.Peers() {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			if err := pm.exchange(address); err != nil {
+				log.Printf("ERROR: %v", err)
+				pm.Failed(address)
+				return
+			}
+			pm.Good(address)
+		}(address)
+	}
+	wg.Wait()
+
+	candidates := pm.candidates()
+	if len(candidates) > MAX_REFRESH_ATTEMPTS {
+		candidates = candidates[:MAX_REFRESH_ATTEMPTS]
+	}
+	for len(candidates) > 0 {
+		pm.mux.Lock()
+		need := pm.maxPeers - len(pm.active)
+		pm.mux.Unlock()
+		if need <= 0 {
+			return
+		}
+		batch := need
+		if batch > REFRESH_DIAL_BATCH {
+			batch = REFRESH_DIAL_BATCH
+		}
+		if batch > len(candidates) {
+			batch = len(candidates)
+		}
+		for _, address := range candidates[:batch] {
+			pm.mux.Lock()
+			if pa, ok := pm.book[address]; ok {
+				pa.LastAttempt = time.Now()
+			}
+			pm.mux.Unlock()
+			wg.Add(1)
+			go func(address string) {
+				defer wg.Done()
+				if err := pm.exchange(address); err != nil {
+					pm.Failed(address)
+					return
+				}
+				pm.Good(address)
+				pm.mux.Lock()
+				full := len(pm.active) >= pm.maxPeers
+				if !full {
+					pm.active[address] = true
+				}
+				pm.mux.Unlock()
+				if !full {
+					log.Printf("action=peer_connected, peer=%s", address)
+				}
+			}(address)
+		}
+		wg.Wait()
+		candidates = candidates[batch:]
+	}
+}
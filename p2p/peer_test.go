@@ -0,0 +1,245 @@
+package p2p
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAddAddress(t *testing.T) {
+	pm := NewPeerManager("127.0.0.1:5000", []string{"127.0.0.1:5001", "127.0.0.1:5000"}, 0)
+	if pm.maxPeers != MAX_PEERS_DEFAULT {
+		t.Fatalf("maxPeers = %d, want %d", pm.maxPeers, MAX_PEERS_DEFAULT)
+	}
+	// 自分自身はシードノードに含めない
+	if len(pm.seeds) != 1 || pm.seeds[0] != "127.0.0.1:5001" {
+		t.Fatalf("seeds = %v", pm.seeds)
+	}
+	tests := []struct {
+		name    string
+		address string
+		want    bool
+	}{
+		{"valid", "127.0.0.1:5002", true},
+		{"self", "127.0.0.1:5000", false},
+		{"no port", "127.0.0.1", false},
+		{"empty host", ":5002", false},
+		{"empty port", "127.0.0.1:", false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pm.AddAddress(tt.address, "127.0.0.1:5001")
+			if _, ok := pm.book[tt.address]; ok != tt.want {
+				t.Fatalf("address %q in book = %v, want %v", tt.address, ok, tt.want)
+			}
+		})
+	}
+}
+
+// 応答したことのないアドレスから消し、シードノードと通信中のピアは消さない
+func TestEvictStale(t *testing.T) {
+	pm := NewPeerManager("127.0.0.1:5000", []string{"127.0.0.1:5001"}, 0)
+	pm.book["127.0.0.1:5001"].LastSeen = time.Now().Add(-time.Hour)
+	pm.AddAddress("127.0.0.1:5002", "")
+	pm.book["127.0.0.1:5002"].LastSeen = time.Now().Add(-time.Hour)
+	pm.active["127.0.0.1:5002"] = true
+	pm.AddAddress("127.0.0.1:5003", "")
+	pm.book["127.0.0.1:5003"].LastSeen = time.Now().Add(-time.Minute)
+	pm.AddAddress("127.0.0.1:5004", "")
+	pm.book["127.0.0.1:5004"].LastSeen = time.Now().Add(-2 * time.Minute)
+	pm.AddAddress("127.0.0.1:5005", "")
+
+	for _, want := range []string{"127.0.0.1:5005", "127.0.0.1:5004", "127.0.0.1:5003"} {
+		if !pm.evictStale() {
+			t.Fatalf("no address evicted, want %s", want)
+		}
+		if _, ok := pm.book[want]; ok {
+			t.Fatalf("%s was not evicted", want)
+		}
+	}
+	if pm.evictStale() {
+		t.Fatal("seed or active peer evicted")
+	}
+	if len(pm.book) != 2 {
+		t.Fatalf("book size = %d, want 2", len(pm.book))
+	}
+}
+
+// アドレス帳が一杯で消せるアドレスがない場合は追加しない
+func TestAddAddressBookFull(t *testing.T) {
+	pm := NewPeerManager("127.0.0.1:5000", nil, 0)
+	for i := 0; i < MAX_ADDRESS_BOOK_SIZE; i++ {
+		address := fmt.Sprintf("10.0.%d.%d:5000", i/256, i%256)
+		pm.AddAddress(address, "")
+		pm.active[address] = true
+	}
+	pm.AddAddress("127.0.0.1:5001", "")
+	if _, ok := pm.book["127.0.0.1:5001"]; ok {
+		t.Fatal("address added to a full book")
+	}
+	delete(pm.active, "10.0.0.0:5000")
+	pm.AddAddress("127.0.0.1:5001", "")
+	if _, ok := pm.book["127.0.0.1:5001"]; !ok {
+		t.Fatal("address not added after evicting a stale one")
+	}
+	if _, ok := pm.book["10.0.0.0:5000"]; ok {
+		t.Fatal("inactive address was not evicted")
+	}
+}
+
+func TestMisbehavingBansPeer(t *testing.T) {
+	pm := NewPeerManager("127.0.0.1:5000", []string{"127.0.0.1:5001"}, 0)
+	for _, address := range []string{"127.0.0.1:5001", "127.0.0.1:5002"} {
+		pm.AddAddress(address, "")
+		pm.Good(address)
+	}
+	pm.active["127.0.0.1:5002"] = true
+
+	// ヘッダーと一致しないブロック程度では禁止しない
+	pm.Misbehaving("127.0.0.1:5002", PENALTY_UNEXPECTED_BLOCK, "unexpected block")
+	if pm.book["127.0.0.1:5002"].banned(time.Now()) || !pm.active["127.0.0.1:5002"] {
+		t.Fatal("peer banned after a small penalty")
+	}
+
+	pm.Misbehaving("127.0.0.1:5002", PENALTY_INVALID_CHAIN, "invalid chain")
+	if !pm.book["127.0.0.1:5002"].banned(time.Now()) {
+		t.Fatal("peer not banned after an invalid chain")
+	}
+	if pm.active["127.0.0.1:5002"] {
+		t.Fatal("banned peer is still active")
+	}
+	for _, pa := range pm.SharedAddresses() {
+		if pa.Address == "127.0.0.1:5002" {
+			t.Fatal("banned address shared")
+		}
+	}
+	for _, address := range pm.candidates() {
+		if address == "127.0.0.1:5002" {
+			t.Fatal("banned address is a candidate")
+		}
+	}
+	// 禁止したアドレスはアドレス帳から消さない(再度教わっても禁止を忘れないため)
+	pm.AddAddress("127.0.0.1:5002", "127.0.0.1:5001")
+	if !pm.book["127.0.0.1:5002"].banned(time.Now()) {
+		t.Fatal("ban forgotten after the address was shared again")
+	}
+}
+
+func TestFailedRemovesAddress(t *testing.T) {
+	pm := NewPeerManager("127.0.0.1:5000", []string{"127.0.0.1:5001"}, 0)
+	pm.AddAddress("127.0.0.1:5002", "127.0.0.1:5001")
+	pm.active["127.0.0.1:5002"] = true
+	for i := 0; i < MAX_PEER_FAILURES; i++ {
+		if _, ok := pm.book["127.0.0.1:5002"]; !ok {
+			t.Fatalf("address removed after %d failures", i)
+		}
+		pm.Failed("127.0.0.1:5001")
+		pm.Failed("127.0.0.1:5002")
+	}
+	if pm.active["127.0.0.1:5002"] {
+		t.Fatal("failed peer is still active")
+	}
+	if _, ok := pm.book["127.0.0.1:5002"]; ok {
+		t.Fatalf("address kept after %d failures", MAX_PEER_FAILURES)
+	}
+	if _, ok := pm.book["127.0.0.1:5001"]; !ok {
+		t.Fatal("seed removed")
+	}
+	// 応答があれば失敗回数は戻る
+	pm.Good("127.0.0.1:5001")
+	if pm.book["127.0.0.1:5001"].Failures != 0 {
+		t.Fatalf("failures = %d after a good response", pm.book["127.0.0.1:5001"].Failures)
+	}
+}
+
+// 他のノードには応答したことのあるアドレスを新しい順に教える
+func TestSharedAddresses(t *testing.T) {
+	pm := NewPeerManager("127.0.0.1:5000", nil, 0)
+	pm.AddAddress("127.0.0.1:5001", "")
+	pm.AddAddress("127.0.0.1:5002", "")
+	pm.AddAddress("127.0.0.1:5003", "")
+	pm.book["127.0.0.1:5001"].LastSeen = time.Now().Add(-time.Hour)
+	pm.book["127.0.0.1:5002"].LastSeen = time.Now()
+
+	shared := pm.SharedAddresses()
+	if len(shared) != 2 || shared[0].Address != "127.0.0.1:5002" || shared[1].Address != "127.0.0.1:5001" {
+		t.Fatalf("shared = %v", shared)
+	}
+	// 返したアドレスを書き換えてもアドレス帳は変わらない
+	shared[0].Score = MAX_PEER_SCORE
+	if pm.book["127.0.0.1:5002"].Score != 0 {
+		t.Fatal("shared address aliases the book")
+	}
+}
+
+// 接続を試みるアドレスはスコアの高い順で、通信中のピアは含めない
+func TestCandidates(t *testing.T) {
+	pm := NewPeerManager("127.0.0.1:5000", nil, 0)
+	for _, address := range []string{"127.0.0.1:5001", "127.0.0.1:5002", "127.0.0.1:5003"} {
+		pm.AddAddress(address, "")
+	}
+	pm.Good("127.0.0.1:5002")
+	pm.Good("127.0.0.1:5002")
+	pm.Good("127.0.0.1:5003")
+	pm.active["127.0.0.1:5003"] = true
+
+	got := pm.candidates()
+	if len(got) != 2 || got[0] != "127.0.0.1:5002" || got[1] != "127.0.0.1:5001" {
+		t.Fatalf("candidates = %v", got)
+	}
+}
+
+func TestDialable(t *testing.T) {
+	pm := NewPeerManager("127.0.0.1:5000", nil, 0)
+	pm.AddAddress("127.0.0.1:5001", "")
+	pm.Misbehaving("127.0.0.1:5001", PENALTY_INVALID_CHAIN, "invalid chain")
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"127.0.0.1:5002", true},
+		{"127.0.0.1:5001", false},
+		{"127.0.0.1:5000", false},
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := pm.Dialable(tt.address); got != tt.want {
+			t.Errorf("Dialable(%q) = %v, want %v", tt.address, got, tt.want)
+		}
+	}
+}
+
+// ノードIDで禁止したノードのアドレスには接続し返さず、接続も試みない
+func TestMisbehavingNode(t *testing.T) {
+	pm := NewPeerManager("127.0.0.1:5000", nil, 0)
+	pm.AddAddress("127.0.0.1:5001", "")
+	pm.SetNodeID("127.0.0.1:5001", "node1")
+
+	if pm.MisbehavingNode("node1", "", PENALTY_UNEXPECTED_BLOCK, "unexpected block") {
+		t.Fatal("node banned after a small penalty")
+	}
+	if !pm.MisbehavingNode("node1", "", PENALTY_INVALID_CHAIN, "invalid chain") {
+		t.Fatal("node not banned after an invalid chain")
+	}
+	if !pm.IsBannedNode("node1") || pm.IsBannedNode("node2") {
+		t.Fatal("wrong node banned")
+	}
+	// アドレスは禁止していないが、確認したノードIDが禁止されている
+	if pm.book["127.0.0.1:5001"].banned(time.Now()) {
+		t.Fatal("address banned without a verified address")
+	}
+	if pm.Dialable("127.0.0.1:5001") {
+		t.Fatal("address of a banned node is dialable")
+	}
+	if len(pm.candidates()) != 0 {
+		t.Fatalf("candidates = %v", pm.candidates())
+	}
+
+	// 確認済みのアドレスがあればアドレスのスコアも下げる
+	pm.AddAddress("127.0.0.1:5002", "")
+	pm.MisbehavingNode("node2", "127.0.0.1:5002", PENALTY_INVALID_CHAIN, "invalid chain")
+	if !pm.book["127.0.0.1:5002"].banned(time.Now()) || !pm.IsBannedNode("node2") {
+		t.Fatal("node and its address not banned")
+	}
+}
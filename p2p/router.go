@@ -0,0 +1,40 @@
+package p2p
+
+import (
+	"log"
+	"sync"
+)
+
+// 受信したメッセージの処理
+// エラーを返すと接続を切る
+type Handler func(c *Conn, m *Message) error
+
+// コマンドごとにメッセージを処理する関数を振り分ける
+// version, verack, ping, pongは接続自体が処理するため登録できない
+// headersとblocksはConn.Requestの応答として接続が処理する
+type Router struct {
+	mux      sync.RWMutex
+	handlers map[string]Handler
+}
+
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]Handler)}
+}
+
+func (r *Router) Handle(command string, h Handler) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.handlers[command] = h
+}
+
+func (r *Router) dispatch(c *Conn, m *Message) error {
+	r.mux.RLock()
+	h, ok := r.handlers[m.Command]
+	r.mux.RUnlock()
+	if !ok {
+		// 新しいバージョンのノードが送るコマンドは無視する
+		log.Printf("action=p2p_unknown_command, peer=%s, command=%s", c, m.Command)
+		return nil
+	}
+	return h(c, m)
+}
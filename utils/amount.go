@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// 金額は1コイン=10^8の最小単位の整数で扱う
+	AMOUNT_DECIMALS = 8
+	COIN            = 100000000
+)
+
+var (
+	ErrInvalidAmount   = errors.New("invalid amount")
+	ErrZeroAmount      = errors.New("amount must be greater than zero")
+	ErrAmountPrecision = fmt.Errorf("amount must have at most %d decimal places", AMOUNT_DECIMALS)
+	ErrAmountOverflow  = errors.New("amount is too large")
+)
+
+// 符号や指数表記は受け付けず、整数部と小数部のみを許可する
+var AMOUNT_PATTERN = regexp.MustCompile(`^([0-9]+)(\.([0-9]+))?$`)
+
+// 最小単位の整数を10進数の文字列に変換(ex. 150000000 -> "1.5")
+func FormatAmount(v uint64) string {
+	whole := v / COIN
+	frac := v % COIN
+	if frac == 0 {
+		return strconv.FormatUint(whole, 10)
+	}
+	fracStr := strings.TrimRight(fmt.Sprintf("%0*d", AMOUNT_DECIMALS, frac), "0")
+	return fmt.Sprintf("%d.%s", whole, fracStr)
+}
+
+// 10進数の文字列を最小単位の整数に変換(残高など0を含む値用)
+func ParseBalance(s string) (uint64, error) {
+	m := AMOUNT_PATTERN.FindStringSubmatch(s)
+	if m == nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidAmount, s)
+	}
+	fracStr := m[3]
+	if len(fracStr) > AMOUNT_DECIMALS {
+		return 0, fmt.Errorf("%w: %q", ErrAmountPrecision, s)
+	}
+	whole, err := strconv.ParseUint(m[1], 10, 64)
+	if err != nil || whole > math.MaxUint64/COIN {
+		return 0, fmt.Errorf("%w: %q", ErrAmountOverflow, s)
+	}
+	var frac uint64 = 0
+	if fracStr != "" {
+		// 足りない桁を0で埋めて最小単位に揃える
+		frac, _ = strconv.ParseUint(fracStr+strings.Repeat("0", AMOUNT_DECIMALS-len(fracStr)), 10, 64)
+	}
+	v := whole * COIN
+	if v > math.MaxUint64-frac {
+		return 0, fmt.Errorf("%w: %q", ErrAmountOverflow, s)
+	}
+	return v + frac, nil
+}
+
+// 送金額として10進数の文字列を最小単位の整数に変換(0や負の値、桁数超過は不可)
+func ParseAmount(s string) (uint64, error) {
+	v, err := ParseBalance(s)
+	if err != nil {
+		return 0, err
+	}
+	if v == 0 {
+		return 0, fmt.Errorf("%w: %q", ErrZeroAmount, s)
+	}
+	return v, nil
+}
+
+// 2つの金額の和(uint64に収まらない場合はfalse)
+func AddAmount(a uint64, b uint64) (uint64, bool) {
+	if a > math.MaxUint64-b {
+		return 0, false
+	}
+	return a + b, true
+}
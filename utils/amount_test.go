@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFormatAmount(t *testing.T) {
+	tests := []struct {
+		v    uint64
+		want string
+	}{
+		{0, "0"},
+		{1, "0.00000001"},
+		{150000000, "1.5"},
+		{2 * COIN, "2"},
+	}
+	for _, tt := range tests {
+		if got := FormatAmount(tt.v); got != tt.want {
+			t.Errorf("FormatAmount(%d) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		s    string
+		want uint64
+		err  error
+	}{
+		{"1.5", 150000000, nil},
+		{"0.00000001", 1, nil},
+		{"10", 10 * COIN, nil},
+		{"0", 0, ErrZeroAmount},
+		{"0.000000001", 0, ErrAmountPrecision},
+		{"-1", 0, ErrInvalidAmount},
+		{"1e8", 0, ErrInvalidAmount},
+		{"184467440738", 0, ErrAmountOverflow},
+	}
+	for _, tt := range tests {
+		got, err := ParseAmount(tt.s)
+		if !errors.Is(err, tt.err) || got != tt.want {
+			t.Errorf("ParseAmount(%q) = %d, %v, want %d, %v", tt.s, got, err, tt.want, tt.err)
+		}
+	}
+}
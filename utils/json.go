@@ -11,3 +11,15 @@ func JsonStatus(message string) []byte {
 	})
 	return m
 }
+
+// 失敗した理由を添えてstatusメッセージを返す
+func JsonStatusWithReason(message string, reason string) []byte {
+	m, _ := json.Marshal(struct {
+		Message string `json:"message"`
+		Reason  string `json:"reason"`
+	}{
+		Message: message,
+		Reason:  reason,
+	})
+	return m
+}
@@ -1,6 +1,7 @@
 package wallet
 
 import (
+	"block/block"
 	"block/utils"
 	"crypto/ecdsa"
 	"crypto/elliptic"
@@ -8,9 +9,6 @@ import (
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-
-	"github.com/btcsuite/btcutil/base58"
-	"golang.org/x/crypto/ripemd160"
 )
 
 type Wallet struct {
@@ -30,46 +28,13 @@ func NewWallet() *Wallet {
 	// privateKeyのstructにはpublickKeyとD(プライベートキー)いう要素が存在
 	w.publicKey = &w.privateKey.PublicKey
 
-	// 2. Perform SHA-256 hashing on the public key (32 bytes).
-	h2 := sha256.New()
-	h2.Write(w.publicKey.X.Bytes())
-	h2.Write(w.publicKey.Y.Bytes())
-	// nilになるまでスライス？の値を結合
-	digest2 := h2.Sum(nil)
-	// 3. Perform RIPEMD-160 hashing on the result of SHA-256 (20 bytes).
-	h3 := ripemd160.New()
-	h3.Write(digest2)
-	digest3 := h3.Sum(nil)
-	// 4. Add version byte in front of RIPEMD-160 hash (0x00 for Main Network).
-	// 1バイト目にvd４、2~21バイト目にdigest3を入れる
-	vd4 := make([]byte, 21)
-	vd4[0] = 0x00
-	copy(vd4[1:], digest3[:])
-	// 5. Perform SHA-256 hash on the extended RIPEMD-160 result.
-	// vd4を加工
-	h5 := sha256.New()
-	h5.Write(vd4)
-	digest5 := h5.Sum(nil)
-	// 6. Perform SHA-256 hash on the result of the previous SHA-256 hash.
-	// vd4を加工したdigest5を加工
-	h6 := sha256.New()
-	h6.Write(digest5)
-	digest6 := h6.Sum(nil)
-	// 7. Take the first 4 bytes of the second SHA-256 hash for checksum.
-	// digest6の1~4バイトを取得
-	chsum := digest6[:4]
-	// 8. Add the 4 checksum bytes from 7 at the end of extended RIPEMD-160 hash from 4 (25 bytes).
-	// vd4とchsumを結合
-	dc8 := make([]byte, 25)
-	copy(dc8[:21], vd4[:])
-	copy(dc8[21:], chsum[:])
-	// 9. Convert the result from a byte string into base58.
-	address := base58.Encode(dc8)
+	// 2.~9. publicKeyからブロックチェーンアドレスを生成
+	address := utils.PublicKeyToBlockchainAddress(w.publicKey)
 	w.blockchainAddress = address
 	return w
 }
 
-// signatureはtransactionのjsonをPrivateKeyで暗号化することで取得
+// signatureはtransactionのバイナリ形式のハッシュをPrivateKeyで署名することで取得
 
 func (w *Wallet) PrivateKey() *ecdsa.PrivateKey {
 	// 構造体全てを返す
@@ -113,32 +78,52 @@ type Transaction struct {
 	senderPubllicKey           *ecdsa.PublicKey
 	senderBlockchainAddress    string
 	recipientBlockchainAddress string
-	value                      float32
+	// 最小単位(1コイン=10^8)の整数で表した送金額
+	value uint64
+	// マイナーに支払う手数料
+	fee uint64
+	// 送信者ごとの連番(同じトランザクションの再送を防ぐ)
+	nonce uint64
 }
 
-func NewTransaction(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey, sender string, recipient string, value float32) *Transaction {
-	return &Transaction{privateKey, publicKey, sender, recipient, value}
+func NewTransaction(privateKey *ecdsa.PrivateKey, publicKey *ecdsa.PublicKey, sender string, recipient string, value uint64, fee uint64, nonce uint64) *Transaction {
+	return &Transaction{privateKey, publicKey, sender, recipient, value, fee, nonce}
 }
 
 func (t *Transaction) GenerateSignature() *utils.Signature {
-	// transactionをjson化
-	m, _ := json.Marshal(t)
-	// transactionをハッシュ化
-	h := sha256.Sum256([]byte(m))
+	// ノードが検証に使うものと同じバイナリ形式でtransactionをハッシュ化
+	m := block.NewTransaction(t.senderBlockchainAddress, t.recipientBlockchainAddress, t.value, t.fee, t.nonce).SigningBytes()
+	h := sha256.Sum256(m)
 	// privatekeyとtransactionで署名を作成
 	r, s, _ := ecdsa.Sign(rand.Reader, t.senderPrivateKey, h[:])
-	return &utils.Signature{r, s}
+	return &utils.Signature{R: r, S: s}
+}
+
+// UTXOモデルの場合、prevOutsを入力、おつりをchangeとしたトランザクションの各入力の署名を作成する
+func (t *Transaction) GenerateInputSignatures(prevOuts []block.OutPoint, change uint64) []*utils.Signature {
+	bt := block.NewUTXOTransaction(t.senderBlockchainAddress, t.recipientBlockchainAddress, t.value, t.fee, t.nonce, prevOuts, change)
+	signatures := make([]*utils.Signature, len(prevOuts))
+	for i := range prevOuts {
+		h := sha256.Sum256(bt.InputSigningBytes(i))
+		r, s, _ := ecdsa.Sign(rand.Reader, t.senderPrivateKey, h[:])
+		signatures[i] = &utils.Signature{R: r, S: s}
+	}
+	return signatures
 }
 
 func (t *Transaction) MarshalJSON() ([]byte, error) {
 	return json.Marshal(struct {
-		Sender    string  `json:"sender_blockchain_address"`
-		Recipient string  `json:"recipient_blockchain_address"`
-		Value     float32 `json:"value"`
+		Sender    string `json:"sender_blockchain_address"`
+		Recipient string `json:"recipient_blockchain_address"`
+		Value     string `json:"value"`
+		Fee       string `json:"fee"`
+		Nonce     uint64 `json:"nonce"`
 	}{
 		Sender:    t.senderBlockchainAddress,
 		Recipient: t.recipientBlockchainAddress,
-		Value:     t.value,
+		Value:     utils.FormatAmount(t.value),
+		Fee:       utils.FormatAmount(t.fee),
+		Nonce:     t.nonce,
 	})
 }
 
@@ -148,6 +133,7 @@ type TransactionRequest struct {
 	RecipientBlockchainAddress *string `json:"recipient_blockchain_address"`
 	SenderPublicKey            *string `json:"sender_public_key"`
 	Value                      *string `json:"value"`
+	Fee                        *string `json:"fee,omitempty"`
 }
 
 func (tr *TransactionRequest) Validate() bool {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"block/block"
 	"flag"
 	"log"
 )
@@ -12,8 +13,9 @@ func init() {
 func main() {
 	port := flag.Uint("port", 8080, "TCP Port Number for Wallet Server")
 	gateway := flag.String("gateway", "http://127.0.0.1:5000", "Blockchain Gateway")
+	ledger := flag.String("ledger", block.LEDGER_ACCOUNT, "Ledger model of the blockchain, account or utxo")
 	flag.Parse()
 
-	app := NewWalletServer(uint16(*port), *gateway)
+	app := NewWalletServer(uint16(*port), *gateway, *ledger)
 	app.Run()
 }
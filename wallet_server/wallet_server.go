@@ -11,6 +11,7 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"path"
 	"strconv"
 )
@@ -21,10 +22,12 @@ type WalletServer struct {
 	port uint16
 	// 接続するブロックチェーンノードのアドレス(ex. 0.0.0.0:5000)
 	gateway string
+	// ノードと同じ台帳のモデル(accountかutxo)
+	ledger string
 }
 
-func NewWalletServer(port uint16, gateway string) *WalletServer {
-	return &WalletServer{port, gateway}
+func NewWalletServer(port uint16, gateway string, ledger string) *WalletServer {
+	return &WalletServer{port, gateway, ledger}
 }
 
 func (ws *WalletServer) Port() uint16 {
@@ -84,36 +87,106 @@ func (ws *WalletServer) CreateTransaction(w http.ResponseWriter, req *http.Reque
 		// SenderPublicKeyはポインタ型(*string)
 		publicKey := utils.PublicKeyFromString(*t.SenderPublicKey)
 		privateKey := utils.PrivateKeyFromString(*t.SenderPrivateKey, publicKey)
-		value, err := strconv.ParseFloat(*t.Value, 32)
+		value, err := utils.ParseAmount(*t.Value)
 		if err != nil {
-			log.Println("ERROR: parse error")
-			io.WriteString(w, string(utils.JsonStatus("fail")))
+			log.Printf("ERROR: %v", err)
+			io.WriteString(w, string(utils.JsonStatusWithReason("fail", err.Error())))
 			return
 		}
-		value32 := float32(value)
+		// 手数料は任意(未入力の場合は0)
+		var fee uint64 = 0
+		if t.Fee != nil && *t.Fee != "" {
+			fee, err = utils.ParseBalance(*t.Fee)
+			if err != nil {
+				log.Printf("ERROR: %v", err)
+				io.WriteString(w, string(utils.JsonStatusWithReason("fail", err.Error())))
+				return
+			}
+		}
+		// 署名と送信に使う正規化された10進数の文字列(ex. "1.50" -> "1.5")
+		valueStr := utils.FormatAmount(value)
+		feeStr := utils.FormatAmount(fee)
 
 		w.Header().Add("Content-Type", "application/json")
 
-		transaction := wallet.NewTransaction(privateKey, publicKey, *t.SenderBlockchainAddress, *t.RecipientBlockchainAddress, value32)
-		signature := transaction.GenerateSignature()
-		signatureStr := signature.String()
+		nonce, err := ws.NextNonce(*t.SenderBlockchainAddress)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+
+		transaction := wallet.NewTransaction(privateKey, publicKey, *t.SenderBlockchainAddress, *t.RecipientBlockchainAddress, value, fee, nonce)
 
 		bt := &block.TransactionRequest{
-			t.SenderBlockchainAddress,
-			t.RecipientBlockchainAddress,
-			t.SenderPublicKey,
-			&value32, &signatureStr,
+			SenderBlockchainAddress:    t.SenderBlockchainAddress,
+			RecipientBlockchainAddress: t.RecipientBlockchainAddress,
+			SenderPublicKey:            t.SenderPublicKey,
+			Value:                      &valueStr,
+			Fee:                        &feeStr,
+			Nonce:                      &nonce,
+		}
+		if ws.ledger == block.LEDGER_UTXO {
+			// 送金額と手数料を賄える分の未使用の出力を入力にし、残りはおつりとして自分に戻す
+			utxos, err := ws.SpendableUTXOs(*t.SenderBlockchainAddress)
+			if err != nil {
+				log.Printf("ERROR: %v", err)
+				io.WriteString(w, string(utils.JsonStatus("fail")))
+				return
+			}
+			total, ok := utils.AddAmount(value, fee)
+			if !ok {
+				log.Printf("ERROR: %v", utils.ErrAmountOverflow)
+				io.WriteString(w, string(utils.JsonStatusWithReason("fail", utils.ErrAmountOverflow.Error())))
+				return
+			}
+			prevOuts, change, err := selectUTXOs(utxos, total)
+			if err != nil {
+				log.Printf("ERROR: %v", err)
+				io.WriteString(w, string(utils.JsonStatusWithReason("fail", err.Error())))
+				return
+			}
+			signatures := transaction.GenerateInputSignatures(prevOuts, change)
+			for i, op := range prevOuts {
+				bt.Inputs = append(bt.Inputs, &block.TxInputRequest{
+					TxID:      fmt.Sprintf("%x", op.TxID),
+					Index:     op.Index,
+					Signature: signatures[i].String(),
+				})
+			}
+			bt.Outputs = append(bt.Outputs, &block.TxOutputRequest{Address: *t.RecipientBlockchainAddress, Value: valueStr})
+			if change > 0 {
+				bt.Outputs = append(bt.Outputs, &block.TxOutputRequest{Address: *t.SenderBlockchainAddress, Value: utils.FormatAmount(change)})
+			}
+		} else {
+			signatureStr := transaction.GenerateSignature().String()
+			bt.Signature = &signatureStr
 		}
 
 		m, _ := json.Marshal(bt)
 		buf := bytes.NewBuffer(m)
 
-		resp, _ := http.Post(ws.Gateway()+"/transactions", "application/json", buf)
+		resp, err := http.Post(ws.Gateway()+"/transactions", "application/json", buf)
+		if err != nil {
+			log.Printf("ERROR: %v", err)
+			io.WriteString(w, string(utils.JsonStatus("fail")))
+			return
+		}
+		defer resp.Body.Close()
 		if resp.StatusCode == 201 {
-			io.WriteString(w, string(utils.JsonStatus("success")))
+			// 承認状況の確認に使えるよう、ノードが計算したトランザクションIDを返す
+			var tcr block.TransactionCreatedResponse
+			if err := json.NewDecoder(resp.Body).Decode(&tcr); err != nil {
+				log.Printf("ERROR: %v", err)
+				io.WriteString(w, string(utils.JsonStatus("fail")))
+				return
+			}
+			m, _ := json.Marshal(&tcr)
+			io.WriteString(w, string(m))
 			return
 		}
-		io.WriteString(w, string(utils.JsonStatus("fail")))
+		// ブロックチェーンノードが返した拒否理由をそのままフロントに返す
+		io.Copy(w, resp.Body)
 		/*
 			fmt.Println(*t.SenderPublicKey)
 			fmt.Println(*t.SenderPrivateKey)
@@ -127,6 +200,67 @@ func (ws *WalletServer) CreateTransaction(w http.ResponseWriter, req *http.Reque
 	}
 }
 
+// 入力に使える未使用の出力をブロックチェーンノードに問い合わせる
+func (ws *WalletServer) SpendableUTXOs(blockchainAddress string) ([]*block.UTXO, error) {
+	endpoint := fmt.Sprintf("%s/addresses/%s/utxos", ws.Gateway(), url.PathEscape(blockchainAddress))
+	resp, err := http.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("utxos request failed: %s", resp.Status)
+	}
+	var v struct {
+		UTXOs []*block.UTXO `json:"utxos"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return v.UTXOs, nil
+}
+
+// 古い出力から順にamount以上になるまで選び、選んだ出力とおつりを返す
+func selectUTXOs(utxos []*block.UTXO, amount uint64) ([]block.OutPoint, uint64, error) {
+	prevOuts := make([]block.OutPoint, 0)
+	var total uint64 = 0
+	for _, u := range utxos {
+		if total >= amount {
+			break
+		}
+		prevOuts = append(prevOuts, u.OutPoint)
+		total += u.Output.Value()
+	}
+	if total < amount {
+		return nil, 0, block.ErrInsufficientBalance
+	}
+	return prevOuts, total - amount, nil
+}
+
+// 送信者が次に使うべきnonceをブロックチェーンノードに問い合わせる
+func (ws *WalletServer) NextNonce(blockchainAddress string) (uint64, error) {
+	endpoint := fmt.Sprintf("%s/nonce", ws.Gateway())
+	bcsReq, _ := http.NewRequest("GET", endpoint, nil)
+	q := bcsReq.URL.Query()
+	q.Add("blockchain_address", blockchainAddress)
+	bcsReq.URL.RawQuery = q.Encode()
+
+	client := &http.Client{}
+	bcsResp, err := client.Do(bcsReq)
+	if err != nil {
+		return 0, err
+	}
+	defer bcsResp.Body.Close()
+	if bcsResp.StatusCode != 200 {
+		return 0, fmt.Errorf("nonce request failed: %s", bcsResp.Status)
+	}
+	var nr block.NonceResponse
+	if err := json.NewDecoder(bcsResp.Body).Decode(&nr); err != nil {
+		return 0, err
+	}
+	return nr.Nonce, nil
+}
+
 func (ws *WalletServer) WalletAmount(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case http.MethodGet:
@@ -162,11 +296,11 @@ func (ws *WalletServer) WalletAmount(w http.ResponseWriter, req *http.Request) {
 				return
 			}
 			m, _ := json.Marshal(struct {
-				Message string  `json:"message"`
-				Amount  float32 `json:"amount"`
+				Message string `json:"message"`
+				Amount  string `json:"amount"`
 			}{
 				Message: "success",
-				Amount:  bar.Amount,
+				Amount:  utils.FormatAmount(bar.Amount),
 			})
 			io.WriteString(w, string(m[:]))
 		} else {